@@ -50,31 +50,25 @@ func main() {
 
 	conn = tlsConn
 
-	buff := make([]byte, 4096)
-
-	_, err = conn.Read(buff)
+	p, err := nodosum.Pack(int(nodosum.HELLO), []byte("CLI"), "")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	pack, err := nodosum.unpack(buff)
+	_, err = conn.Write(p)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if pack.Command != nodosum.HELLO {
-		log.Fatal("Server handshake failed")
-	}
-
-	p, err := nodosum.pack(nodosum.HELLO, []byte("CLI-"+string(pack.Data)), "")
+	pack, err := nodosum.ReadPacket(conn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	_, err = conn.Write(p)
-	if err != nil {
-		log.Fatal(err)
+	if pack.Command != int(nodosum.HELLO) {
+		log.Fatal("Server handshake failed")
 	}
+	fmt.Println("Connected to node " + string(pack.Data))
 
 	scanner := bufio.NewScanner(os.Stdin)
 
@@ -95,7 +89,7 @@ func main() {
 				}
 
 				if args[0] == "exit" {
-					p, err := nodosum.pack(nodosum.EXIT, nil, token)
+					p, err := nodosum.Pack(nodosum.EXIT, nil, token)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -113,7 +107,7 @@ func main() {
 				}
 
 				if args[0] == "id" {
-					p, err := nodosum.pack(nodosum.ID, nil, token)
+					p, err := nodosum.Pack(nodosum.ID, nil, token)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -122,20 +116,38 @@ func main() {
 						log.Fatal(err)
 					}
 
-					buff := make([]byte, 40960000)
-					n, err := conn.Read(buff)
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
-					pack, err := nodosum.unpack(buff[:n])
+					fmt.Println(string(pack.Data))
+				}
+
+				if args[0] == "set" {
+					// set <token> <application> <key> <value>
+					p, err := nodosum.Pack(nodosum.SET, []byte(strings.Join(args[2:], " ")), token)
+					if err != nil {
+						log.Fatal(err)
+					}
+					_, err = conn.Write(p)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
 					fmt.Println(string(pack.Data))
 				}
 
-				if args[0] == "set" {
-					p, err := nodosum.pack(nodosum.SET, []byte(args[2]), token)
+				if args[0] == "audit" {
+					// audit <token> [limit]
+					var limit []byte
+					if len(args) > 2 {
+						limit = []byte(args[2])
+					}
+					p, err := nodosum.Pack(nodosum.AUDIT, limit, token)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -144,20 +156,38 @@ func main() {
 						log.Fatal(err)
 					}
 
-					buff := make([]byte, 40960000)
-					n, err := conn.Read(buff)
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
-					pack, err := nodosum.unpack(buff[:n])
+					fmt.Print(string(pack.Data))
+				}
+
+				if args[0] == "rotate" || args[0] == "retire" {
+					// rotate <token> <new secret>, retire <token> <old secret>
+					cmd := nodosum.ROTATE
+					if args[0] == "retire" {
+						cmd = nodosum.RETIRE
+					}
+					p, err := nodosum.Pack(cmd, []byte(args[2]), token)
+					if err != nil {
+						log.Fatal(err)
+					}
+					_, err = conn.Write(p)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
 					fmt.Println(string(pack.Data))
 				}
 
-				if args[0] == "get" {
-					p, err := nodosum.pack(nodosum.GET, []byte(args[2]), token)
+				if args[0] == "chaos" {
+					// chaos <token> fault|clear|partition|heal|reset|status [args...]
+					p, err := nodosum.Pack(nodosum.CHAOS, []byte(strings.Join(args[2:], " ")), token)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -166,12 +196,25 @@ func main() {
 						log.Fatal(err)
 					}
 
-					buff := make([]byte, 40960000)
-					n, err := conn.Read(buff)
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
-					pack, err := nodosum.unpack(buff[:n])
+					fmt.Print(string(pack.Data))
+				}
+
+				if args[0] == "get" {
+					// get <token> <application> <key>
+					p, err := nodosum.Pack(nodosum.GET, []byte(strings.Join(args[2:], " ")), token)
+					if err != nil {
+						log.Fatal(err)
+					}
+					_, err = conn.Write(p)
+					if err != nil {
+						log.Fatal(err)
+					}
+
+					pack, err := nodosum.ReadPacket(conn)
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"io"
 	"log/slog"
 	"net"
 	"net/url"
@@ -20,6 +21,35 @@ const (
 	DC_MODE_STATIC
 )
 
+const (
+	// RATE_LIMIT_THROTTLE delays reading from a connection until it is within its limits again
+	RATE_LIMIT_THROTTLE = iota
+	// RATE_LIMIT_DISCONNECT closes a connection as soon as it exceeds its limits
+	RATE_LIMIT_DISCONNECT
+)
+
+const (
+	// COMPRESSION_NONE sends all payloads uncompressed
+	COMPRESSION_NONE = iota
+	// COMPRESSION_GZIP compresses payloads with gzip
+	COMPRESSION_GZIP
+	// COMPRESSION_ZSTD compresses payloads with zstd
+	COMPRESSION_ZSTD
+	// COMPRESSION_SNAPPY compresses payloads with snappy
+	COMPRESSION_SNAPPY
+)
+
+const (
+	// SEND_QUEUE_BLOCK waits for space in the send queue of a node
+	SEND_QUEUE_BLOCK = iota
+	// SEND_QUEUE_DROP_OLDEST drops the oldest queued frame to make space
+	SEND_QUEUE_DROP_OLDEST
+	// SEND_QUEUE_DROP_NEWEST drops the frame that is sent
+	SEND_QUEUE_DROP_NEWEST
+	// SEND_QUEUE_ERROR fails the send
+	SEND_QUEUE_ERROR
+)
+
 type Config struct {
 	Ctx    context.Context
 	Logger *slog.Logger
@@ -47,6 +77,37 @@ type Config struct {
 		so it's safe to include a complete list of all node addresses
 	*/
 	NodeAddrs []net.TCPAddr
+	/*
+		ReconnectInterval is how often lost connections to NodeAddrs are redialed.
+
+		Default: 1 second
+	*/
+	ReconnectInterval time.Duration
+	/*
+		ConnectionsPerPeer is the number of connections opened to every other node.
+		Frames are distributed over them by application, stream or blob, frames of one of them stay in order.
+		More connections can saturate fast links that a single TCP stream and TLS session can not, at most 64.
+
+		Default: 1
+	*/
+	ConnectionsPerPeer int
+	/*
+		MaxFrameSize is the largest frame in bytes this node accepts from other nodes.
+		Nodes agree on the smaller of both limits when they connect. A node sending a bigger frame,
+		or one with an invalid header, is disconnected and the protocol violation counted.
+		It has to be bigger than FragmentSize.
+
+		Default: 16MB
+	*/
+	MaxFrameSize int
+	/*
+		BroadcastFanout makes broadcasts travel along a tree: the sending node only sends to this many nodes,
+		which relay the message to the rest of the cluster the same way. With 0, or with reliable delivery,
+		the sending node sends every broadcast to all nodes itself. At most 255.
+
+		Default: 0
+	*/
+	BroadcastFanout int
 	/*
 		HttpClientTLSEnabled if true, supply HttpClientTLSCACert and HttpClientTLSCert
 		to authenticate with Consul API
@@ -59,9 +120,16 @@ type Config struct {
 		SingleMode disables all Cluster features but leaves the listener enabled for the CLI.
 		A node in SingleMode will reject all connections besides ones identified as an Authenticated CLI instance.
 	*/
-	SingleMode   bool
-	ListenPort   int
-	SharedSecret string
+	SingleMode bool
+	ListenPort int
+	/*
+		SharedSecret is the primary cluster secret.
+		PreviousSharedSecrets are still accepted from peers,
+		which allows rotating the secret during a rolling deploy without a cluster wide restart.
+		Secrets can also be rotated at runtime with RotateSharedSecret or from Pulse.
+	*/
+	SharedSecret          string
+	PreviousSharedSecrets []string
 	/*
 		HandshakeTimeout defines the duration in which a client has to answer before conn is dropped.
 
@@ -74,6 +142,122 @@ type Config struct {
 	ClusterTLSCert         *tls.Certificate
 	MultiplexerBufferSize  int
 	MultiplexerWorkerCount int
+	/*
+		AuditSink receives one JSON line per privileged command issued from Pulse (SET, ID, AUDIT, ROTATE...)
+		with the caller, command, application, key and outcome.
+		Leave nil to only keep entries in memory.
+	*/
+	AuditSink io.Writer
+	/*
+		AuditBufferSize is the amount of recent audit entries kept in memory to be queried from Pulse.
+
+		Default: 1000
+	*/
+	AuditBufferSize int
+	/*
+		PeerRoles maps the TLS certificate common name of a cluster peer to its roles.
+		Applications can restrict inbound traffic to peers with specific identities or roles.
+	*/
+	PeerRoles map[string][]string
+	/*
+		MaxConnections caps the amount of concurrent cluster and CLI connections,
+		MaxConnectionsPerIP caps them per remote IP.
+		MaxHandshakes caps the amount of TLS and node handshakes running at the same time.
+		0 disables a limit.
+
+		Default: 1024, 64, 32
+	*/
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxHandshakes       int
+	/*
+		ConnFrameRate and ConnByteRate limit the frames and bytes per second
+		a single connection may send to this node. 0 disables a limit.
+	*/
+	ConnFrameRate float64
+	ConnByteRate  float64
+	/*
+		RateLimitAction decides what happens to a connection exceeding its rate limits
+
+		Delay reading from the connection
+		RATE_LIMIT_THROTTLE
+
+		Close the connection
+		RATE_LIMIT_DISCONNECT
+	*/
+	RateLimitAction int
+	/*
+		Compression selects the algorithm used for application payloads of at least CompressionThreshold bytes.
+		One of COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD or COMPRESSION_SNAPPY.
+		Nodes announce the algorithms they can decompress when they connect, payloads to a node
+		that does not support the configured algorithm are sent uncompressed. So nodes may use different settings.
+
+		Default: COMPRESSION_ZSTD, 50kb
+	*/
+	Compression          int
+	CompressionThreshold int
+	/*
+		FragmentSize is the maximum payload size of a single frame.
+		Bigger payloads are split into fragments, so they do not block other traffic on a connection.
+		MaxMessageSize caps the size of a reassembled or decompressed message. Blobs are not limited,
+		but one is aborted once more than MaxMessageSize of it is buffered, unread by its receive function.
+
+		Default: 64kb, 64mb
+	*/
+	FragmentSize   int
+	MaxMessageSize int
+	/*
+		RetransmitInterval is the time after which messages of applications with reliable delivery
+		are sent again if the receiving node did not acknowledge them.
+
+		Default: 1 second
+	*/
+	RetransmitInterval time.Duration
+	/*
+		SendQueueSize is the number of frames that can be queued for a single node.
+		SendQueuePolicy decides what Application.Send does if the queue of a receiving node is full.
+
+		Wait for space until the context is done
+		SEND_QUEUE_BLOCK
+
+		Drop the oldest queued message that was not fragmented
+		SEND_QUEUE_DROP_OLDEST
+
+		Drop the message that is sent
+		SEND_QUEUE_DROP_NEWEST
+
+		Fail with ErrSendQueueFull
+		SEND_QUEUE_ERROR
+
+		Default: 1024, SEND_QUEUE_BLOCK
+	*/
+	SendQueueSize   int
+	SendQueuePolicy int
+	/*
+		HeartbeatInterval is the interval in which every connection pings its peer to measure the round trip time.
+		IdleTimeout is the time after which a connection that received nothing, not even a heartbeat, is closed.
+
+		Default: 1 second, 10 seconds
+	*/
+	HeartbeatInterval time.Duration
+	IdleTimeout       time.Duration
+	/*
+		MaxConcurrentRequests is the number of request handlers running at the same time on this node.
+		Requests beyond it fail with a RemoteError on the calling node.
+
+		Default: 256
+	*/
+	MaxConcurrentRequests int
+	/*
+		Transport is the network the node runs on.
+		NewTCPTransport listens on TCP and UDP, NewUnixTransport on Unix domain sockets
+		for processes on the same host and MemoryNetwork connects nodes within one process.
+		ClusterTLSEnabled applies to every transport.
+		Chaos.Transport wraps any of them to inject faults in tests, controllable from Pulse with the chaos command.
+
+		Default: TCP and UDP on ListenPort
+	*/
+	Transport Transport
 }
 
 func GetDefaultConfig() *Config {
@@ -87,8 +271,26 @@ func GetDefaultConfig() *Config {
 		SingleMode:             false,
 		ListenPort:             6969,
 		NodeAddrs:              []net.TCPAddr{},
+		ReconnectInterval:      time.Second,
+		ConnectionsPerPeer:     1,
+		MaxFrameSize:           16 * 1024 * 1024,
 		HandshakeTimeout:       2 * time.Second,
 		MultiplexerBufferSize:  1024,
 		MultiplexerWorkerCount: 1,
+		AuditBufferSize:        1000,
+		MaxConnections:         1024,
+		MaxConnectionsPerIP:    64,
+		MaxHandshakes:          32,
+		RateLimitAction:        RATE_LIMIT_THROTTLE,
+		Compression:            COMPRESSION_ZSTD,
+		CompressionThreshold:   50 * 1024,
+		FragmentSize:           64 * 1024,
+		MaxMessageSize:         64 * 1024 * 1024,
+		RetransmitInterval:     time.Second,
+		SendQueueSize:          1024,
+		SendQueuePolicy:        SEND_QUEUE_BLOCK,
+		HeartbeatInterval:      time.Second,
+		IdleTimeout:            10 * time.Second,
+		MaxConcurrentRequests:  256,
 	}
 }
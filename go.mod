@@ -7,4 +7,5 @@ replace github.com/conamu/go-worker v0.0.0-20250929233913-1ff4ec154b65 => /Users
 require (
 	github.com/conamu/go-worker v0.0.0-20250929233913-1ff4ec154b65
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.20.1
 )
@@ -1,5 +1,12 @@
 package nodosum
 
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
 /*
 ACLs work with applications to enable secure controlflow.
 Permission structure could be someting like
@@ -8,27 +15,61 @@ ex.: CACHE:SET
 ex.: CACHE:USER:READ
 */
 
+// Commands that can be issued over a CLI connection. HELLO is shared with the handshake.
+const (
+	EXIT = iota + 1
+	ID
+	SET
+	GET
+	AUDIT
+	ROTATE
+	RETIRE
+	CHAOS
+	// ERROR answers a command that was denied or failed, it can not be issued
+	ERROR
+)
+
+var commandNames = map[int]string{
+	int(HELLO): "HELLO",
+	EXIT:       "EXIT",
+	ID:         "ID",
+	SET:        "SET",
+	GET:        "GET",
+	AUDIT:      "AUDIT",
+	ROTATE:     "ROTATE",
+	RETIRE:     "RETIRE",
+	CHAOS:      "CHAOS",
+	ERROR:      "ERROR",
+}
+
 var godToken = token{
-	token: "token",
+	token:   "token",
+	subject: "god",
 	commands: map[int]bool{
-		EXIT:  true,
-		HELLO: true,
-		ID:    true,
-		SET:   true,
+		EXIT:       true,
+		int(HELLO): true,
+		ID:         true,
+		SET:        true,
+		AUDIT:      true,
+		ROTATE:     true,
+		RETIRE:     true,
+		CHAOS:      true,
 	},
 }
 
 var anonymousToken = token{
-	token: "",
+	token:   "",
+	subject: "anonymous",
 	commands: map[int]bool{
-		EXIT:  true,
-		HELLO: true,
-		GET:   true,
+		EXIT:       true,
+		int(HELLO): true,
+		GET:        true,
 	},
 }
 
 type token struct {
 	token    string
+	subject  string
 	commands map[int]bool
 }
 
@@ -46,3 +87,141 @@ func middleware(cmd int, token string) bool {
 
 	return false
 }
+
+// privileged reports whether cmd requires more than the anonymous token.
+func privileged(cmd int) bool {
+	return !anonymousToken.commands[cmd]
+}
+
+// tokenSubject resolves the subject a token was issued to.
+func tokenSubject(token string) string {
+	switch token {
+	case anonymousToken.token:
+		return anonymousToken.subject
+	case godToken.token:
+		return godToken.subject
+	default:
+		return "unknown"
+	}
+}
+
+func commandName(cmd int) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+/*
+Sender policies restrict which peers may send frames to an application.
+A peer is identified by the common name of its TLS certificate and carries the roles
+configured for that identity in Config.PeerRoles.
+An application without a declared policy accepts frames from every peer.
+*/
+
+type senderPolicy struct {
+	mu         sync.RWMutex
+	declared   bool
+	identities map[string]bool
+	roles      map[string]bool
+	denied     atomic.Uint64
+}
+
+func newSenderPolicy() *senderPolicy {
+	return &senderPolicy{
+		identities: make(map[string]bool),
+		roles:      make(map[string]bool),
+	}
+}
+
+func (p *senderPolicy) allow(identities, roles []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.declared = true
+	for _, id := range identities {
+		p.identities[id] = true
+	}
+	for _, role := range roles {
+		p.roles[role] = true
+	}
+}
+
+func (p *senderPolicy) permits(identity string, roles []string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if !p.declared {
+		return true
+	}
+	if identity != "" && p.identities[identity] {
+		return true
+	}
+	for _, role := range roles {
+		if p.roles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// senderAllowed checks the sending connection against the application's sender policy.
+// Denied frames are counted on the policy and logged.
+func (n *Nodosum) senderAllowed(app *application, connId uint32) bool {
+	var nc *nodeConn
+	if v, ok := n.connections.Load(connId); ok && v != nil {
+		nc = v.(*nodeConn)
+	}
+	return n.peerAllowed(app, connId, nc)
+}
+
+// originAllowed checks the node a broadcast originates from against the application's sender policy.
+// The identity of an origin this node is not connected to is unknown, it is only allowed by an undeclared policy.
+func (n *Nodosum) originAllowed(app *application, connId uint32, origin string) bool {
+	nc, _ := n.nodeConnection(origin)
+	return n.peerAllowed(app, connId, nc)
+}
+
+// peerAllowed checks the identity and roles of a peer against the application's sender policy, nc may be nil.
+func (n *Nodosum) peerAllowed(app *application, connId uint32, nc *nodeConn) bool {
+	identity := ""
+	var roles []string
+	if nc != nil {
+		identity = nc.identity
+		roles = nc.roles
+	}
+
+	if app.senders.permits(identity, roles) {
+		return true
+	}
+
+	app.senders.denied.Add(1)
+	n.logger.Warn("denied inbound frame", "application", app.id, "conn", connId, "identity", identity, "roles", roles)
+	return false
+}
+
+// DeniedFrames returns the number of inbound frames rejected by the sender policy of an application.
+func (n *Nodosum) DeniedFrames(applicationId uint32) uint64 {
+	v, ok := n.applications.Load(applicationId)
+	if !ok || v == nil {
+		return 0
+	}
+	app := v.(*application)
+	return app.senders.denied.Load()
+}
+
+// peerIdentity returns the common name of the peer certificate of a TLS connection.
+func peerIdentity(conn net.Conn) string {
+	if pc, ok := conn.(*peekedConn); ok {
+		conn = pc.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
@@ -0,0 +1,161 @@
+package nodosum
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the common names of nodes, valid for the host name "node".
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t: t, cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(commonName string) *tls.Certificate {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSNode starts a node on the memory network with a certificate for its ID issued by ca.
+func newTLSNode(t *testing.T, memory *MemoryNetwork, ca *testCA, id string, peerRoles map[string][]string, configure ...func(*Config)) *Nodosum {
+	t.Helper()
+	tlsConfig := func(cfg *Config) {
+		cfg.TlsEnabled = true
+		cfg.TlsHostName = "node"
+		cfg.TlsCACert = ca.pool
+		cfg.TlsCert = ca.issue(id)
+		cfg.PeerRoles = peerRoles
+	}
+	return newTransportNode(t, id, memory.Transport(id), append([]func(*Config){tlsConfig}, configure...)...)
+}
+
+func TestSenderPolicyOverTLS(t *testing.T) {
+	memory := NewMemoryNetwork()
+	ca := newTestCA(t)
+	a := newTLSNode(t, memory, ca, "a", map[string][]string{"c": {"writer"}, "d": {"reader"}})
+
+	receiver, received := addNamedApplication(t, a, "ledger")
+	receiver.AllowSenders([]string{"b"}, []string{"writer"})
+
+	senders := make(map[string]*application)
+	for _, id := range []string{"b", "c", "d"} {
+		n := newTLSNode(t, memory, ca, id, nil)
+		if _, err := n.Connect(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+		senders[id], _ = addNamedApplication(t, n, "ledger")
+	}
+	waitForApplicationNodes(t, a, "ledger", []string{"b", "c", "d"})
+
+	// b is allowed by identity, c by the role configured for its identity, d has neither
+	for _, id := range []string{"b", "c", "d"} {
+		if err := senders[id].Send([]byte("from "+id), []string{"a"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string]bool)
+	deadline := time.After(5 * time.Second)
+	for len(got) < 2 || receiver.DeniedFrames() == 0 {
+		select {
+		case payload := <-received:
+			got[string(payload.([]byte))] = true
+		case <-deadline:
+			t.Fatalf("Expected frames of b and c and a denied frame, got %v and %d denied", got, receiver.DeniedFrames())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	if !got["from b"] || !got["from c"] || len(got) != 2 {
+		t.Errorf("Expected frames of b and c, got %v", got)
+	}
+	if denied := receiver.DeniedFrames(); denied != 1 {
+		t.Errorf("Expected 1 denied frame, got %d", denied)
+	}
+	if denied := a.DeniedFrames(receiver.id); denied != 1 {
+		t.Errorf("Expected 1 denied frame by ID, got %d", denied)
+	}
+}
+
+func TestTLSRequiresClientCertificate(t *testing.T) {
+	memory := NewMemoryNetwork()
+	ca := newTestCA(t)
+	// Pipes of the memory network block the alert of the server until the handshake times out
+	newTLSNode(t, memory, ca, "a", nil, func(cfg *Config) { cfg.HandshakeTimeout = 100 * time.Millisecond })
+
+	// Signed by another CA but trusting the one of the cluster, so only the server can tell
+	outsider := newTransportNode(t, "outsider", memory.Transport("outsider"), func(cfg *Config) {
+		cfg.TlsEnabled = true
+		cfg.TlsHostName = "node"
+		cfg.TlsCACert = ca.pool
+		cfg.TlsCert = newTestCA(t).issue("outsider")
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := outsider.Connect(ctx, "a"); err == nil {
+		t.Fatal("Expected a node with a certificate of another CA to be rejected")
+	}
+
+	member := newTLSNode(t, memory, ca, "b", nil)
+	if _, err := member.Connect(context.Background(), "a"); err != nil {
+		t.Fatalf("Expected a node with a certificate of the cluster CA to connect, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package nodosum
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Admission control protects a node from misbehaving clients.
+
+Before a connection is handed to a goroutine it has to be admitted:
+the total amount of connections and the amount of connections per remote IP are capped.
+TLS and node handshakes are limited in concurrency so a flood of new connections
+cannot starve established ones.
+Once established, every connection can be limited in frames and bytes per second.
+A connection exceeding its limits is either throttled or disconnected.
+
+A limit of 0 disables it.
+*/
+
+const (
+	// RATE_LIMIT_THROTTLE delays reading from a connection until it is within its limits again
+	RATE_LIMIT_THROTTLE = iota
+	// RATE_LIMIT_DISCONNECT closes a connection as soon as it exceeds its limits
+	RATE_LIMIT_DISCONNECT
+)
+
+type admission struct {
+	mu            sync.Mutex
+	maxConns      int
+	maxConnsPerIP int
+	active        int
+	perIP         map[string]int
+	handshakes    chan struct{}
+}
+
+func newAdmission(maxConns, maxConnsPerIP, maxHandshakes int) *admission {
+	a := &admission{
+		maxConns:      maxConns,
+		maxConnsPerIP: maxConnsPerIP,
+		perIP:         make(map[string]int),
+	}
+	if maxHandshakes > 0 {
+		a.handshakes = make(chan struct{}, maxHandshakes)
+	}
+	return a
+}
+
+// admit reserves a connection slot for addr. Every admitted connection has to be released.
+func (a *admission) admit(addr net.Addr) bool {
+	ip := remoteIP(addr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxConns > 0 && a.active >= a.maxConns {
+		return false
+	}
+	if a.maxConnsPerIP > 0 && a.perIP[ip] >= a.maxConnsPerIP {
+		return false
+	}
+
+	a.active++
+	a.perIP[ip]++
+	return true
+}
+
+func (a *admission) release(addr net.Addr) {
+	ip := remoteIP(addr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.active > 0 {
+		a.active--
+	}
+	if a.perIP[ip] <= 1 {
+		delete(a.perIP, ip)
+		return
+	}
+	a.perIP[ip]--
+}
+
+// acquireHandshake waits for a free handshake slot until timeout or ctx is done.
+func (a *admission) acquireHandshake(ctx context.Context, timeout time.Duration) bool {
+	if a.handshakes == nil {
+		return true
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case a.handshakes <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *admission) releaseHandshake() {
+	if a.handshakes == nil {
+		return
+	}
+	<-a.handshakes
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// rateLimiter is a token bucket refilled with rate tokens per second up to burst.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+// newRateLimiter returns nil for a rate <= 0, a nil limiter never limits.
+func newRateLimiter(rate float64, clock Clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  rate,
+		tokens: rate,
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// reserve takes n tokens and returns how long the caller has to wait until they are available.
+func (r *rateLimiter) reserve(n float64) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	r.tokens -= n
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// enforceRateLimits accounts a frame of frameLength bytes against the limits of a connection.
+// It returns false if the connection has to be dropped.
+func (n *Nodosum) enforceRateLimits(nc *nodeConn, frameLength int) bool {
+	wait := nc.frameLimiter.reserve(1)
+	if byteWait := nc.byteLimiter.reserve(float64(frameLength)); byteWait > wait {
+		wait = byteWait
+	}
+	if wait == 0 {
+		return true
+	}
+
+	if n.rateLimitAction == RATE_LIMIT_DISCONNECT {
+		n.logger.Warn("connection exceeded rate limit, disconnecting", "conn", nc.connId, "remote", nc.addr)
+		return false
+	}
+
+	n.logger.Debug("connection exceeded rate limit, throttling", "conn", nc.connId, "remote", nc.addr, "wait", wait)
+	t := n.clock.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-nc.ctx.Done():
+		return false
+	}
+}
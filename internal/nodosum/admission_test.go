@@ -0,0 +1,98 @@
+package nodosum
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	a := newAdmission(3, 2, 0)
+
+	first := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	second := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+	third := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1002}
+	other := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	another := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1000}
+
+	if !a.admit(first) || !a.admit(second) {
+		t.Fatal("Expected first two connections to be admitted")
+	}
+	if a.admit(third) {
+		t.Error("Expected third connection from same IP to be rejected")
+	}
+	if !a.admit(other) {
+		t.Error("Expected connection from other IP to be admitted")
+	}
+	if a.admit(another) {
+		t.Error("Expected connection to be rejected after reaching MaxConnections")
+	}
+
+	a.release(first)
+	if !a.admit(third) {
+		t.Error("Expected connection to be admitted after release")
+	}
+}
+
+func TestAdmissionHandshakes(t *testing.T) {
+	a := newAdmission(0, 0, 1)
+
+	if !a.acquireHandshake(context.Background(), time.Millisecond) {
+		t.Fatal("Expected first handshake slot to be acquired")
+	}
+	if a.acquireHandshake(context.Background(), time.Millisecond) {
+		t.Error("Expected second handshake to time out")
+	}
+	a.releaseHandshake()
+	if !a.acquireHandshake(context.Background(), time.Millisecond) {
+		t.Error("Expected handshake slot to be free after release")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	if wait := unlimited.reserve(1000); wait != 0 {
+		t.Errorf("Expected nil limiter to never wait, got %s", wait)
+	}
+
+	clock := NewSimClock(time.Unix(0, 0))
+	r := newRateLimiter(10, clock)
+	if wait := r.reserve(10); wait != 0 {
+		t.Errorf("Expected burst to be available, got wait %s", wait)
+	}
+	if wait := r.reserve(5); wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of 500ms, got %s", wait)
+	}
+
+	// Tokens are refilled as the clock of the node moves
+	clock.Advance(time.Second)
+	if wait := r.reserve(5); wait != 0 {
+		t.Errorf("Expected tokens to be refilled, got wait %s", wait)
+	}
+}
+
+func TestAdmissionReleasedForInboundOnly(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	newMemoryNode(t, memory, "b")
+	c := newMemoryNode(t, memory, "c")
+
+	if _, err := c.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Connect(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 2)
+
+	// Closing the connection a dialed must not free the slot of the one c dialed
+	nc, _ := a.nodeConnection("b")
+	a.closeConnChannel(nc.connId)
+
+	a.admission.mu.Lock()
+	defer a.admission.mu.Unlock()
+	if a.admission.active != 1 {
+		t.Fatalf("Expected the inbound connection to stay admitted, got %d active", a.admission.active)
+	}
+}
@@ -1,7 +1,11 @@
 package nodosum
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
 
 	"github.com/conamu/go-worker"
 )
@@ -27,66 +31,251 @@ Packets for one application are always Identified by its Identifier and routed t
 */
 
 type Application interface {
+	// Name returns the name the application was registered with, unique among the whole cluster.
+	Name() string
 	// Send sends a Command to one or more Nodes specified by ID. Specifying no ID will broadcast the packet to all Nodes.
 	Send(payload []byte, ids []string) error
+	// Broadcast sends a payload to all connected Nodes, relayed along a tree if Config.BroadcastFanout is set.
+	Broadcast(ctx context.Context, payload []byte) error
+	// SendContext is Send, waiting for space in full send queues at most until ctx is done.
+	// Depending on the configured SendQueuePolicy it drops frames or fails with ErrSendQueueFull instead of waiting.
+	SendContext(ctx context.Context, payload []byte, ids []string) error
 	// SetReceiveFunc registers a function that is executed to handle the Command received.
+	// Payloads wait in a queue of Config.MultiplexerBufferSize for it and are dropped while the queue is full.
 	SetReceiveFunc(func(payload []byte) error)
-	// Nodes retrieves the ID info about nodes in the cluster to enable the application to work with the clusters resources.
+	// ReceiveDrops returns the number of payloads dropped because the receive queue was full.
+	ReceiveDrops() uint64
+	// Nodes retrieves the IDs of the connected nodes that registered this application as well.
 	Nodes() []string
+	// AllowSenders restricts inbound frames to peers with one of the given certificate identities or roles.
+	// Until it is called, frames from every peer are accepted.
+	AllowSenders(identities []string, roles []string)
+	// DeniedFrames returns the number of inbound frames rejected because their sender was not allowed.
+	DeniedFrames() uint64
+	// EnableReliableDelivery makes Send retransmit messages until every receiving Node acknowledged them.
+	// Messages are delivered exactly once and in order per Node. Send fails with ErrNodeUnreachable for Nodes
+	// that were never connected and with ErrOutboxFull if too many messages to a Node are unacknowledged.
+	EnableReliableDelivery()
+	// SetWeight sets the share of a congested connection this application gets relative to other applications.
+	// Default: 1
+	SetWeight(weight int)
+	// DisableCompression sends all payloads of this application uncompressed, e.g. if they are compressed already.
+	DisableCompression()
+	// NewBlobWriter returns a writer that streams a blob to the Nodes specified by ID, without keeping it in memory.
+	// The blob is complete once the writer is closed.
+	NewBlobWriter(ctx context.Context, ids []string) io.WriteCloser
+	// SetBlobReceiveFunc registers a function that is executed with a reader for every blob received.
+	SetBlobReceiveFunc(func(r io.Reader) error)
+	// OpenStream opens a bidirectional stream to this application on the Node specified by ID.
+	OpenStream(ctx context.Context, id string) (Stream, error)
+	// AcceptStream waits for the next stream opened by another Node.
+	AcceptStream(ctx context.Context) (Stream, error)
+	// Request sends a payload to this application on the Node specified by ID and waits for the response.
+	// It fails with ErrRequestTimeout, ErrNodeUnreachable or a *RemoteError if the remote handler failed,
+	// which wraps ErrUnknownApplication if the Node has no such application.
+	Request(ctx context.Context, id string, payload []byte) ([]byte, error)
+	// SetRequestHandler registers a function that answers requests. Its context expires with the callers context.
+	SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error))
+	// SetCommandHandler registers a function that answers the SET and GET commands Pulse issues for a key
+	// of this application. value is nil for GET.
+	SetCommandHandler(func(command int, key string, value []byte) ([]byte, error))
 }
 
 type application struct {
-	id            uint32
-	receiveFunc   func(payload []byte) error
-	nodes         []string
-	sendWorker    *worker.Worker
-	receiveWorker *worker.Worker
+	id      uint32
+	name    string
+	nodosum *Nodosum
+	// receiveFunc, blobReceiveFunc, requestHandler and commandHandler can be set while frames arrive
+	receiveFunc     atomic.Pointer[func(payload []byte) error]
+	blobReceiveFunc atomic.Pointer[func(r io.Reader) error]
+	requestHandler  atomic.Pointer[func(ctx context.Context, payload []byte) ([]byte, error)]
+	commandHandler  atomic.Pointer[func(command int, key string, value []byte) ([]byte, error)]
+	receiveWorker   *worker.Worker
+	// receiveDrops counts payloads dropped because the receive queue was full
+	receiveDrops atomic.Uint64
+	senders      *senderPolicy
+	// uncompressed, reliable and weight can be changed while the application sends
+	uncompressed atomic.Bool
+	reliable     atomic.Bool
+	weight       atomic.Int32
+	// acceptedStreams holds streams opened by other nodes until they are accepted
+	acceptedStreams chan *stream
 }
 
 type dataPackage struct {
 	id             uint32
 	payload        []byte
 	receivingNodes []string
+	uncompressed   bool
+	// fragment is set for chunks of a blob, which are sent as is
+	fragment *fragmentInfo
+	// stream is set for frames of a stream
+	stream *streamControl
+	// extensions are added to every frame of the package
+	extensions []frameExtension
+	// reliable packages get a sequence number per receiving node and are retransmitted until acknowledged
+	reliable bool
+	seq      uint64
+	epoch    uint64
+	// queuePolicy decides what happens if the send queue of a receiving node is full
+	queuePolicy int
+	// broadcast packages are sent to all connected nodes, along a tree if a broadcast fanout is configured
+	broadcast bool
 }
 
-func (n *Nodosum) RegisterApplication(uniqueIdentifier uint32) Application {
-
-	sendWorker := worker.NewWorker(n.ctx, fmt.Sprintf("%d-send", uniqueIdentifier), n.wg, n.applicationSendTask, n.logger, 0)
-	sendWorker.OutputChan = n.globalWriteChannel
-	sendWorker.Start()
+// RegisterApplication registers an application under a name that has to be unique among the whole cluster.
+// It fails with ErrApplicationConflict if the name, or the wire ID derived from it, is taken on this node.
+func (n *Nodosum) RegisterApplication(name string) (Application, error) {
+	app, err := n.newApplication(name)
+	if err != nil {
+		return nil, err
+	}
 
-	receiveWorker := worker.NewWorker(n.ctx, fmt.Sprintf("%d-receive", uniqueIdentifier), n.wg, n.applicationReceiveTask, n.logger, 0)
-	receiveWorker.InputChan = make(chan any)
-	receiveWorker.Start()
+	app.receiveWorker = worker.NewWorker(n.ctx, fmt.Sprintf("%s-receive", name), n.wg, app.receiveTask, n.logger, 0)
+	app.receiveWorker.InputChan = make(chan any, n.multiplexerBufferSize)
 
-	app := application{
-		id:            uniqueIdentifier,
-		sendWorker:    sendWorker,
-		receiveWorker: receiveWorker,
+	if err := n.addApplication(app); err != nil {
+		return nil, err
 	}
+	go app.receiveWorker.Start()
+
+	return app, nil
+}
+
+func (a *application) Send(payload []byte, ids []string) error {
+	return a.SendContext(a.nodosum.ctx, payload, ids)
+}
 
-	n.applications.Store(uniqueIdentifier, app)
+func (a *application) SendContext(ctx context.Context, payload []byte, ids []string) error {
+	if len(ids) == 0 {
+		return a.Broadcast(ctx, payload)
+	}
 
-	//TODO: Find a way to keep nodes in sync for the application instances
+	dataPack := &dataPackage{
+		id:             a.id,
+		payload:        payload,
+		receivingNodes: ids,
+		uncompressed:   a.uncompressed.Load(),
+		reliable:       a.reliable.Load(),
+		queuePolicy:    a.nodosum.sendQueuePolicy,
+	}
 
-	return &app
+	return a.nodosum.send(ctx, dataPack)
 }
 
-func (a *application) Send(payload []byte, ids []string) error {
-	//TODO implement me
-	panic("implement me")
+func (a *application) Broadcast(ctx context.Context, payload []byte) error {
+	dataPack := &dataPackage{
+		id:             a.id,
+		payload:        payload,
+		receivingNodes: a.nodosum.connectedNodes(),
+		uncompressed:   a.uncompressed.Load(),
+		reliable:       a.reliable.Load(),
+		queuePolicy:    a.nodosum.sendQueuePolicy,
+		broadcast:      true,
+	}
+
+	return a.nodosum.send(ctx, dataPack)
 }
 
 func (a *application) SetReceiveFunc(f func(payload []byte) error) {
-	a.receiveFunc = f
+	a.receiveFunc.Store(&f)
+}
+
+func (a *application) ReceiveDrops() uint64 {
+	return a.receiveDrops.Load()
+}
+
+func (a *application) Name() string {
+	return a.name
 }
 
 func (a *application) Nodes() []string {
-	return a.nodes
+	return a.nodosum.ApplicationNodes(a.name)
+}
+
+func (a *application) AllowSenders(identities []string, roles []string) {
+	a.senders.allow(identities, roles)
+}
+
+func (a *application) DeniedFrames() uint64 {
+	return a.senders.denied.Load()
+}
+
+func (a *application) EnableReliableDelivery() {
+	a.reliable.Store(true)
+}
+
+func (a *application) SetWeight(weight int) {
+	a.weight.Store(int32(min(weight, math.MaxInt32)))
 }
 
-func (n *Nodosum) applicationSendTask(w *worker.Worker, msg any) {
+func (a *application) DisableCompression() {
+	a.uncompressed.Store(true)
 }
 
-func (n *Nodosum) applicationReceiveTask(w *worker.Worker, msg any) {
+func (a *application) NewBlobWriter(ctx context.Context, ids []string) io.WriteCloser {
+	size := a.nodosum.fragmentSize
+	if size <= 0 {
+		size = DEFAULT_FRAGMENT_SIZE
+	}
+
+	return &blobWriter{
+		ctx:  ctx,
+		app:  a,
+		ids:  ids,
+		id:   a.nodosum.fragmentIds.Add(1),
+		size: size,
+		buf:  make([]byte, 0, size),
+	}
+}
+
+func (a *application) SetBlobReceiveFunc(f func(r io.Reader) error) {
+	a.blobReceiveFunc.Store(&f)
+}
+
+func (a *application) OpenStream(ctx context.Context, id string) (Stream, error) {
+	return a.nodosum.openStream(ctx, a, id)
+}
+
+func (a *application) AcceptStream(ctx context.Context) (Stream, error) {
+	select {
+	case s := <-a.acceptedStreams:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (a *application) Request(ctx context.Context, id string, payload []byte) ([]byte, error) {
+	return a.nodosum.request(ctx, a, id, payload)
+}
+
+func (a *application) SetRequestHandler(f func(ctx context.Context, payload []byte) ([]byte, error)) {
+	a.requestHandler.Store(&f)
+}
+
+func (a *application) SetCommandHandler(f func(command int, key string, value []byte) ([]byte, error)) {
+	a.commandHandler.Store(&f)
+}
+
+// applicationWeight returns the scheduling weight of an application.
+func (n *Nodosum) applicationWeight(applicationId uint32) int {
+	v, ok := n.applications.Load(applicationId)
+	if !ok || v == nil {
+		return 1
+	}
+	return max(int(v.(*application).weight.Load()), 1)
+}
+
+// receiveTask runs the receive function of the application for a payload delivered by the multiplexer.
+func (a *application) receiveTask(w *worker.Worker, msg any) {
+	payload := msg.([]byte)
+	receiveFunc := a.receiveFunc.Load()
+	if receiveFunc == nil || *receiveFunc == nil {
+		a.nodosum.logger.Debug("dropping payload, no receive function set", "application", a.name)
+		return
+	}
+	if err := (*receiveFunc)(payload); err != nil {
+		a.nodosum.logger.Error("error handling payload", "error", err.Error(), "application", a.name)
+	}
 }
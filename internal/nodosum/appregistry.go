@@ -0,0 +1,239 @@
+package nodosum
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+)
+
+/*
+Application registry
+
+Applications register with a name that has to be unique within the cluster. The wire ID, the ApplicationID
+of every frame, is derived from the name, so nodes agree on it without coordination.
+
+Every node announces the names of its applications to its peers, once a connection is established
+and whenever an application is registered. This tells which nodes run an application and catches
+two names hashing to the same ID: a node refuses to register a name whose ID is taken locally or
+by a connected node, and frames from a peer that registered the ID under a different name are dropped instead of being
+handed to the wrong application. Conflicts are logged and listed by ApplicationConflicts.
+
+Applications announcement, a SYSTEM frame with an empty EXT_APPLICATIONS extension, payload:
+	per application: uint32 ID | uint8 name length | name
+*/
+
+var (
+	// ErrApplicationConflict is returned when registering a name that is registered already or whose ID is taken
+	ErrApplicationConflict = errors.New("application conflict")
+	// ErrUnknownApplication is returned when addressing an application that is not registered on the node
+	ErrUnknownApplication = errors.New("unknown application")
+	errApplicationName    = errors.New("invalid application name")
+)
+
+// ApplicationConflict is an application ID a peer registered under a different name than this node.
+type ApplicationConflict struct {
+	NodeId     string
+	Id         uint32
+	Name       string
+	RemoteName string
+}
+
+// applicationId derives the wire ID of an application from its name. 0 is left to frames of no application.
+func applicationId(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	id := h.Sum32()
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// newApplication returns an application registered under name, it is not routed to until it is added.
+func (n *Nodosum) newApplication(name string) (*application, error) {
+	if name == "" || len(name) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: %q", errApplicationName, name)
+	}
+
+	return &application{
+		id:              applicationId(name),
+		name:            name,
+		nodosum:         n,
+		senders:         newSenderPolicy(),
+		acceptedStreams: make(chan *stream, streamAcceptBacklog),
+	}, nil
+}
+
+// addApplication stores an application unless its name or ID is taken, locally or by a connected node,
+// and announces it to all connected nodes.
+func (n *Nodosum) addApplication(app *application) error {
+	for _, nodeId := range n.connectedNodes() {
+		v, ok := n.remoteApplications.Load(nodeId)
+		if !ok {
+			continue
+		}
+		if name, ok := v.(map[uint32]string)[app.id]; ok && name != app.name {
+			return fmt.Errorf("%w: %s has the same ID %d as %s on node %s", ErrApplicationConflict, app.name, app.id, name, nodeId)
+		}
+	}
+	if v, loaded := n.applications.LoadOrStore(app.id, app); loaded {
+		existing := v.(*application)
+		if existing.name == app.name {
+			return fmt.Errorf("%w: %s is registered already", ErrApplicationConflict, app.name)
+		}
+		return fmt.Errorf("%w: %s has the same ID %d as %s", ErrApplicationConflict, app.name, app.id, existing.name)
+	}
+
+	for _, nodeId := range n.connectedNodes() {
+		if nc, ok := n.nodeConnection(nodeId); ok {
+			n.announceApplications(nc)
+		}
+	}
+	return nil
+}
+
+func encodeApplications(apps map[uint32]string) []byte {
+	ids := slices.Sorted(func(yield func(uint32) bool) {
+		for id := range apps {
+			if !yield(id) {
+				return
+			}
+		}
+	})
+
+	var buf []byte
+	for _, id := range ids {
+		buf = binary.LittleEndian.AppendUint32(buf, id)
+		buf = append(buf, uint8(len(apps[id])))
+		buf = append(buf, apps[id]...)
+	}
+	return buf
+}
+
+func decodeApplications(payload []byte) (map[uint32]string, error) {
+	apps := make(map[uint32]string)
+	for len(payload) > 0 {
+		if len(payload) < 5 || len(payload) < 5+int(payload[4]) {
+			return nil, errFrameShort
+		}
+		apps[binary.LittleEndian.Uint32(payload[0:4])] = string(payload[5 : 5+int(payload[4])])
+		payload = payload[5+int(payload[4]):]
+	}
+	return apps, nil
+}
+
+// localApplications returns the names of all applications registered by name on this node by ID.
+func (n *Nodosum) localApplications() map[uint32]string {
+	apps := make(map[uint32]string)
+	n.applications.Range(func(k, v any) bool {
+		if app, ok := v.(*application); ok && app.name != "" {
+			apps[app.id] = app.name
+		}
+		return true
+	})
+	return apps
+}
+
+// announceApplications sends the applications of this node over a connection.
+func (n *Nodosum) announceApplications(nc *nodeConn) {
+	payload := encodeApplications(n.localApplications())
+	fh := frameHeader{
+		Version:    PROTOCOL_VERSION,
+		Type:       SYSTEM,
+		Length:     uint32(len(payload)),
+		Extensions: []frameExtension{{Type: EXT_APPLICATIONS}},
+	}
+	err := n.enqueue(n.ctx, nc, append(encodeFrameHeader(&fh), payload...), SEND_QUEUE_BLOCK)
+	if err != nil && !errors.Is(err, ErrNodeUnreachable) {
+		n.logger.Debug("error announcing applications", "error", err.Error(), "conn", nc.connId)
+	}
+}
+
+// handleApplications stores the applications announced by a peer and reports conflicts with local ones.
+func (n *Nodosum) handleApplications(connId uint32, payload []byte) {
+	nodeId := n.nodeIdOf(connId)
+	if nodeId == "" {
+		return
+	}
+	remote, err := decodeApplications(payload)
+	if err != nil {
+		n.protocolViolation(connId, err)
+		return
+	}
+	n.remoteApplications.Store(nodeId, remote)
+
+	local := n.localApplications()
+	for id, name := range remote {
+		if localName, ok := local[id]; ok && localName != name {
+			n.logger.Error("application registered under a different name on peer, dropping its frames",
+				"application", id, "name", localName, "node", nodeId, "remoteName", name)
+		}
+	}
+}
+
+// applicationConflict reports whether the node on the other end of a connection registered the ID of app under another name.
+func (n *Nodosum) applicationConflict(connId uint32, app *application) bool {
+	if app.name == "" {
+		return false
+	}
+	v, ok := n.remoteApplications.Load(n.nodeIdOf(connId))
+	if !ok {
+		return false
+	}
+	name, ok := v.(map[uint32]string)[app.id]
+	return ok && name != app.name
+}
+
+// announcedApplication reports whether a connected node announced an application with the given ID.
+func (n *Nodosum) announcedApplication(nodeId string, id uint32) bool {
+	v, ok := n.remoteApplications.Load(nodeId)
+	if !ok {
+		return false
+	}
+	_, ok = v.(map[uint32]string)[id]
+	return ok
+}
+
+// ApplicationNodes returns the IDs of all connected nodes that registered an application with the given name.
+func (n *Nodosum) ApplicationNodes(name string) []string {
+	id := applicationId(name)
+	var ids []string
+	for _, nodeId := range n.connectedNodes() {
+		v, ok := n.remoteApplications.Load(nodeId)
+		if ok && v.(map[uint32]string)[id] == name {
+			ids = append(ids, nodeId)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// ApplicationConflicts returns all applications that connected nodes registered under a different name than this node.
+func (n *Nodosum) ApplicationConflicts() []ApplicationConflict {
+	local := n.localApplications()
+	var conflicts []ApplicationConflict
+	for _, nodeId := range n.connectedNodes() {
+		v, ok := n.remoteApplications.Load(nodeId)
+		if !ok {
+			continue
+		}
+		for id, remoteName := range v.(map[uint32]string) {
+			if name, ok := local[id]; ok && name != remoteName {
+				conflicts = append(conflicts, ApplicationConflict{NodeId: nodeId, Id: id, Name: name, RemoteName: remoteName})
+			}
+		}
+	}
+	slices.SortFunc(conflicts, func(a, b ApplicationConflict) int {
+		if a.NodeId != b.NodeId {
+			if a.NodeId < b.NodeId {
+				return -1
+			}
+			return 1
+		}
+		return int(a.Id) - int(b.Id)
+	})
+	return conflicts
+}
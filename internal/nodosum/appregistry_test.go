@@ -0,0 +1,186 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addNamedApplication registers an application by name without workers, receiving into the returned channel.
+func addNamedApplication(t *testing.T, n *Nodosum, name string) (*application, chan any) {
+	t.Helper()
+	app, err := n.newApplication(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := receiveInto(app)
+	if err := n.addApplication(app); err != nil {
+		t.Fatal(err)
+	}
+	return app, received
+}
+
+func waitForApplicationNodes(t *testing.T, n *Nodosum, name string, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(n.ApplicationNodes(name), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s on %v, got %v", name, want, n.ApplicationNodes(name))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestApplicationsRoundTrip(t *testing.T) {
+	apps := map[uint32]string{applicationId("cache"): "cache", applicationId("pulse"): "pulse"}
+	decoded, err := decodeApplications(encodeApplications(apps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(decoded, apps) {
+		t.Fatalf("Expected %v, got %v", apps, decoded)
+	}
+
+	payload := encodeApplications(apps)
+	if _, err := decodeApplications(payload[:len(payload)-1]); !errors.Is(err, errFrameShort) {
+		t.Errorf("Expected truncated payload to be rejected, got %v", err)
+	}
+}
+
+func TestRegisterApplicationConflict(t *testing.T) {
+	n := newMemoryNode(t, NewMemoryNetwork(), "a")
+	addNamedApplication(t, n, "cache")
+
+	if _, err := n.RegisterApplication("cache"); !errors.Is(err, ErrApplicationConflict) {
+		t.Errorf("Expected registering a name twice to fail, got %v", err)
+	}
+	for _, name := range []string{"", strings.Repeat("x", 256)} {
+		if _, err := n.RegisterApplication(name); !errors.Is(err, errApplicationName) {
+			t.Errorf("Expected name of %d bytes to be rejected, got %v", len(name), err)
+		}
+	}
+
+	// Another name hashing to the same ID is refused as well
+	app, _ := n.newApplication("other")
+	app.id = applicationId("cache")
+	if err := n.addApplication(app); !errors.Is(err, ErrApplicationConflict) {
+		t.Errorf("Expected ID collision to fail, got %v", err)
+	}
+}
+
+func TestApplicationNodes(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	c := newMemoryNode(t, memory, "c")
+
+	// Registered before connecting, announced with the handshake
+	addNamedApplication(t, b, "cache")
+	for _, peer := range []string{"b", "c"} {
+		if _, err := a.Connect(context.Background(), peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForPeers(t, a, 2)
+	waitForApplicationNodes(t, a, "cache", []string{"b"})
+
+	// Registered while connected, announced right away
+	addNamedApplication(t, c, "cache")
+	waitForApplicationNodes(t, a, "cache", []string{"b", "c"})
+
+	app, _ := addNamedApplication(t, a, "cache")
+	waitForApplicationNodes(t, b, "cache", []string{"a"})
+	if nodes := app.Nodes(); !slices.Equal(nodes, []string{"b", "c"}) {
+		t.Errorf("Expected cache on b and c, got %v", nodes)
+	}
+	if len(a.ApplicationNodes("pulse")) != 0 {
+		t.Errorf("Expected pulse on no nodes, got %v", a.ApplicationNodes("pulse"))
+	}
+
+	c.Shutdown()
+	waitForApplicationNodes(t, a, "cache", []string{"b"})
+	// The announcement of a node is forgotten with its last connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := a.remoteApplications.Load("c"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the applications of c to be forgotten")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegisterApplicationConflictWithPeer(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+
+	// b registered another name that hashes to the ID of cache
+	other, _ := b.newApplication("other")
+	other.id = applicationId("cache")
+	if err := b.addApplication(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Connect(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !a.announcedApplication("b", other.id) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected b to announce its applications")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := a.RegisterApplication("cache"); !errors.Is(err, ErrApplicationConflict) {
+		t.Errorf("Expected an ID registered by a peer under another name to fail, got %v", err)
+	}
+	if _, err := a.RegisterApplication("other"); err != nil {
+		t.Errorf("Expected the name the peer registered to succeed, got %v", err)
+	}
+}
+
+func TestApplicationConflictDropsFrames(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+
+	sender, _ := addNamedApplication(t, a, "cache")
+	// b registered another name that hashes to the same ID
+	other, _ := b.newApplication("other")
+	other.id = sender.id
+	received := receiveInto(other)
+	if err := b.addApplication(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Connect(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.ApplicationConflicts()) == 0 || len(b.ApplicationConflicts()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected both nodes to detect the conflict")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	want := ApplicationConflict{NodeId: "b", Id: sender.id, Name: "cache", RemoteName: "other"}
+	if conflicts := a.ApplicationConflicts(); len(conflicts) != 1 || conflicts[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, conflicts)
+	}
+
+	if err := sender.Send([]byte("hello"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-received:
+		t.Fatalf("Expected frames of a conflicting application to be dropped, got %q", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
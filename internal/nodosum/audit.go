@@ -0,0 +1,172 @@
+package nodosum
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Audit trail for privileged operations.
+
+Every command gated by the ACL middleware that is not available to the anonymous token
+is recorded with who issued it, what was requested and the outcome.
+Entries are written as JSON lines to the configured sink and the most recent ones
+are kept in memory so they can be queried from Pulse with the AUDIT command.
+*/
+
+// DEFAULT_AUDIT_BUFFER_SIZE is the number of recent audit entries kept for the AUDIT command by default
+const DEFAULT_AUDIT_BUFFER_SIZE = 1000
+
+type auditOutcome string
+
+const (
+	AUDIT_ALLOWED auditOutcome = "allowed"
+	AUDIT_DENIED  auditOutcome = "denied"
+	AUDIT_FAILED  auditOutcome = "failed"
+)
+
+type auditEntry struct {
+	Time          time.Time    `json:"time"`
+	Subject       string       `json:"subject"`
+	Identity      string       `json:"identity,omitempty"`
+	RemoteAddr    string       `json:"remoteAddr,omitempty"`
+	Command       string       `json:"command"`
+	ApplicationID uint32       `json:"applicationId"`
+	Key           string       `json:"key,omitempty"`
+	Outcome       auditOutcome `json:"outcome"`
+	Error         string       `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	mu      sync.Mutex
+	sink    io.Writer
+	logger  *slog.Logger
+	entries []auditEntry
+	size    int
+}
+
+func newAuditLog(sink io.Writer, size int, logger *slog.Logger) *auditLog {
+	return &auditLog{
+		sink:    sink,
+		logger:  logger,
+		entries: make([]auditEntry, 0, size),
+		size:    size,
+	}
+}
+
+func (a *auditLog) record(e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 {
+		if len(a.entries) == a.size {
+			copy(a.entries, a.entries[1:])
+			a.entries = a.entries[:a.size-1]
+		}
+		a.entries = append(a.entries, e)
+	}
+
+	if a.sink == nil {
+		return
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Error("error encoding audit entry", "error", err.Error())
+		return
+	}
+	_, err = a.sink.Write(append(line, '\n'))
+	if err != nil {
+		a.logger.Error("error writing audit entry", "error", err.Error())
+	}
+}
+
+// recent returns up to limit of the newest entries, oldest first. A limit <= 0 returns all buffered entries.
+func (a *auditLog) recent(limit int) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	start := 0
+	if limit > 0 && limit < len(a.entries) {
+		start = len(a.entries) - limit
+	}
+
+	out := make([]auditEntry, len(a.entries)-start)
+	copy(out, a.entries[start:])
+	return out
+}
+
+// queryAudit answers the AUDIT command. data optionally holds the maximum number of entries as a decimal string.
+// Entries are returned as JSON lines, the same format written to the sink.
+func (n *Nodosum) queryAudit(data []byte) ([]byte, error) {
+	limit := 0
+	if len(data) > 0 {
+		l, err := strconv.Atoi(string(data))
+		if err != nil {
+			return nil, err
+		}
+		limit = l
+	}
+
+	var buf []byte
+	for _, e := range n.audit.recent(limit) {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	return buf, nil
+}
+
+// authorize checks cmd against the ACL middleware and records privileged commands in the audit log.
+func (n *Nodosum) authorize(conn net.Conn, cmd int, token string, applicationId uint32, key string) bool {
+	allowed := middleware(cmd, token)
+	if !privileged(cmd) {
+		return allowed
+	}
+
+	outcome := AUDIT_ALLOWED
+	if !allowed {
+		outcome = AUDIT_DENIED
+	}
+
+	n.audit.record(newAuditEntry(conn, cmd, token, applicationId, key, outcome))
+	return allowed
+}
+
+// auditFailure records a privileged command that passed the ACL but failed while executing.
+func (n *Nodosum) auditFailure(conn net.Conn, cmd int, token string, applicationId uint32, key string, err error) {
+	e := newAuditEntry(conn, cmd, token, applicationId, key, AUDIT_FAILED)
+	e.Error = err.Error()
+	n.audit.record(e)
+}
+
+func newAuditEntry(conn net.Conn, cmd int, token string, applicationId uint32, key string, outcome auditOutcome) auditEntry {
+	e := auditEntry{
+		Subject:       tokenSubject(token),
+		Command:       commandName(cmd),
+		ApplicationID: applicationId,
+		Key:           key,
+		Outcome:       outcome,
+	}
+
+	if conn == nil {
+		return e
+	}
+
+	e.RemoteAddr = conn.RemoteAddr().String()
+	e.Identity = peerIdentity(conn)
+
+	return e
+}
@@ -0,0 +1,67 @@
+package nodosum
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestAuditLogRecord(t *testing.T) {
+	sink := &bytes.Buffer{}
+	a := newAuditLog(sink, 2, slog.Default())
+
+	a.record(auditEntry{Subject: "god", Command: "SET", Key: "a", Outcome: AUDIT_ALLOWED})
+	a.record(auditEntry{Subject: "anonymous", Command: "ID", Outcome: AUDIT_DENIED})
+	a.record(auditEntry{Subject: "god", Command: "EXIT", Outcome: AUDIT_ALLOWED})
+
+	lines := bytes.Split(bytes.TrimSpace(sink.Bytes()), []byte("\n"))
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines in sink, got %d", len(lines))
+	}
+
+	e := auditEntry{}
+	if err := json.Unmarshal(lines[0], &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Command != "SET" || e.Key != "a" || e.Outcome != AUDIT_ALLOWED {
+		t.Errorf("Unexpected first entry %+v", e)
+	}
+
+	recent := a.recent(0)
+	if len(recent) != 2 {
+		t.Fatalf("Expected 2 buffered entries, got %d", len(recent))
+	}
+	if recent[0].Command != "ID" || recent[1].Command != "EXIT" {
+		t.Errorf("Expected oldest entry to be evicted, got %s, %s", recent[0].Command, recent[1].Command)
+	}
+
+	if latest := a.recent(1); len(latest) != 1 || latest[0].Command != "EXIT" {
+		t.Errorf("Expected only the newest entry, got %+v", latest)
+	}
+}
+
+func TestAuthorizeRecordsPrivilegedCommands(t *testing.T) {
+	n := &Nodosum{audit: newAuditLog(nil, 10, slog.Default())}
+
+	if !n.authorize(nil, GET, "", 1, "key") {
+		t.Error("Expected GET to be allowed anonymously")
+	}
+	if n.authorize(nil, SET, "", 1, "key") {
+		t.Error("Expected SET to be denied anonymously")
+	}
+	if !n.authorize(nil, SET, godToken.token, 1, "key") {
+		t.Error("Expected SET to be allowed with god token")
+	}
+
+	entries := n.audit.recent(0)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d", len(entries))
+	}
+	if entries[0].Outcome != AUDIT_DENIED || entries[0].Subject != "anonymous" {
+		t.Errorf("Unexpected first entry %+v", entries[0])
+	}
+	if entries[1].Outcome != AUDIT_ALLOWED || entries[1].Subject != "god" {
+		t.Errorf("Unexpected second entry %+v", entries[1])
+	}
+}
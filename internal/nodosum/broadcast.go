@@ -0,0 +1,211 @@
+package nodosum
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+)
+
+/*
+Cluster wide broadcast
+
+Application.Broadcast, and Send without node IDs, send a message to every connected node.
+The message is encoded once and the same frames are queued for all nodes.
+
+With Config.BroadcastFanout set, the sender only sends to at most fanout nodes and the message
+travels along a tree instead: the receiving nodes that announced the application are sorted and split
+into fanout subtrees of about equal size, so every relay has the application registered. The first node
+of every subtree gets the message with the IDs of the rest of its subtree in an EXT_BROADCAST extension
+and relays it the same way, so no node sends more than fanout copies and all nodes are reached after
+log_fanout(N) hops. Every chunk is compressed once per hop, only the extension differs between the copies.
+
+The extension also carries the node the broadcast originates from. Receivers check the sender policy
+of the application against the origin as well as against the node the frames arrived from, so with a
+policy in place a relay has to be allowed to send too. Relays are trusted to report the origin truthfully.
+
+Like Send, a broadcast is best effort. Relays drop the copies for nodes whose send queue is full,
+along with the rest of the fragments of the message, and a node failing while relaying loses the message
+for its subtree. If a relay is not connected
+to the first node of a subtree, the next node of the subtree takes its place.
+Applications with reliable delivery always send to every node directly, as sequence numbers and
+acknowledgements are kept per pair of nodes.
+
+Broadcast extension value:
+	uint8   fanout
+	uint8   origin length | origin node ID
+	uint16  number of node IDs
+	per node ID: uint8 length | ID
+*/
+
+// maxBroadcastRoute leaves room for the other extensions of a frame next to the broadcast route
+const maxBroadcastRoute = math.MaxUint16 - 1024
+
+var errBroadcastRoute = errors.New("invalid broadcast route")
+
+// broadcastRoute is what a relay needs to pass a broadcast on to its subtree.
+type broadcastRoute struct {
+	fanout int
+	// origin is the ID of the node that sent the broadcast
+	origin string
+	nodes  []string
+}
+
+func encodeBroadcastRoute(route *broadcastRoute) ([]byte, error) {
+	if route.fanout <= 0 || route.fanout > math.MaxUint8 || len(route.nodes) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: fanout %d for %d nodes", errBroadcastRoute, route.fanout, len(route.nodes))
+	}
+	if len(route.origin) == 0 || len(route.origin) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: origin ID of %d bytes", errBroadcastRoute, len(route.origin))
+	}
+
+	buf := []byte{uint8(route.fanout), uint8(len(route.origin))}
+	buf = append(buf, route.origin...)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(route.nodes)))
+	for _, id := range route.nodes {
+		if len(id) == 0 || len(id) > math.MaxUint8 {
+			return nil, fmt.Errorf("%w: node ID of %d bytes", errBroadcastRoute, len(id))
+		}
+		buf = append(buf, uint8(len(id)))
+		buf = append(buf, id...)
+	}
+	if len(buf) > maxBroadcastRoute {
+		return nil, fmt.Errorf("%w: %d bytes for %d nodes", errBroadcastRoute, len(buf), len(route.nodes))
+	}
+	return buf, nil
+}
+
+func decodeBroadcastRoute(value []byte) (*broadcastRoute, error) {
+	if len(value) < 2 || value[0] == 0 || value[1] == 0 || len(value) < 4+int(value[1]) {
+		return nil, errBroadcastRoute
+	}
+	origin := string(value[2 : 2+int(value[1])])
+	rest := value[2+int(value[1]):]
+	count := int(binary.LittleEndian.Uint16(rest[0:2]))
+	route := &broadcastRoute{fanout: int(value[0]), origin: origin, nodes: make([]string, 0, min(count, len(rest)))}
+
+	rest = rest[2:]
+	for range count {
+		if len(rest) == 0 || int(rest[0]) == 0 || len(rest) < 1+int(rest[0]) {
+			return nil, errBroadcastRoute
+		}
+		route.nodes = append(route.nodes, string(rest[1:1+int(rest[0])]))
+		rest = rest[1+int(rest[0]):]
+	}
+	if len(rest) != 0 {
+		return nil, errBroadcastRoute
+	}
+	return route, nil
+}
+
+// splitBroadcast splits nodes into at most fanout subtrees of about equal size, keeping their order.
+func splitBroadcast(nodes []string, fanout int) [][]string {
+	subtrees := make([][]string, 0, fanout)
+	for i := range fanout {
+		start, end := i*len(nodes)/fanout, (i+1)*len(nodes)/fanout
+		if start < end {
+			subtrees = append(subtrees, nodes[start:end])
+		}
+	}
+	return subtrees
+}
+
+// broadcastHop is a node the message is sent to and the rest of the subtree it relays the message to.
+type broadcastHop struct {
+	nc   *nodeConn
+	rest []string
+}
+
+// broadcast sends dataPack to its receiving nodes that announced its application along a tree with the given fanout.
+// origin is the node the broadcast originates from, passed on to every hop.
+func (n *Nodosum) broadcast(ctx context.Context, dataPack *dataPackage, fanout int, origin string) error {
+	nodes := slices.Sorted(slices.Values(dataPack.receivingNodes))
+	nodes = slices.DeleteFunc(slices.Compact(nodes), func(id string) bool {
+		return id == n.nodeId || !n.announcedApplication(id, dataPack.id)
+	})
+
+	key := dataPack.stripeKey()
+	var hops []broadcastHop
+	for _, subtree := range splitBroadcast(nodes, fanout) {
+		for i, id := range subtree {
+			if nc, ok := n.nodeConnectionFor(id, key); ok {
+				hops = append(hops, broadcastHop{nc: nc, rest: subtree[i+1:]})
+				break
+			}
+			n.logger.Debug("skipping unreachable node in broadcast", "node", id, "application", dataPack.id)
+		}
+	}
+	// Hops are ordered by their compression algorithm, so every chunk is compressed once per algorithm
+	slices.SortStableFunc(hops, func(a, b broadcastHop) int {
+		return cmp.Compare(a.nc.compression, b.nc.compression)
+	})
+
+	var errs []error
+	extensions := make([][]frameExtension, len(hops))
+	for i, hop := range hops {
+		extensions[i] = slices.Clip(dataPack.extensions)
+		// Leaves get a route without nodes, it tells them the origin
+		route, err := encodeBroadcastRoute(&broadcastRoute{fanout: fanout, origin: origin, nodes: hop.rest})
+		if err != nil {
+			errs = append(errs, err)
+			hops[i].nc = nil
+			continue
+		}
+		extensions[i] = append(extensions[i], frameExtension{Type: EXT_BROADCAST, Value: route})
+	}
+
+	scratch := getScratch()
+	defer putScratch(scratch)
+	chunks, infos := n.chunkPayload(dataPack)
+	for c, chunk := range chunks {
+		var payload []byte
+		var compressed bool
+		algorithm := -1
+
+		for i, hop := range hops {
+			if hop.nc == nil {
+				continue
+			}
+			if hop.nc.compression != algorithm {
+				algorithm = hop.nc.compression
+				payload, compressed = n.maybeCompress((*scratch)[:0], chunk, dataPack.uncompressed, algorithm)
+				if compressed {
+					*scratch = payload[:0]
+				}
+			}
+			pack := *dataPack
+			pack.extensions = extensions[i]
+			err := n.enqueue(ctx, hop.nc, buildFrame(&pack, payload, compressed, infos[c]), dataPack.queuePolicy)
+			if err != nil {
+				// The rest of the message is useless to this subtree
+				if !errors.Is(err, errFrameDropped) {
+					errs = append(errs, err)
+				}
+				hops[i].nc = nil
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// relayBroadcast passes a broadcast received from another node on to the subtree in its route.
+// Relaying never waits for full send queues, so a slow node can not hold up inbound traffic.
+func (n *Nodosum) relayBroadcast(app *application, route *broadcastRoute, payload []byte) {
+	if len(route.nodes) == 0 {
+		return
+	}
+
+	dataPack := &dataPackage{
+		id:             app.id,
+		payload:        payload,
+		receivingNodes: route.nodes,
+		uncompressed:   app.uncompressed.Load(),
+		queuePolicy:    SEND_QUEUE_DROP_NEWEST,
+	}
+	if err := n.broadcast(n.ctx, dataPack, route.fanout, route.origin); err != nil {
+		n.logger.Debug("error relaying broadcast", "error", err.Error(), "application", app.id, "origin", route.origin)
+	}
+}
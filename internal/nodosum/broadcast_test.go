@@ -0,0 +1,237 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSplitBroadcast(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e", "f", "g"}
+	subtrees := splitBroadcast(nodes, 3)
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"e", "f", "g"}}
+	if !slices.EqualFunc(subtrees, want, slices.Equal) {
+		t.Fatalf("Expected %v, got %v", want, subtrees)
+	}
+	if subtrees := splitBroadcast(nodes[:2], 3); len(subtrees) != 2 {
+		t.Fatalf("Expected no empty subtrees, got %v", subtrees)
+	}
+}
+
+func TestBroadcastRouteRoundTrip(t *testing.T) {
+	route := &broadcastRoute{fanout: 2, origin: "node-0", nodes: []string{"node-1", "node-22"}}
+	value, err := encodeBroadcastRoute(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeBroadcastRoute(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.fanout != 2 || decoded.origin != "node-0" || !slices.Equal(decoded.nodes, route.nodes) {
+		t.Fatalf("Expected %+v, got %+v", route, decoded)
+	}
+
+	bad := [][]byte{nil, {0, 1, 'a', 0, 0}, {2, 0, 0, 0}, {2, 1, 'a', 0}, {2, 1, 'a', 1, 0}, {2, 1, 'a', 1, 0, 5, 'b'}, {2, 1, 'a', 0, 0, 1}}
+	for _, bad := range bad {
+		if _, err := decodeBroadcastRoute(bad); !errors.Is(err, errBroadcastRoute) {
+			t.Errorf("Expected %v to be rejected, got %v", bad, err)
+		}
+	}
+	if _, err := encodeBroadcastRoute(&broadcastRoute{fanout: 2, origin: "node-0", nodes: []string{""}}); err == nil {
+		t.Error("Expected empty node ID to be rejected")
+	}
+	if _, err := encodeBroadcastRoute(&broadcastRoute{fanout: 2}); err == nil {
+		t.Error("Expected empty origin to be rejected")
+	}
+}
+
+// newBroadcastCluster connects count nodes named n0, n1, ... with each other over a chaos transport.
+// Every node registers the application "broadcast", except for the nodes in without.
+func newBroadcastCluster(t *testing.T, count, fanout int, without ...int) ([]*application, []chan any, *Chaos) {
+	t.Helper()
+	memory := NewMemoryNetwork()
+	chaos := NewChaos(1)
+
+	nodes := make([]*Nodosum, count)
+	apps := make([]*application, count)
+	received := make([]chan any, count)
+	for i := range nodes {
+		id := fmt.Sprintf("n%d", i)
+		nodes[i] = newTransportNode(t, id, chaos.Transport(memory.Transport(id), id), func(cfg *Config) {
+			cfg.BroadcastFanout = fanout
+		})
+		app, err := nodes[i].newApplication("broadcast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		apps[i] = app
+		received[i] = receiveInto(app)
+		if !slices.Contains(without, i) {
+			if err := nodes[i].addApplication(app); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, n := range nodes {
+		for _, peer := range nodes[i+1:] {
+			if _, err := n.Connect(context.Background(), peer.NodeId()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var registered []string
+	for i, n := range nodes {
+		if !slices.Contains(without, i) {
+			registered = append(registered, n.NodeId())
+		}
+	}
+	for _, n := range nodes {
+		waitForPeers(t, n, count-1)
+		waitForApplicationNodes(t, n, "broadcast", slices.DeleteFunc(slices.Clone(registered), func(id string) bool { return id == n.NodeId() }))
+	}
+	return apps, received, chaos
+}
+
+func TestBroadcastTree(t *testing.T) {
+	apps, received, chaos := newBroadcastCluster(t, 7, 2)
+
+	// n0 only sends to n1 and n4, the roots of its subtrees n1-n3 and n4-n6, the other links are cut
+	for _, id := range []string{"n2", "n3", "n5", "n6"} {
+		chaos.SetFault("n0", id, Fault{DropRate: 1})
+	}
+
+	if err := apps[0].Broadcast(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(apps); i++ {
+		select {
+		case payload := <-received[i]:
+			if string(payload.([]byte)) != "hello" {
+				t.Fatalf("Expected n%d to receive hello, got %q", i, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected n%d to receive the broadcast", i)
+		}
+	}
+
+	// Every node receives the broadcast exactly once, the sender not at all
+	time.Sleep(50 * time.Millisecond)
+	for i := range apps {
+		if len(received[i]) != 0 {
+			t.Errorf("Expected n%d to receive the broadcast once, %d more", i, len(received[i]))
+		}
+	}
+}
+
+func TestBroadcastDirect(t *testing.T) {
+	apps, received, chaos := newBroadcastCluster(t, 4, 0)
+	chaos.SetFault("n0", "n2", Fault{DropRate: 1})
+
+	if err := apps[0].Send([]byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range []int{1, 3} {
+		select {
+		case <-received[i]:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected n%d to receive the broadcast", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(received[2]) != 0 {
+		t.Error("Expected a direct broadcast not to be relayed")
+	}
+}
+
+func TestBroadcastTreeSkipsNodesWithoutApplication(t *testing.T) {
+	// n1 would relay to n2 and n3, without the application it would drop the broadcast
+	apps, received, chaos := newBroadcastCluster(t, 7, 2, 1)
+	for _, id := range []string{"n3", "n5", "n6"} {
+		chaos.SetFault("n0", id, Fault{DropRate: 1})
+	}
+
+	if err := apps[0].Broadcast(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{2, 3, 4, 5, 6} {
+		select {
+		case <-received[i]:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected n%d to receive the broadcast", i)
+		}
+	}
+	if len(received[1]) != 0 {
+		t.Error("Expected the node without the application not to receive the broadcast")
+	}
+}
+
+func TestRelayedBroadcastChecksOrigin(t *testing.T) {
+	apps, received, chaos := newBroadcastCluster(t, 3, 1)
+	chaos.SetFault("n0", "n2", Fault{DropRate: 1})
+	// n2 accepts frames from n1 but not from n0, the origin of the broadcast n1 relays
+	n2 := apps[2].nodosum
+	for _, nc := range n2.nodeConnections("n1") {
+		nc.identity = "n1"
+	}
+	for _, nc := range n2.nodeConnections("n0") {
+		nc.identity = "n0"
+	}
+	apps[2].AllowSenders([]string{"n1"}, nil)
+
+	if err := apps[0].Broadcast(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received[1]:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected n1 to receive the broadcast")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for apps[2].DeniedFrames() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the relayed broadcast to be denied")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(received[2]) != 0 {
+		t.Error("Expected the relayed broadcast not to be delivered")
+	}
+
+	if err := apps[1].Send([]byte("from n1"), []string{"n2"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case payload := <-received[2]:
+		if string(payload.([]byte)) != "from n1" {
+			t.Fatalf("Expected the message of n1, got %q", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected n2 to accept messages of n1")
+	}
+}
+
+func TestRelayDropsRestOfFragmentedMessage(t *testing.T) {
+	n, app, nc := newSendQueueTestNodosum(t, 3, SEND_QUEUE_BLOCK)
+	n.fragmentSize = 4
+	n.remoteApplications.Store("b", map[uint32]string{app.id: "app"})
+
+	if err := app.Send([]byte("x"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	// A relay never waits, the third of 4 fragments does not fit and the fourth is useless without it
+	n.relayBroadcast(app, &broadcastRoute{fanout: 1, origin: "a", nodes: []string{"b"}}, []byte("0123456789abcdef"))
+	if drops := n.SendQueueDrops("b"); drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+	nc.queue.pop()
+	nc.queue.pop()
+	if depth := n.SendQueueDepth("b"); depth != 1 {
+		t.Fatalf("expected only the second fragment left, got %d frames", depth)
+	}
+}
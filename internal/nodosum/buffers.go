@@ -0,0 +1,33 @@
+package nodosum
+
+import "sync"
+
+/*
+Buffer pooling for the data path.
+
+Encoded frames and received frames are handed on to queues, retransmits and applications,
+so they are allocated exactly once and never reused. Buffers that only live while a frame
+is built, like the output of the compressor, come from scratchPool instead.
+*/
+
+// maxPooledBuffer keeps oversized buffers from staying in the pool
+const maxPooledBuffer = 1024 * 1024
+
+var scratchPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, DEFAULT_FRAGMENT_SIZE)
+		return &buf
+	},
+}
+
+func getScratch() *[]byte {
+	return scratchPool.Get().(*[]byte)
+}
+
+func putScratch(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	*buf = (*buf)[:0]
+	scratchPool.Put(buf)
+}
@@ -0,0 +1,574 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Chaos transport
+
+Chaos wraps the transports of named nodes and injects faults into their traffic, to exercise
+failure handling in tests. Faults are set per direction between two nodes, "*" matches any node:
+
+	chaos := NewChaos(1)
+	a := chaos.Transport(memory.Transport("a"), "a")
+	chaos.SetFault("a", "*", Fault{Latency: 50 * time.Millisecond, DropRate: 0.01})
+	chaos.Partition("a", "b", false)
+
+Faults are applied by the sending node to every write, so one write of the write loop,
+a batch of whole frames, is delayed, dropped or resets the connection as a unit.
+Writes of a connection are delivered in order, jitter never reorders them.
+Below TLS a dropped write corrupts the record stream and the connection fails instead.
+Packet connections only honor partitions and drops.
+
+The peer of an accepted connection is recognized by the address it was dialed from,
+which only works for transports with distinct local addresses like TCP and the MemoryNetwork.
+
+A node running on a chaos transport can be controlled from Pulse with the CHAOS command, see chaosCommand.
+*/
+
+var (
+	errChaosReset       = errors.New("connection reset by chaos transport")
+	errChaosPartitioned = errors.New("connection refused, nodes are partitioned")
+	errChaosDisabled    = errors.New("node does not run on a chaos transport")
+)
+
+// chaosWriteBuffer is the number of delayed writes a connection holds before writes block
+const chaosWriteBuffer = 1024
+
+// Fault describes the faults injected into the traffic from one node to another.
+type Fault struct {
+	// Latency delays every write
+	Latency time.Duration
+	// Jitter adds a random delay between 0 and Jitter to every write
+	Jitter time.Duration
+	// DropRate is the probability a write is silently dropped, between 0 and 1
+	DropRate float64
+	// Bandwidth limits the bytes per second, 0 is unlimited
+	Bandwidth int
+	// ResetRate is the probability a write resets the connection, between 0 and 1
+	ResetRate float64
+}
+
+func (f Fault) String() string {
+	return fmt.Sprintf("latency=%s jitter=%s drop=%g bandwidth=%d reset=%g", f.Latency, f.Jitter, f.DropRate, f.Bandwidth, f.ResetRate)
+}
+
+type chaosLink struct {
+	from, to string
+}
+
+// Chaos controls the faults of all transports created with it. It is safe to change at runtime.
+type Chaos struct {
+	mu   sync.Mutex
+	seed uint64
+	// rngs draws the faults of every direction from its own generator,
+	// so they do not depend on how writes of different connections interleave
+	rngs   map[chaosLink]*rand.Rand
+	clock  Clock
+	faults map[chaosLink]Fault
+	// blocked holds partitioned directions, writes are dropped and dials refused
+	blocked map[chaosLink]bool
+	// names maps listener and dialing addresses to node names
+	names map[string]string
+	conns map[*chaosConn]struct{}
+}
+
+// NewChaos returns a controller without any faults. Random faults are drawn from a generator seeded with seed.
+func NewChaos(seed uint64) *Chaos {
+	return &Chaos{
+		seed:    seed,
+		rngs:    make(map[chaosLink]*rand.Rand),
+		clock:   realClock{},
+		faults:  make(map[chaosLink]Fault),
+		blocked: make(map[chaosLink]bool),
+		names:   make(map[string]string),
+		conns:   make(map[*chaosConn]struct{}),
+	}
+}
+
+// Transport wraps the transport of the node name.
+func (c *Chaos) Transport(inner Transport, name string) Transport {
+	c.mu.Lock()
+	c.names[inner.Addr()] = name
+	c.mu.Unlock()
+	return &chaosTransport{Transport: inner, chaos: c, name: name}
+}
+
+// SetClock sets the clock delays are measured on, the wall clock by default.
+// It has to be set before any connection is made.
+func (c *Chaos) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+func (c *Chaos) getClock() Clock {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clock
+}
+
+// SetFault sets the faults of traffic from node from to node to, either may be "*".
+func (c *Chaos) SetFault(from, to string, f Fault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults[chaosLink{from, to}] = f
+}
+
+// ClearFaults removes all faults, partitions stay in place.
+func (c *Chaos) ClearFaults() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.faults)
+}
+
+// Partition cuts traffic from a to b and, unless oneWay, from b to a.
+// Existing connections of a full partition are reset, one way partitions silently drop writes.
+func (c *Chaos) Partition(a, b string, oneWay bool) {
+	c.mu.Lock()
+	c.blocked[chaosLink{a, b}] = true
+	if !oneWay {
+		c.blocked[chaosLink{b, a}] = true
+	}
+	c.mu.Unlock()
+
+	if !oneWay {
+		c.ResetConns(a, b)
+	}
+}
+
+// Heal removes the partitions between a and b in both directions.
+func (c *Chaos) Heal(a, b string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blocked, chaosLink{a, b})
+	delete(c.blocked, chaosLink{b, a})
+}
+
+// HealAll removes all partitions.
+func (c *Chaos) HealAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.blocked)
+}
+
+// ResetConns closes all connections between a and b, either may be "*".
+func (c *Chaos) ResetConns(a, b string) {
+	c.mu.Lock()
+	var reset []*chaosConn
+	for conn := range c.conns {
+		if conn.peer == "" {
+			conn.peer = c.names[conn.Conn.RemoteAddr().String()]
+		}
+		local, peer := conn.local, conn.peer
+		if (chaosMatch(a, local) && chaosMatch(b, peer)) || (chaosMatch(a, peer) && chaosMatch(b, local)) {
+			reset = append(reset, conn)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, conn := range reset {
+		conn.Close()
+	}
+}
+
+// Status describes all faults and partitions, one per line.
+func (c *Chaos) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines []string
+	for link, f := range c.faults {
+		lines = append(lines, fmt.Sprintf("fault %s %s %s", link.from, link.to, f))
+	}
+	for link := range c.blocked {
+		lines = append(lines, fmt.Sprintf("partition %s %s", link.from, link.to))
+	}
+	slices.Sort(lines)
+	if len(lines) == 0 {
+		return "no faults\n"
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func chaosMatch(pattern, name string) bool {
+	return pattern == "*" || pattern == name
+}
+
+// link returns the fault from node from to node to and whether the direction is partitioned, c.mu has to be held.
+func (c *Chaos) link(from, to string) (Fault, bool) {
+	if c.blocked[chaosLink{from, to}] {
+		return Fault{}, true
+	}
+	for _, link := range []chaosLink{{from, to}, {from, "*"}, {"*", to}, {"*", "*"}} {
+		if f, ok := c.faults[link]; ok {
+			return f, false
+		}
+	}
+	return Fault{}, false
+}
+
+// chaosAction is what happens to a single write.
+type chaosAction int
+
+const (
+	chaosDeliver chaosAction = iota
+	chaosDrop
+	chaosReset
+)
+
+// rng returns the generator of the direction from node from to node to, c.mu has to be held.
+func (c *Chaos) rng(from, to string) *rand.Rand {
+	link := chaosLink{from, to}
+	rng, ok := c.rngs[link]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(from))
+		h.Write([]byte{0})
+		h.Write([]byte(to))
+		rng = rand.New(rand.NewPCG(c.seed, h.Sum64()))
+		c.rngs[link] = rng
+	}
+	return rng
+}
+
+// decide draws the fate of a write from node from to node to, the time it is delivered at and the bandwidth limit.
+func (c *Chaos) decide(from, to string) (chaosAction, time.Time, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, blocked := c.link(from, to)
+	if blocked {
+		return chaosDrop, time.Time{}, 0
+	}
+	rng := c.rng(from, to)
+	if f.ResetRate > 0 && rng.Float64() < f.ResetRate {
+		return chaosReset, time.Time{}, 0
+	}
+	if f.DropRate > 0 && rng.Float64() < f.DropRate {
+		return chaosDrop, time.Time{}, 0
+	}
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(rng.Int64N(int64(f.Jitter)))
+	}
+	return chaosDeliver, c.clock.Now().Add(delay), f.Bandwidth
+}
+
+func (c *Chaos) nameOf(addr string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.names[addr]
+}
+
+type chaosTransport struct {
+	Transport
+	chaos *Chaos
+	name  string
+}
+
+func (t *chaosTransport) Listen() (net.Listener, error) {
+	l, err := t.Transport.Listen()
+	if err != nil {
+		return nil, err
+	}
+	// The listener may have resolved an ephemeral port
+	t.chaos.mu.Lock()
+	t.chaos.names[l.Addr().String()] = t.name
+	t.chaos.mu.Unlock()
+	return &chaosListener{Listener: l, transport: t}, nil
+}
+
+func (t *chaosTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	to := t.chaos.nameOf(addr)
+	t.chaos.mu.Lock()
+	_, blocked := t.chaos.link(t.name, to)
+	t.chaos.mu.Unlock()
+	if blocked {
+		return nil, &net.OpError{Op: "dial", Net: "chaos", Err: errChaosPartitioned}
+	}
+
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// The accepting end learns who dialed from the local address
+	local := conn.LocalAddr().String()
+	t.chaos.mu.Lock()
+	t.chaos.names[local] = t.name
+	t.chaos.mu.Unlock()
+	c := newChaosConn(conn, t.chaos, t.name, to)
+	c.registered = local
+	return c, nil
+}
+
+func (t *chaosTransport) ListenPacket() (net.PacketConn, error) {
+	p, err := t.Transport.ListenPacket()
+	if err != nil {
+		return nil, err
+	}
+	t.chaos.mu.Lock()
+	t.chaos.names[p.LocalAddr().String()] = t.name
+	t.chaos.mu.Unlock()
+	return &chaosPacketConn{PacketConn: p, transport: t}, nil
+}
+
+// Chaos returns the controller of the transport.
+func (t *chaosTransport) Chaos() *Chaos {
+	return t.chaos
+}
+
+type chaosListener struct {
+	net.Listener
+	transport *chaosTransport
+}
+
+func (l *chaosListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newChaosConn(conn, l.transport.chaos, l.transport.name, ""), nil
+}
+
+type chaosWrite struct {
+	data      []byte
+	at        time.Time
+	bandwidth int
+}
+
+// chaosConn delays, drops and resets writes. Delayed writes are written in order by a pump goroutine.
+type chaosConn struct {
+	net.Conn
+	chaos *Chaos
+	local string
+	// peer is resolved on first use for accepted connections, guarded by chaos.mu
+	peer string
+	// registered is the address a dialed connection named its node under, forgotten once it is closed
+	registered string
+
+	writes    chan chaosWrite
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	// last is the delivery time of the latest write so jitter does not reorder writes
+	last time.Time
+	// err is the error of a failed delayed write, returned by the next Write
+	err error
+}
+
+func newChaosConn(conn net.Conn, chaos *Chaos, local, peer string) *chaosConn {
+	c := &chaosConn{
+		Conn:   conn,
+		chaos:  chaos,
+		local:  local,
+		peer:   peer,
+		writes: make(chan chaosWrite, chaosWriteBuffer),
+		closed: make(chan struct{}),
+	}
+	chaos.mu.Lock()
+	chaos.conns[c] = struct{}{}
+	chaos.mu.Unlock()
+	go c.pump()
+	return c
+}
+
+func (c *chaosConn) peerName() string {
+	c.chaos.mu.Lock()
+	defer c.chaos.mu.Unlock()
+	if c.peer == "" {
+		c.peer = c.chaos.names[c.Conn.RemoteAddr().String()]
+	}
+	return c.peer
+}
+
+func (c *chaosConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	action, at, bandwidth := c.chaos.decide(c.local, c.peerName())
+	switch action {
+	case chaosDrop:
+		return len(b), nil
+	case chaosReset:
+		c.err = &net.OpError{Op: "write", Net: "chaos", Err: errChaosReset}
+		c.Close()
+		return 0, c.err
+	}
+
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+
+	select {
+	case c.writes <- chaosWrite{data: append([]byte(nil), b...), at: at, bandwidth: bandwidth}:
+		return len(b), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *chaosConn) pump() {
+	clock := c.chaos.getClock()
+	// The timer is created with the first write so an idle connection schedules nothing
+	var timer Timer
+	wait := func(d time.Duration) bool {
+		if timer == nil {
+			timer = clock.NewTimer(d)
+		} else {
+			timer.Reset(d)
+		}
+		select {
+		case <-timer.C():
+			return true
+		case <-c.closed:
+			timer.Stop()
+			return false
+		}
+	}
+
+	for {
+		var w chaosWrite
+		select {
+		case w = <-c.writes:
+		case <-c.closed:
+			return
+		}
+
+		if !wait(w.at.Sub(clock.Now())) {
+			return
+		}
+		_, err := c.Conn.Write(w.data)
+		if err != nil {
+			// Closed first, a Write blocked on a full buffer holds mu
+			c.Close()
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			return
+		}
+		if w.bandwidth > 0 && !wait(time.Duration(len(w.data))*time.Second/time.Duration(w.bandwidth)) {
+			return
+		}
+	}
+}
+
+func (c *chaosConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.chaos.mu.Lock()
+		delete(c.chaos.conns, c)
+		if c.registered != "" {
+			delete(c.chaos.names, c.registered)
+		}
+		c.chaos.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+type chaosPacketConn struct {
+	net.PacketConn
+	transport *chaosTransport
+}
+
+func (p *chaosPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	chaos := p.transport.chaos
+	action, _, _ := chaos.decide(p.transport.name, chaos.nameOf(addr.String()))
+	if action != chaosDeliver {
+		return len(b), nil
+	}
+	return p.PacketConn.WriteTo(b, addr)
+}
+
+/*
+chaosCommand answers the CHAOS command of Pulse. data holds one of:
+
+	fault <from> <to> [latency=<duration>] [jitter=<duration>] [drop=<p>] [bandwidth=<bytes/s>] [reset=<p>]
+	clear
+	partition <a> <b> [oneway]
+	heal [<a> <b>]
+	reset <a> <b>
+	status
+
+Every command answers with the status after applying it.
+*/
+func (n *Nodosum) chaosCommand(data []byte) ([]byte, error) {
+	if n.chaos == nil {
+		return nil, errChaosDisabled
+	}
+
+	args := strings.Fields(string(data))
+	if len(args) == 0 {
+		args = []string{"status"}
+	}
+
+	switch {
+	case args[0] == "fault" && len(args) >= 3:
+		f, err := parseFault(args[3:])
+		if err != nil {
+			return nil, err
+		}
+		n.chaos.SetFault(args[1], args[2], f)
+	case args[0] == "clear" && len(args) == 1:
+		n.chaos.ClearFaults()
+	case args[0] == "partition" && (len(args) == 3 || len(args) == 4 && args[3] == "oneway"):
+		n.chaos.Partition(args[1], args[2], len(args) == 4)
+	case args[0] == "heal" && len(args) == 1:
+		n.chaos.HealAll()
+	case args[0] == "heal" && len(args) == 3:
+		n.chaos.Heal(args[1], args[2])
+	case args[0] == "reset" && len(args) == 3:
+		n.chaos.ResetConns(args[1], args[2])
+	case args[0] == "status" && len(args) == 1:
+	default:
+		return nil, fmt.Errorf("invalid chaos command: %s", string(data))
+	}
+
+	n.logger.Warn("chaos command applied", "command", string(data))
+	return []byte(n.chaos.Status()), nil
+}
+
+func parseFault(args []string) (Fault, error) {
+	var f Fault
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return f, fmt.Errorf("invalid fault %q, expected key=value", arg)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			f.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			f.Jitter, err = time.ParseDuration(value)
+		case "drop":
+			f.DropRate, err = strconv.ParseFloat(value, 64)
+		case "bandwidth":
+			f.Bandwidth, err = strconv.Atoi(value)
+		case "reset":
+			f.ResetRate, err = strconv.ParseFloat(value, 64)
+		default:
+			err = fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,268 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chaosPair connects a to b over a memory network wrapped in chaos and returns both ends.
+func chaosPair(t *testing.T, chaos *Chaos) (net.Conn, net.Conn) {
+	t.Helper()
+	memory := NewMemoryNetwork()
+	a := chaos.Transport(memory.Transport("a"), "a")
+	b := chaos.Transport(memory.Transport("b"), "b")
+
+	listener, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := a.Dial(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestChaosLatency(t *testing.T) {
+	chaos := NewChaos(1)
+	chaos.SetFault("a", "b", Fault{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	client, server := chaosPair(t, chaos)
+
+	start := time.Now()
+	for _, msg := range []string{"one", "two", "three"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, len("onetwothree"))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected writes to be delayed by 50ms, took %s", elapsed)
+	}
+	if string(buf) != "onetwothree" {
+		t.Errorf("Expected writes in order, got %q", buf)
+	}
+}
+
+func TestChaosDrop(t *testing.T) {
+	chaos := NewChaos(1)
+	chaos.SetFault("*", "b", Fault{DropRate: 1})
+	client, server := chaosPair(t, chaos)
+
+	if _, err := client.Write([]byte("dropped")); err != nil {
+		t.Fatal(err)
+	}
+	chaos.ClearFaults()
+	if _, err := client.Write([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "kept" {
+		t.Errorf("Expected first write to be dropped, got %q", buf)
+	}
+}
+
+func TestChaosBandwidth(t *testing.T) {
+	chaos := NewChaos(1)
+	chaos.SetFault("a", "b", Fault{Bandwidth: 100 * 1024})
+	client, server := chaosPair(t, chaos)
+
+	go func() {
+		for range 4 {
+			client.Write(make([]byte, 10*1024))
+		}
+	}()
+
+	start := time.Now()
+	if _, err := io.ReadFull(server, make([]byte, 40*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// The last write is read before its transmission time passed
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 40KB at 100KB/s to take about 300ms, took %s", elapsed)
+	}
+}
+
+func TestChaosReset(t *testing.T) {
+	chaos := NewChaos(1)
+	chaos.SetFault("a", "b", Fault{ResetRate: 1})
+	client, server := chaosPair(t, chaos)
+
+	_, err := client.Write([]byte("reset"))
+	if !errors.Is(err, errChaosReset) {
+		t.Fatalf("Expected reset error, got %v", err)
+	}
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected peer to see the connection closed, got %v", err)
+	}
+}
+
+func TestChaosPartition(t *testing.T) {
+	chaos := NewChaos(1)
+	client, server := chaosPair(t, chaos)
+	memory := NewMemoryNetwork()
+	c := chaos.Transport(memory.Transport("c"), "c")
+
+	chaos.Partition("a", "b", true)
+	client.Write([]byte("lost"))
+	server.Write([]byte("back"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "back" {
+		t.Fatalf("Expected one way partition to let b reach a, got %q %v", buf, err)
+	}
+
+	chaos.Partition("a", "b", false)
+	if _, err := server.Read(buf); err == nil {
+		t.Fatal("Expected full partition to reset existing connections")
+	}
+
+	// Dials across a partition are refused
+	chaos.Partition("c", "a", true)
+	a := chaos.Transport(memory.Transport("a"), "a")
+	listener, err := a.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := c.Dial(context.Background(), "a"); !errors.Is(err, errChaosPartitioned) {
+		t.Fatalf("Expected dial across partition to be refused, got %v", err)
+	}
+
+	chaos.HealAll()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := c.Dial(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Expected dial after heal to succeed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestChaosCommand(t *testing.T) {
+	n := &Nodosum{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), chaos: NewChaos(1)}
+
+	for _, cmd := range []string{
+		"fault a b latency=10ms jitter=1ms drop=0.5 bandwidth=1024 reset=0.1",
+		"partition a c oneway",
+	} {
+		if _, err := n.chaosCommand([]byte(cmd)); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	status, err := n.chaosCommand([]byte("status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "fault a b latency=10ms jitter=1ms drop=0.5 bandwidth=1024 reset=0.1\npartition a c\n"
+	if string(status) != want {
+		t.Errorf("Expected status %q, got %q", want, status)
+	}
+
+	status, _ = n.chaosCommand([]byte("heal"))
+	if strings.Contains(string(status), "partition") {
+		t.Errorf("Expected heal to remove partitions, got %q", status)
+	}
+
+	for _, cmd := range []string{"fault a", "fault a b latency=x", "fault a b speed=1", "partition a", "explode"} {
+		if _, err := n.chaosCommand([]byte(cmd)); err == nil {
+			t.Errorf("Expected %q to be rejected", cmd)
+		}
+	}
+
+	n.chaos = nil
+	if _, err := n.chaosCommand([]byte("status")); !errors.Is(err, errChaosDisabled) {
+		t.Errorf("Expected error without chaos transport, got %v", err)
+	}
+}
+
+func TestNodesOnChaosTransport(t *testing.T) {
+	memory := NewMemoryNetwork()
+	chaos := NewChaos(1)
+	a := newTransportNode(t, "a", chaos.Transport(memory.Transport("a"), "a"))
+	b := newTransportNode(t, "b", chaos.Transport(memory.Transport("b"), "b"))
+	if a.chaos != chaos {
+		t.Fatal("Expected node to pick up the chaos controller of its transport")
+	}
+
+	chaos.SetFault("*", "*", Fault{Latency: 10 * time.Millisecond})
+	b.AddPeer("a")
+	waitForPeers(t, a, 1)
+
+	chaos.Partition("a", "b", false)
+	waitForPeers(t, a, 0)
+	waitForPeers(t, b, 0)
+
+	chaos.HealAll()
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+}
+
+func TestChaosForgetsClosedConns(t *testing.T) {
+	memory := NewMemoryNetwork()
+	chaos := NewChaos(1)
+	a := chaos.Transport(memory.Transport("a"), "a")
+	b := chaos.Transport(memory.Transport("b"), "b")
+	l, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	names := func() int {
+		chaos.mu.Lock()
+		defer chaos.mu.Unlock()
+		return len(chaos.names)
+	}
+	before := names()
+	for range 10 {
+		conn, err := a.Dial(context.Background(), "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if after := names(); after != before {
+		t.Fatalf("Expected the names of closed connections to be forgotten, %d names before and %d after", before, after)
+	}
+}
@@ -0,0 +1,248 @@
+package nodosum
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+/*
+Clocks
+
+Heartbeats, idle timeouts, retransmits, reconnects, rate limits, fragment reassembly
+and the delays of the chaos transport read the time from a Clock. Nodes use the wall clock unless Config.Clock is set.
+
+SimClock is a virtual clock for deterministic simulations. Its time only moves when Advance is called,
+timers and tickers fire in the order of their deadlines, ties in the order they were scheduled.
+Socket deadlines, handshake admission timeouts and stream deadlines stay on the wall clock.
+*/
+
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// SimClock is a virtual clock that only advances when told to.
+type SimClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers simTimers
+	// seq numbers every scheduling of a timer, it orders timers with the same deadline
+	seq uint64
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	t := &simTimer{clock: c, ch: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimClock.NewTicker")
+	}
+	t := &simTimer{clock: c, ch: make(chan time.Time, 1), period: d, index: -1}
+	t.Reset(d)
+	return simTicker{t}
+}
+
+// Next returns the deadline of the earliest pending timer.
+func (c *SimClock) Next() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return time.Time{}, false
+	}
+	return c.timers[0].when, true
+}
+
+// Advance moves the clock forward by d, firing all timers that are due on the way.
+func (c *SimClock) Advance(d time.Duration) {
+	c.AdvanceTo(c.Now().Add(d))
+}
+
+// AdvanceTo moves the clock forward to t, firing all timers that are due on the way.
+// Like the wall clock, a ticker whose channel is full drops the tick.
+func (c *SimClock) AdvanceTo(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.timers) > 0 && !c.timers[0].when.After(t) {
+		c.fire(heap.Pop(&c.timers).(*simTimer))
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// fire moves the clock to the deadline of a timer taken from the heap and fires it, c.mu has to be held.
+func (c *SimClock) fire(timer *simTimer) {
+	if timer.when.After(c.now) {
+		c.now = timer.when
+	}
+	select {
+	case timer.ch <- timer.when:
+	default:
+	}
+	if timer.period > 0 {
+		c.schedule(timer, timer.when.Add(timer.period))
+	}
+}
+
+// FireNext advances the clock to the earliest pending timer and fires only that one.
+// It returns false if no timer is pending.
+func (c *SimClock) FireNext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.timers) == 0 {
+		return false
+	}
+	c.fire(heap.Pop(&c.timers).(*simTimer))
+	return true
+}
+
+// schedule adds a timer to the heap, c.mu has to be held.
+func (c *SimClock) schedule(t *simTimer, when time.Time) {
+	c.seq++
+	t.when = when
+	t.seq = c.seq
+	heap.Push(&c.timers, t)
+}
+
+type simTimer struct {
+	clock  *SimClock
+	ch     chan time.Time
+	when   time.Time
+	period time.Duration
+	seq    uint64
+	// index is the position in the heap, -1 if not scheduled
+	index int
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	active := t.index >= 0
+	if active {
+		heap.Remove(&c.timers, t.index)
+	}
+	// Like time.Timer since Go 1.23, no stale value is received after Reset
+	select {
+	case <-t.ch:
+	default:
+	}
+	c.schedule(t, c.now.Add(max(d, 0)))
+	return active
+}
+
+func (t *simTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&c.timers, t.index)
+	return true
+}
+
+type simTicker struct {
+	*simTimer
+}
+
+func (t simTicker) Stop() {
+	t.simTimer.Stop()
+}
+
+// simTimers is a heap of timers ordered by deadline and sequence, the sequence breaks ties in the order timers were scheduled.
+type simTimers []*simTimer
+
+func (h simTimers) Len() int { return len(h) }
+
+func (h simTimers) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h simTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *simTimers) Push(x any) {
+	t := x.(*simTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *simTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
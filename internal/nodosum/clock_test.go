@@ -0,0 +1,166 @@
+package nodosum
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSimClockTimers(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewSimClock(start)
+
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("Expected Stop of a pending timer to report true")
+	}
+
+	if next, ok := clock.Next(); !ok || !next.Equal(start.Add(time.Second)) {
+		t.Fatalf("Expected next deadline after 1s, got %v", next)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case at := <-early.C():
+		if !at.Equal(start.Add(time.Second)) {
+			t.Errorf("Expected timer to fire at its deadline, got %v", at)
+		}
+	default:
+		t.Fatal("Expected due timer to fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("Expected timer to wait for its deadline")
+	case <-stopped.C():
+		t.Fatal("Expected stopped timer not to fire")
+	default:
+	}
+	if !clock.Now().Equal(start.Add(1500 * time.Millisecond)) {
+		t.Errorf("Expected clock at 1.5s, got %v", clock.Now())
+	}
+
+	late.Reset(time.Second)
+	clock.Advance(time.Second)
+	select {
+	case <-late.C():
+	default:
+		t.Fatal("Expected reset timer to fire after its new deadline")
+	}
+}
+
+func TestSimClockTicker(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+
+	var ticks []time.Duration
+	for range 3 {
+		clock.Advance(time.Second)
+		ticks = append(ticks, (<-ticker.C()).Sub(time.Unix(0, 0)))
+	}
+	if ticks[0] != time.Second || ticks[2] != 3*time.Second {
+		t.Errorf("Expected a tick every second, got %v", ticks)
+	}
+
+	// Ticks are dropped like on the wall clock if nobody receives them
+	clock.Advance(5 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Error("Expected missed ticks to be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	if _, ok := clock.Next(); ok {
+		t.Error("Expected stopped ticker to be unscheduled")
+	}
+}
+
+func TestChaosOnSimClock(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	chaos := NewChaos(1)
+	chaos.SetClock(clock)
+	chaos.SetFault("a", "b", Fault{Latency: time.Hour})
+	client, server := chaosPair(t, chaos)
+
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{})
+	go func() {
+		server.Read(make([]byte, 1))
+		close(received)
+	}()
+
+	// The pump schedules its timer asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if next, ok := clock.Next(); ok && next.Equal(time.Unix(0, 0).Add(time.Hour)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected write to be scheduled an hour ahead")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-received:
+		t.Fatal("Expected write to wait for virtual time")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Hour)
+	<-received
+}
+
+func TestSimClockFireNext(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	first := clock.NewTimer(time.Second)
+	second := clock.NewTimer(time.Second)
+
+	if !clock.FireNext() {
+		t.Fatal("Expected a pending timer to fire")
+	}
+	select {
+	case <-first.C():
+	default:
+		t.Fatal("Expected the timer scheduled first to fire first")
+	}
+	select {
+	case <-second.C():
+		t.Fatal("Expected only one timer to fire per call")
+	default:
+	}
+
+	clock.FireNext()
+	<-second.C()
+	if clock.FireNext() {
+		t.Error("Expected no pending timer")
+	}
+}
+
+func TestSimClockTiesFireInScheduleOrder(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	first := clock.NewTimer(time.Second)
+	second := clock.NewTimer(time.Second)
+	third := clock.NewTimer(time.Second)
+	// A reset timer is scheduled again and fires after the others with the same deadline
+	first.Reset(time.Second)
+
+	var order []string
+	for clock.FireNext() {
+		select {
+		case <-first.C():
+			order = append(order, "first")
+		case <-second.C():
+			order = append(order, "second")
+		case <-third.C():
+			order = append(order, "third")
+		}
+	}
+	if want := []string{"second", "third", "first"}; !slices.Equal(order, want) {
+		t.Errorf("Expected timers to fire in order %v, got %v", want, order)
+	}
+}
@@ -0,0 +1,183 @@
+package nodosum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Payload compression.
+
+Sending compresses APP payloads bigger than the configured threshold
+with the algorithm configured on the sending node and sets the COMPRESSED flag.
+The first byte of a compressed payload names the algorithm.
+Both ends announce the algorithms they can decompress in the handshake, a connection only carries
+compressed payloads if the peer announced the algorithm of the sender, otherwise they are sent as is.
+So nodes with different settings, or without support for an algorithm, can be mixed during a rolling deploy.
+A payload is only sent compressed if that actually makes it smaller.
+Payloads decompressing to more than the maximum message size are a protocol violation, so a small
+frame can not make the receiver allocate unbounded memory.
+Applications can opt out with DisableCompression, e.g. when they already send compressed data.
+*/
+
+const (
+	COMPRESSION_NONE = iota
+	COMPRESSION_GZIP
+	COMPRESSION_ZSTD
+	COMPRESSION_SNAPPY
+)
+
+// compressionSupported is the bitset of algorithms this node can decompress, 1 << algorithm each
+const compressionSupported uint8 = 1<<COMPRESSION_GZIP | 1<<COMPRESSION_ZSTD | 1<<COMPRESSION_SNAPPY
+
+var (
+	errUnknownCompression = errors.New("unknown compression algorithm")
+	errDecompressedSize   = errors.New("decompressed payload exceeds maximum message size")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+	// zstdDecoders holds the shared decoders by the output limit they enforce
+	zstdDecoders sync.Map
+)
+
+// zstdCodec lazily creates the shared zstd encoder, it is safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	return zstdEncoder, zstdErr
+}
+
+// zstdDecoder returns the shared decoder refusing to decode more than limit bytes, it is safe for concurrent use.
+func zstdDecoder(limit int) (*zstd.Decoder, error) {
+	if v, ok := zstdDecoders.Load(limit); ok {
+		return v.(*zstd.Decoder), nil
+	}
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderMaxMemory(uint64(limit)),
+		zstd.WithDecoderMaxWindow(uint64(min(max(limit, zstd.MinWindowSize), zstd.MaxWindowSize))),
+	)
+	if err != nil {
+		return nil, err
+	}
+	v, loaded := zstdDecoders.LoadOrStore(limit, dec)
+	if loaded {
+		dec.Close()
+	}
+	return v.(*zstd.Decoder), nil
+}
+
+// compressPayload compresses payload with algorithm, prefixed by the algorithm byte, and appends it to dst.
+func compressPayload(algorithm int, dst []byte, payload []byte) ([]byte, error) {
+	out := append(dst, uint8(algorithm))
+
+	switch algorithm {
+	case COMPRESSION_GZIP:
+		buf := bytes.NewBuffer(out)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case COMPRESSION_ZSTD:
+		enc, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(payload, out), nil
+	case COMPRESSION_SNAPPY:
+		out = slices.Grow(out, s2.MaxEncodedLen(len(payload)))
+		encoded := s2.EncodeSnappy(out[len(out):cap(out)], payload)
+		return out[:len(out)+len(encoded)], nil
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnknownCompression, algorithm)
+	}
+}
+
+// decompressPayload reverses compressPayload using the algorithm named in the first byte.
+// It fails with errDecompressedSize instead of decompressing more than limit bytes.
+func decompressPayload(payload []byte, limit int) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty compressed payload")
+	}
+
+	algorithm, data := int(payload[0]), payload[1:]
+
+	switch algorithm {
+	case COMPRESSION_GZIP:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, errDecompressedSize
+		}
+		return out, nil
+	case COMPRESSION_ZSTD:
+		dec, err := zstdDecoder(limit)
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, fmt.Errorf("%w: %w", errDecompressedSize, err)
+		}
+		return out, err
+	case COMPRESSION_SNAPPY:
+		size, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > limit {
+			return nil, errDecompressedSize
+		}
+		return s2.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnknownCompression, algorithm)
+	}
+}
+
+// connCompression returns the algorithm to compress with on a connection to a node that can decompress accepted.
+func (n *Nodosum) connCompression(accepted uint8) int {
+	if n.compression <= COMPRESSION_NONE || n.compression > COMPRESSION_SNAPPY || accepted&(1<<n.compression) == 0 {
+		return COMPRESSION_NONE
+	}
+	return n.compression
+}
+
+// maybeCompress compresses payloads of at least the configured threshold with algorithm into dst.
+// It returns the payload to send and whether it is compressed.
+func (n *Nodosum) maybeCompress(dst []byte, payload []byte, optOut bool, algorithm int) ([]byte, bool) {
+	if optOut || algorithm == COMPRESSION_NONE || len(payload) < n.compressionThreshold {
+		return payload, false
+	}
+
+	compressed, err := compressPayload(algorithm, dst, payload)
+	if err != nil {
+		n.logger.Error("error compressing payload", "error", err.Error())
+		return payload, false
+	}
+	if len(compressed) >= len(payload) {
+		return payload, false
+	}
+	return compressed, true
+}
@@ -0,0 +1,109 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("mycorrizal "), 10000)
+
+	for _, algorithm := range []int{COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_SNAPPY} {
+		compressed, err := compressPayload(algorithm, nil, payload)
+		if err != nil {
+			t.Fatalf("algorithm %d: %v", algorithm, err)
+		}
+		if int(compressed[0]) != algorithm {
+			t.Errorf("Expected algorithm byte %d, got %d", algorithm, compressed[0])
+		}
+		if len(compressed) >= len(payload) {
+			t.Errorf("algorithm %d: expected compressed payload to be smaller, got %d bytes", algorithm, len(compressed))
+		}
+
+		decompressed, err := decompressPayload(compressed, len(payload))
+		if err != nil {
+			t.Fatalf("algorithm %d: %v", algorithm, err)
+		}
+		if !bytes.Equal(decompressed, payload) {
+			t.Errorf("algorithm %d: round trip mismatch", algorithm)
+		}
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte{0}, 1024*1024)
+
+	for _, algorithm := range []int{COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_SNAPPY} {
+		compressed, err := compressPayload(algorithm, nil, payload)
+		if err != nil {
+			t.Fatalf("algorithm %d: %v", algorithm, err)
+		}
+		if _, err := decompressPayload(compressed, len(payload)-1); !errors.Is(err, errDecompressedSize) {
+			t.Errorf("algorithm %d: expected %d bytes from %d to exceed the limit, got %v", algorithm, len(payload), len(compressed), err)
+		}
+	}
+}
+
+func TestMaybeCompress(t *testing.T) {
+	n := &Nodosum{logger: slog.Default(), compression: COMPRESSION_ZSTD, compressionThreshold: 1024}
+	big := bytes.Repeat([]byte("a"), 4096)
+
+	if _, compressed := n.maybeCompress(nil, big[:100], false, n.compression); compressed {
+		t.Error("Expected payload below threshold to stay uncompressed")
+	}
+	if _, compressed := n.maybeCompress(nil, big, true, n.compression); compressed {
+		t.Error("Expected opted out payload to stay uncompressed")
+	}
+	if _, compressed := n.maybeCompress(nil, big, false, n.compression); !compressed {
+		t.Error("Expected payload above threshold to be compressed")
+	}
+}
+
+func TestConnCompression(t *testing.T) {
+	n := &Nodosum{compression: COMPRESSION_ZSTD}
+	if algorithm := n.connCompression(compressionSupported); algorithm != COMPRESSION_ZSTD {
+		t.Errorf("Expected zstd for a node supporting every algorithm, got %d", algorithm)
+	}
+	if algorithm := n.connCompression(1 << COMPRESSION_GZIP); algorithm != COMPRESSION_NONE {
+		t.Errorf("Expected no compression for a node without zstd, got %d", algorithm)
+	}
+	n.compression = COMPRESSION_NONE
+	if algorithm := n.connCompression(compressionSupported); algorithm != COMPRESSION_NONE {
+		t.Errorf("Expected no compression if disabled, got %d", algorithm)
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newTransportNode(t, "a", memory.Transport("a"), func(cfg *Config) {
+		cfg.Compression = COMPRESSION_SNAPPY
+	})
+	b := newMemoryNode(t, memory, "b")
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	fromA, _ := a.nodeConnection("b")
+	fromB, _ := b.nodeConnection("a")
+	if fromA.compression != COMPRESSION_SNAPPY || fromB.compression != COMPRESSION_NONE {
+		t.Errorf("Expected snappy from a and no compression from b, got %d and %d", fromA.compression, fromB.compression)
+	}
+
+	// A HELLO without EXT_COMPRESSION is sent by nodes of version 2, which decompress everything
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(handshakeFrame(HANDSHAKE_HELLO, encodeHello(&hello{nonce: make([]byte, handshakeNonceSize), maxFrameSize: 4096, nodeId: "old"})))
+	peer, err := readHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.compression != compressionSupported {
+		t.Errorf("Expected a HELLO without compression extension to accept every algorithm, got %b", peer.compression)
+	}
+}
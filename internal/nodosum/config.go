@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"io"
 	"log/slog"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ type Config struct {
 	Ctx                    context.Context
 	ListenPort             int
 	SharedSecret           string
+	PreviousSharedSecrets  []string
 	HandshakeTimeout       time.Duration
 	Logger                 *slog.Logger
 	Wg                     *sync.WaitGroup
@@ -23,4 +25,30 @@ type Config struct {
 	TlsCert                *tls.Certificate
 	MultiplexerBufferSize  int
 	MultiplexerWorkerCount int
+	AuditSink              io.Writer
+	AuditBufferSize        int
+	PeerRoles              map[string][]string
+	MaxConnections         int
+	MaxConnectionsPerIP    int
+	MaxHandshakes          int
+	ConnFrameRate          float64
+	ConnByteRate           float64
+	RateLimitAction        int
+	Compression            int
+	CompressionThreshold   int
+	FragmentSize           int
+	MaxMessageSize         int
+	RetransmitInterval     time.Duration
+	SendQueueSize          int
+	SendQueuePolicy        int
+	HeartbeatInterval      time.Duration
+	IdleTimeout            time.Duration
+	Transport              Transport
+	Peers                  []string
+	ReconnectInterval      time.Duration
+	ConnectionsPerPeer     int
+	MaxFrameSize           int
+	BroadcastFanout        int
+	MaxConcurrentRequests  int
+	Clock                  Clock
 }
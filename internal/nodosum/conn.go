@@ -3,25 +3,25 @@ package nodosum
 import (
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
-	"time"
 )
 
-// TODO: Introduce UDP for connection negotiation
+// TODO: Introduce UDP for connection negotiation, packets sent have to be sealed with udpCipher
 
-func (n *Nodosum) listenUdp() {
+func (n *Nodosum) listenPackets() {
 	n.wg.Go(
 		func() {
 			<-n.ctx.Done()
-			err := n.udpConn.Close()
+			err := n.packetConn.Close()
 			if err != nil {
-				n.logger.Info("udpConn close failed", "error", err.Error())
+				n.logger.Info("packetConn close failed", "error", err.Error())
 			}
-			n.logger.Info("listenerTcp closed")
+			n.logger.Info("packetConn closed")
 		},
 	)
 
@@ -31,28 +31,49 @@ func (n *Nodosum) listenUdp() {
 			return
 		default:
 			buf := make([]byte, 1024)
-			bytesRead, addr, err := n.udpConn.ReadFromUDP(buf)
+			bytesRead, addr, err := n.packetConn.ReadFrom(buf)
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				n.logger.Info("udp read failed", "error", err.Error(), "bytesRead", bytesRead, "addr", addr)
+				continue
 			}
 
-			go n.handleUdp(buf[:bytesRead])
+			go n.handleUdp(buf[:bytesRead], addr)
 		}
 	}
 
 }
 
-func (n *Nodosum) handleUdp(bytes []byte) {}
+func (n *Nodosum) handleUdp(packet []byte, addr net.Addr) {
+	bytes, err := n.udpCipher.open(packet)
+	if err != nil {
+		n.logger.Warn("dropping udp packet", "error", err.Error(), "addr", addr)
+		return
+	}
 
-func (n *Nodosum) listenTcp() {
+	if len(bytes) < handshakePacketSize {
+		n.logger.Debug("dropping short udp packet", "length", len(bytes))
+		return
+	}
+
+	hp := decodeHandshakePacket(bytes)
+	if !n.keyring.acceptsFingerprint(hp.Secret) {
+		n.logger.Warn("dropping handshake packet with unknown secret", "id", hp.Id)
+		return
+	}
+}
+
+func (n *Nodosum) listenConns() {
 	n.wg.Go(
 		func() {
 			<-n.ctx.Done()
-			err := n.listenerTcp.Close()
+			err := n.listener.Close()
 			if err != nil {
-				n.logger.Info("listenerTcp close failed", "error", err.Error())
+				n.logger.Info("listener close failed", "error", err.Error())
 			}
-			n.logger.Info("listenerTcp closed")
+			n.logger.Info("listener closed")
 		},
 	)
 
@@ -62,18 +83,18 @@ func (n *Nodosum) listenTcp() {
 		case <-n.ctx.Done():
 			return
 		default:
-			conn, err := n.listenerTcp.Accept()
+			conn, err := n.listener.Accept()
 			if err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					n.logger.Error("error accepting TCP connection", err.Error())
+				if errors.Is(err, net.ErrClosed) {
+					return
 				}
+				n.logger.Error("error accepting connection", "error", err.Error())
 				continue
 			}
-			if n.tlsEnabled {
-				conn = n.upgradeConn(conn)
-				if conn == nil {
-					continue
-				}
+			if !n.admission.admit(conn.RemoteAddr()) {
+				n.logger.Warn("rejecting TCP connection, connection limit reached", "remote", conn.RemoteAddr())
+				conn.Close()
+				continue
 			}
 			n.wg.Add(1)
 			go n.handleConn(conn)
@@ -83,13 +104,9 @@ func (n *Nodosum) listenTcp() {
 
 func (n *Nodosum) upgradeConn(conn net.Conn) net.Conn {
 	tlsConn := tls.Server(conn, n.tlsConfig)
-	hsCtx, _ := context.WithDeadline(n.ctx, time.Now().Add(n.handshakeTimeout))
-	err := tlsConn.HandshakeContext(hsCtx)
-	if err != nil {
-		n.logger.Warn("error setting handshake context", "error", err.Error())
-	}
-	err = tlsConn.Handshake()
-	if err != nil {
+	hsCtx, cancel := context.WithTimeout(n.ctx, n.handshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
 		n.logger.Error("error handshake TLS connection", "error", err.Error(), "remote", conn.RemoteAddr())
 		conn.Close()
 		return nil
@@ -100,28 +117,67 @@ func (n *Nodosum) upgradeConn(conn net.Conn) net.Conn {
 func (n *Nodosum) handleConn(conn net.Conn) {
 	defer n.wg.Done()
 
-	nodeConnId := n.serverHandshake(conn)
+	remote := conn.RemoteAddr()
+	if !n.admission.acquireHandshake(n.ctx, n.handshakeTimeout) {
+		n.logger.Warn("rejecting TCP connection, too many concurrent handshakes", "remote", remote)
+		conn.Close()
+		n.admission.release(remote)
+		return
+	}
 
-	err := conn.SetReadDeadline(time.Time{})
+	if n.tlsEnabled {
+		conn = n.upgradeConn(conn)
+		if conn == nil {
+			n.admission.releaseHandshake()
+			n.admission.release(remote)
+			return
+		}
+	}
+
+	peeked, pulse, err := n.detectPulse(conn)
 	if err != nil {
-		n.logger.Error("error setting read deadline", err.Error())
+		n.logger.Warn("error reading from new connection", "error", err.Error(), "remote", remote)
+		conn.Close()
+		n.admission.releaseHandshake()
+		n.admission.release(remote)
+		return
+	}
+	conn = peeked
+	if pulse {
+		n.admission.releaseHandshake()
+		n.handlePulse(conn)
+		n.admission.release(remote)
+		return
+	}
+
+	peer, err := n.handshake(conn, false, 0)
+	n.admission.releaseHandshake()
+	if err != nil {
+		n.logger.Warn("error in node handshake", "error", err.Error(), "remote", remote)
+		conn.Close()
+		n.admission.release(remote)
+		return
 	}
 
-	n.createConnChannel(nodeConnId, conn)
-	n.wg.Add(1)
-	go n.startRwLoops(nodeConnId)
+	_, err = n.registerConn(conn, peer, false)
+	if err != nil {
+		n.logger.Debug("closing connection", "error", err.Error(), "remote", remote)
+		conn.Close()
+		n.admission.release(remote)
+	}
 }
 
 func (n *Nodosum) startRwLoops(id uint32) {
 	defer n.wg.Done()
-	n.wg.Add(2)
+	n.wg.Add(3)
 
 	go n.writeLoop(id)
 	go n.readLoop(id)
-}
+	go n.heartbeatLoop(id)
 
-func (n *Nodosum) serverHandshake(conn net.Conn) uint32 {
-	return 0
+	if v, ok := n.connections.Load(id); ok {
+		n.announceApplications(v.(*nodeConn))
+	}
 }
 
 func (n *Nodosum) readLoop(id uint32) {
@@ -132,6 +188,11 @@ func (n *Nodosum) readLoop(id uint32) {
 		return
 	}
 	connChan := v.(*nodeConn)
+	// Every read counts as activity, a large frame or a busy multiplexer does not make the connection look idle
+	r := &seenReader{r: connChan.conn, nc: connChan, clock: n.clock}
+
+	// header holds the fixed header and the length of the extension area, it is reused for every frame
+	header := make([]byte, frameHeaderSize+extensionAreaHeaderSize)
 
 	for {
 		select {
@@ -139,38 +200,74 @@ func (n *Nodosum) readLoop(id uint32) {
 			n.logger.Debug(fmt.Sprintf("read loop for %d cancelled", id))
 			return
 		default:
-			// Receive and decode frame header
-			headerBytes := make([]byte, 11)
-			i, err := io.ReadFull(connChan.conn, headerBytes)
+			// Receive frame header
+			_, err := io.ReadFull(r, header[:frameHeaderSize])
 			if err != nil {
 				n.handleConnError(err, id)
 				continue
 			}
-			if i != 11 {
-				n.handleConnError(fmt.Errorf("invalid frame header length %d", i), id)
-				continue
+			if err := checkFrameHeader(header[:frameHeaderSize]); err != nil {
+				n.protocolViolation(id, err)
+				return
 			}
 
-			header := decodeFrameHeader(headerBytes)
-			payloadLength := header.Length
-			payloadBytes := make([]byte, payloadLength)
+			prefix := frameHeaderSize
+			areaLength := 0
+			if headerFlags(header)&EXTENDED != 0 {
+				_, err = io.ReadFull(r, header[frameHeaderSize:])
+				if err != nil {
+					n.handleConnError(err, id)
+					continue
+				}
+				prefix += extensionAreaHeaderSize
+				areaLength = int(binary.LittleEndian.Uint16(header[frameHeaderSize:]))
+				if areaLength == 0 {
+					n.protocolViolation(id, errEmptyExtensionArea)
+					return
+				}
+			}
+			frameLength := prefix + areaLength + int(binary.LittleEndian.Uint32(header[7:11]))
+			if connChan.maxFrameSize > 0 && frameLength > connChan.maxFrameSize {
+				n.protocolViolation(id, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, frameLength))
+				return
+			}
+
+			if !n.enforceRateLimits(connChan, frameLength) {
+				n.closeConnChannel(id)
+				return
+			}
 
-			// Read Payload
-			i, err = io.ReadFull(connChan.conn, payloadBytes)
+			// The frame is allocated once, extension area and payload are read right behind the header
+			frame := make([]byte, frameLength)
+			copy(frame, header[:prefix])
+			_, err = io.ReadFull(r, frame[prefix:])
 			if err != nil {
 				n.handleConnError(err, id)
 				continue
 			}
-			if i != int(header.Length) {
-				n.handleConnError(fmt.Errorf("invalid frame payload length %d", i), id)
-				continue
+
+			select {
+			case connChan.readChan <- &inboundFrame{connId: id, frame: frame}:
+			case <-connChan.ctx.Done():
+				return
 			}
+		}
+	}
+}
 
-			frameBytes := append(headerBytes, payloadBytes...)
+// seenReader updates the time the connection was last seen whenever bytes are read from it.
+type seenReader struct {
+	r     io.Reader
+	nc    *nodeConn
+	clock Clock
+}
 
-			connChan.readChan <- frameBytes
-		}
+func (sr *seenReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.nc.lastSeen.Store(sr.clock.Now().UnixNano())
 	}
+	return n, err
 }
 
 func (n *Nodosum) writeLoop(id uint32) {
@@ -182,24 +279,51 @@ func (n *Nodosum) writeLoop(id uint32) {
 	}
 	connChan := v.(*nodeConn)
 
+	batch := make([][]byte, 0, writeBatchFrames)
 	for {
 		select {
 		case <-connChan.ctx.Done():
 			n.logger.Debug(fmt.Sprintf("write loop for %d cancelled", id))
 			return
-		case msg := <-connChan.writeChan:
-			if msg == nil {
-				continue
-			}
-
-			_, err := connChan.conn.Write(append(msg.([]byte)))
-			if err != nil {
-				n.logger.Error("error writing to tcp connection", "error", err.Error())
+		case <-connChan.queue.ready:
+			for {
+				batch = connChan.queue.popBatch(batch[:0], writeBatchFrames, writeBatchBytes)
+				if len(batch) == 0 {
+					break
+				}
+				err := writeBatch(connChan.conn, batch)
+				clear(batch)
+				if err != nil {
+					n.logger.Error("error writing to tcp connection", "error", err.Error())
+				}
 			}
 		}
 	}
 }
 
+// writeBatch writes all frames of a batch, with one vectored write if the connection supports it.
+// Other connections, like TLS, get the frames copied into one buffer so they are not written one by one.
+func writeBatch(conn net.Conn, batch [][]byte) error {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		buffers := net.Buffers(batch)
+		_, err := buffers.WriteTo(conn)
+		return err
+	}
+
+	if len(batch) == 1 {
+		_, err := conn.Write(batch[0])
+		return err
+	}
+	scratch := getScratch()
+	defer putScratch(scratch)
+	for _, frame := range batch {
+		*scratch = append(*scratch, frame...)
+	}
+	_, err := conn.Write(*scratch)
+	return err
+}
+
 func (n *Nodosum) handleConnError(err error, chanId uint32) {
 	if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, io.ErrUnexpectedEOF) {
 		n.logger.Debug("closing conn because of closed connection or deadline exceeded")
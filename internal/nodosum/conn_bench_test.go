@@ -0,0 +1,140 @@
+package nodosum
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newBenchConn connects a Nodosum connection to a loopback TCP peer, returning the connection and the peer.
+func newBenchConn(b *testing.B) (*Nodosum, *nodeConn, net.Conn) {
+	b.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := <-accepted
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Nodosum{
+		clock:              realClock{},
+		ctx:                ctx,
+		wg:                 &sync.WaitGroup{},
+		logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+		connections:        &sync.Map{},
+		violations:         &sync.Map{},
+		remoteApplications: &sync.Map{},
+		applications:       &sync.Map{},
+		admission:          newAdmission(0, 0, 0),
+		globalReadChannel:  make(chan any, 1024),
+		sendQueueSize:      DEFAULT_SEND_QUEUE_SIZE,
+		rpcCalls:           &sync.Map{},
+	}
+	n.createConnChannel(1, &hello{}, false, conn)
+	v, _ := n.connections.Load(uint32(1))
+
+	b.Cleanup(func() {
+		cancel()
+		n.closeConnChannel(1)
+		peer.Close()
+		n.wg.Wait()
+	})
+	return n, v.(*nodeConn), peer
+}
+
+func benchFrame(size int) []byte {
+	n := &Nodosum{}
+	return n.encodeFrames(&dataPackage{id: 1, payload: make([]byte, size), uncompressed: true}, COMPRESSION_NONE)[0]
+}
+
+func reportFrameRate(b *testing.B, start time.Time) {
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "frames/s")
+}
+
+func BenchmarkEncodeFrame(b *testing.B) {
+	n := &Nodosum{}
+	dataPack := &dataPackage{id: 1, payload: make([]byte, 1024), uncompressed: true}
+	b.ReportAllocs()
+	for b.Loop() {
+		n.encodeFrames(dataPack, COMPRESSION_NONE)
+	}
+}
+
+func BenchmarkReadLoop(b *testing.B) {
+	for _, size := range []int{64, 1024, 64 * 1024} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			n, _, peer := newBenchConn(b)
+			frame := benchFrame(size)
+			n.wg.Add(1)
+			go n.readLoop(1)
+			go func() {
+				for range b.N {
+					if _, err := peer.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for range b.N {
+				<-n.globalReadChannel
+			}
+			reportFrameRate(b, start)
+		})
+	}
+}
+
+func BenchmarkWriteLoop(b *testing.B) {
+	for _, size := range []int{64, 1024, 64 * 1024} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			n, nc, peer := newBenchConn(b)
+			frame := benchFrame(size)
+			n.wg.Add(1)
+			go n.writeLoop(1)
+
+			done := make(chan struct{})
+			go func() {
+				io.CopyN(io.Discard, peer, int64(b.N*len(frame)))
+				close(done)
+			}()
+
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for range b.N {
+				if err := n.enqueue(context.Background(), nc, frame, SEND_QUEUE_BLOCK); err != nil {
+					b.Fatal(err)
+				}
+			}
+			<-done
+			reportFrameRate(b, start)
+		})
+	}
+}
+
+func byteSize(size int) string {
+	if size >= 1024 {
+		return fmt.Sprintf("%dkb", size/1024)
+	}
+	return fmt.Sprintf("%db", size)
+}
@@ -0,0 +1,358 @@
+package nodosum
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Acknowledged delivery for applications that enabled it with EnableReliableDelivery.
+
+Every message sent to a peer gets a sequence number, counted per peer and application,
+carried by all of its frames as EXT_SEQUENCE together with the ACK_REQUESTED flag.
+Sequence numbers are only meaningful within one process of each node: every process picks a random epoch
+at start, sent along with every sequence number and acknowledgement and in the HELLO of the handshake.
+The sender keeps the messages until the peer acknowledged them and retransmits
+everything unacknowledged every retransmitInterval, which also covers frames lost with a dropped connection. Frames are encoded again if a retransmit
+goes to a connection that negotiated another compression algorithm.
+
+The receiver delivers messages in sequence order, holding back messages that overtook a missing one,
+and drops messages it already delivered. A message that does not fit into the receive queue of the
+application is not delivered and the sender retransmits it. Acknowledgements are cumulative: a SYSTEM frame
+with an EXT_ACK extension carrying the highest sequence number delivered in order.
+Together this gives exactly once, in order delivery per peer for as long as both nodes are running.
+
+A receiver resets its inbox when the epoch of the sender changed, the restarted sender counts from 1 again.
+A sender that connects to a restarted receiver numbers its unacknowledged messages from 1 again and
+ignores acknowledgements of other epochs than the one of the receiver it numbered them for.
+Messages the previous receiver process got but did not acknowledge are delivered once more.
+
+A sender keeps at most maxUnacked messages per peer and application, Send fails with ErrOutboxFull beyond that.
+Messages to a node that was never connected fail with ErrNodeUnreachable.
+
+Sequence and acknowledgement extension value (16 bytes):
+	uint64 epoch | uint64 sequence number
+*/
+
+const (
+	DEFAULT_RETRANSMIT_INTERVAL = time.Second
+	// maxHeldBack limits the messages a receiver holds back while waiting for a missing one
+	maxHeldBack = 1024
+	// maxUnacked limits the messages a sender keeps per peer and application until acknowledged
+	maxUnacked = 4096
+)
+
+// ErrOutboxFull is returned by Send with reliable delivery if too many messages to a node are unacknowledged.
+var ErrOutboxFull = errors.New("too many unacknowledged messages")
+
+type deliveryKey struct {
+	nodeId        string
+	applicationId uint32
+}
+
+type unackedMessage struct {
+	seq  uint64
+	pack dataPackage
+	// frames are encoded for the compression algorithm of the connection they were last sent on
+	frames      [][]byte
+	compression int
+	sent        time.Time
+	// stripeKey keeps retransmits on the connection the message was sent on
+	stripeKey uint64
+}
+
+// outbox tracks the messages sent to one peer application that were not acknowledged yet.
+type outbox struct {
+	mu      sync.Mutex
+	nextSeq uint64
+	unacked []*unackedMessage
+	// peerEpoch is the epoch of the receiving process the sequence numbers count for, 0 if not connected yet
+	peerEpoch uint64
+}
+
+// inbox tracks the messages received from one peer application.
+type inbox struct {
+	mu sync.Mutex
+	// epoch is the epoch of the sending process the sequence numbers count for
+	epoch     uint64
+	delivered uint64
+	heldBack  map[uint64][]byte
+}
+
+func encodeSequence(epoch, seq uint64) []byte {
+	buf := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buf[0:8], epoch)
+	binary.LittleEndian.PutUint64(buf[8:16], seq)
+	return buf
+}
+
+func decodeSequence(b []byte) (uint64, uint64, error) {
+	if len(b) != 16 {
+		return 0, 0, errors.New("invalid sequence extension")
+	}
+	return binary.LittleEndian.Uint64(b[0:8]), binary.LittleEndian.Uint64(b[8:16]), nil
+}
+
+// newEpoch returns a random epoch for this process, never 0.
+func newEpoch() uint64 {
+	var b [8]byte
+	for {
+		_, _ = rand.Read(b[:])
+		if epoch := binary.LittleEndian.Uint64(b[:]); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// outboxFor returns the outbox for key, creating it only if the node is connected.
+func (n *Nodosum) outboxFor(key deliveryKey) (*outbox, bool) {
+	if v, ok := n.outboxes.Load(key); ok {
+		return v.(*outbox), true
+	}
+	nc, ok := n.nodeConnection(key.nodeId)
+	if !ok {
+		return nil, false
+	}
+	v, _ := n.outboxes.LoadOrStore(key, &outbox{peerEpoch: nc.epoch})
+	return v.(*outbox), true
+}
+
+// resetOutboxes numbers the unacknowledged messages to nodeId from 1 again if the process on nodeId changed.
+// It runs before a new connection to the node is used.
+func (n *Nodosum) resetOutboxes(nodeId string, epoch uint64) {
+	n.outboxes.Range(func(k, v any) bool {
+		if k.(deliveryKey).nodeId != nodeId {
+			return true
+		}
+		ob := v.(*outbox)
+		ob.mu.Lock()
+		defer ob.mu.Unlock()
+		if ob.peerEpoch != 0 && ob.peerEpoch != epoch {
+			for i, msg := range ob.unacked {
+				msg.seq = uint64(i + 1)
+				msg.pack.seq = msg.seq
+				msg.compression = -1
+				msg.sent = time.Time{}
+			}
+			ob.nextSeq = uint64(len(ob.unacked))
+		}
+		ob.peerEpoch = epoch
+		return true
+	})
+}
+
+func (n *Nodosum) inboxFor(key deliveryKey) *inbox {
+	v, _ := n.inboxes.LoadOrStore(key, &inbox{heldBack: make(map[uint64][]byte)})
+	return v.(*inbox)
+}
+
+// sendReliable assigns the next sequence number of the peer to dataPack and keeps its frames until acknowledged.
+// Frames that do not fit into the send queue are left to the retransmit, unless the queue policy is to block.
+func (n *Nodosum) sendReliable(ctx context.Context, dataPack *dataPackage, nodeId string) error {
+	ob, ok := n.outboxFor(deliveryKey{nodeId: nodeId, applicationId: dataPack.id})
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNodeUnreachable, nodeId)
+	}
+
+	ob.mu.Lock()
+	if len(ob.unacked) >= maxUnacked {
+		ob.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrOutboxFull, nodeId)
+	}
+	ob.nextSeq++
+	msg := &unackedMessage{seq: ob.nextSeq, pack: *dataPack, compression: -1, sent: n.clock.Now(), stripeKey: dataPack.stripeKey()}
+	msg.pack.seq = msg.seq
+	msg.pack.epoch = n.epoch
+	ob.unacked = append(ob.unacked, msg)
+	ob.mu.Unlock()
+
+	// Without a connection the frames are sent by the next retransmit
+	nc, ok := n.nodeConnectionFor(nodeId, msg.stripeKey)
+	if !ok {
+		return nil
+	}
+	policy := dataPack.queuePolicy
+	if policy != SEND_QUEUE_BLOCK {
+		policy = SEND_QUEUE_DROP_NEWEST
+	}
+	for _, frame := range n.reliableFrames(ob, msg, nc.compression) {
+		err := n.enqueue(ctx, nc, frame, policy)
+		if errors.Is(err, ErrNodeUnreachable) || errors.Is(err, errFrameDropped) {
+			// The whole message is sent again by the retransmit
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reliableFrames returns the frames of msg compressed with algorithm, encoding them again if it changed.
+func (n *Nodosum) reliableFrames(ob *outbox, msg *unackedMessage, algorithm int) [][]byte {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if msg.compression != algorithm {
+		msg.frames = n.encodeFrames(&msg.pack, algorithm)
+		msg.compression = algorithm
+	}
+	return msg.frames
+}
+
+// handleAck drops all messages up to the acknowledged sequence number.
+// Acknowledgements of a process the messages were not numbered for are ignored.
+func (n *Nodosum) handleAck(connId uint32, header *frameHeader) {
+	value, _ := header.extension(EXT_ACK)
+	epoch, seq, err := decodeSequence(value)
+	if err != nil {
+		n.logger.Error("error decoding ack", "error", err.Error(), "conn", connId)
+		return
+	}
+
+	v, ok := n.outboxes.Load(deliveryKey{nodeId: n.nodeIdOf(connId), applicationId: header.ApplicationID})
+	if !ok {
+		return
+	}
+	ob := v.(*outbox)
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if epoch != ob.peerEpoch {
+		return
+	}
+	i := 0
+	for i < len(ob.unacked) && ob.unacked[i].seq <= seq {
+		i++
+	}
+	ob.unacked = ob.unacked[i:]
+}
+
+func (n *Nodosum) sendAck(connId uint32, applicationId uint32, seq uint64) {
+	v, ok := n.connections.Load(connId)
+	if !ok || v == nil {
+		return
+	}
+
+	fh := frameHeader{
+		Version:       PROTOCOL_VERSION,
+		ApplicationID: applicationId,
+		Type:          SYSTEM,
+		Extensions:    []frameExtension{{Type: EXT_ACK, Value: encodeSequence(n.epoch, seq)}},
+	}
+	// The multiplexer must not wait for a full send queue, acks are cumulative and the next one covers a dropped one
+	err := n.enqueue(n.ctx, v.(*nodeConn), encodeFrameHeader(&fh), SEND_QUEUE_DROP_NEWEST)
+	if err != nil && !errors.Is(err, ErrNodeUnreachable) && !errors.Is(err, errFrameDropped) {
+		n.logger.Debug("error sending ack", "error", err.Error(), "conn", connId)
+	}
+}
+
+// receiveReliable delivers the messages that can be delivered in order after receiving message seq of epoch.
+// A message the receive queue has no room for counts as not received, the sender retransmits it.
+// Duplicates are acknowledged again but not delivered.
+func (n *Nodosum) receiveReliable(connId uint32, app *application, epoch, seq uint64, payload []byte) {
+	ib := n.inboxFor(deliveryKey{nodeId: n.nodeIdOf(connId), applicationId: app.id})
+
+	ib.mu.Lock()
+	if epoch != ib.epoch {
+		// The sender restarted, held back messages of its previous process will never be completed
+		ib.epoch = epoch
+		ib.delivered = 0
+		clear(ib.heldBack)
+	}
+	// Delivering while holding the lock keeps the order if frames of one sender are handled concurrently
+	switch {
+	case seq <= ib.delivered:
+	case seq == ib.delivered+1:
+		if !n.deliver(app, payload) {
+			break
+		}
+		ib.delivered = seq
+		for {
+			next, ok := ib.heldBack[ib.delivered+1]
+			if !ok || !n.deliver(app, next) {
+				break
+			}
+			delete(ib.heldBack, ib.delivered+1)
+			ib.delivered++
+		}
+	default:
+		// Overtook a missing message, the sender retransmits it if we drop this one
+		if len(ib.heldBack) < maxHeldBack {
+			ib.heldBack[seq] = payload
+		}
+	}
+	delivered := ib.delivered
+	ib.mu.Unlock()
+
+	n.sendAck(connId, app.id, delivered)
+}
+
+// retransmitLoop resends unacknowledged messages until the node shuts down.
+func (n *Nodosum) retransmitLoop() {
+	interval := n.retransmitInterval
+	if interval <= 0 {
+		interval = DEFAULT_RETRANSMIT_INTERVAL
+	}
+	ticker := n.clock.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case now := <-ticker.C():
+			n.retransmit(now, interval)
+		}
+	}
+}
+
+func (n *Nodosum) retransmit(now time.Time, interval time.Duration) {
+	n.outboxes.Range(func(k, v any) bool {
+		key := k.(deliveryKey)
+		ob := v.(*outbox)
+
+		ob.mu.Lock()
+		var due []*unackedMessage
+		for _, msg := range ob.unacked {
+			if now.Sub(msg.sent) >= interval {
+				msg.sent = now
+				due = append(due, msg)
+			}
+		}
+		ob.mu.Unlock()
+
+		if len(due) == 0 {
+			return true
+		}
+		// A full queue is not waited for, the frames are sent again by the next retransmit
+		for _, msg := range due {
+			nc, ok := n.nodeConnectionFor(key.nodeId, msg.stripeKey)
+			if !ok {
+				return true
+			}
+			for _, frame := range n.reliableFrames(ob, msg, nc.compression) {
+				if err := n.enqueue(n.ctx, nc, frame, SEND_QUEUE_DROP_NEWEST); err != nil {
+					break
+				}
+			}
+		}
+		return true
+	})
+}
+
+// Unacked returns the number of messages of an application waiting for an acknowledgement of nodeId.
+func (n *Nodosum) Unacked(nodeId string, applicationId uint32) int {
+	v, ok := n.outboxes.Load(deliveryKey{nodeId: nodeId, applicationId: applicationId})
+	if !ok {
+		return 0
+	}
+	ob := v.(*outbox)
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	return len(ob.unacked)
+}
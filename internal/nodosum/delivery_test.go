@@ -0,0 +1,241 @@
+package nodosum
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/conamu/go-worker"
+)
+
+func receiveInto(app *application) chan any {
+	ch := make(chan any, 256)
+	app.receiveWorker = &worker.Worker{InputChan: ch}
+	return ch
+}
+
+func waitUnacked(t *testing.T, n *Nodosum, nodeId string, applicationId uint32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for n.Unacked(nodeId, applicationId) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still unacknowledged", n.Unacked(nodeId, applicationId))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReliableDeliveryInOrder(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appA.EnableReliableDelivery()
+	received := receiveInto(appB)
+
+	for i := range 100 {
+		if err := appA.Send([]byte(fmt.Sprint(i)), []string{"b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 100 {
+		select {
+		case p := <-received:
+			if string(p.([]byte)) != fmt.Sprint(i) {
+				t.Fatalf("expected message %d, got %s", i, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d not delivered", i)
+		}
+	}
+	waitUnacked(t, appA.nodosum, "b", appA.id)
+}
+
+func TestReliableDeliveryRetransmitsAfterDrop(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appA.EnableReliableDelivery()
+	received := receiveInto(appB)
+
+	// The outbox of a node is created while it is connected
+	if err := appA.Send([]byte("first"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-received; string(p.([]byte)) != "first" {
+		t.Fatalf("unexpected message %s", p)
+	}
+	waitUnacked(t, appA.nodosum, "b", appA.id)
+
+	// Without a connection the message stays in the outbox
+	nc, _ := appA.nodosum.connections.LoadAndDelete(uint32(1))
+	if err := appA.Send([]byte("hello"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for appA.nodosum.Unacked("b", appA.id) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not tracked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	appA.nodosum.connections.Store(uint32(1), nc)
+	appA.nodosum.retransmit(time.Now().Add(time.Hour), time.Second)
+
+	select {
+	case p := <-received:
+		if string(p.([]byte)) != "hello" {
+			t.Fatalf("unexpected message %s", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not retransmitted")
+	}
+	waitUnacked(t, appA.nodosum, "b", appA.id)
+
+	// A second retransmit of the same message is not delivered twice
+	select {
+	case p := <-received:
+		t.Fatalf("duplicate delivery of %s", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// receivedPayloads returns the payloads queued for an application since the last call.
+func receivedPayloads(received chan any) []string {
+	var payloads []string
+	for len(received) > 0 {
+		payloads = append(payloads, string((<-received).([]byte)))
+	}
+	return payloads
+}
+
+func newReceiveReliableTestNodosum() *Nodosum {
+	return &Nodosum{
+		clock:              realClock{},
+		logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+		connections:        &sync.Map{},
+		violations:         &sync.Map{},
+		remoteApplications: &sync.Map{},
+		inboxes:            &sync.Map{},
+	}
+}
+
+func TestReceiveReliableOrdersAndDedupes(t *testing.T) {
+	n := newReceiveReliableTestNodosum()
+	app := &application{id: 1}
+	received := receiveInto(app)
+
+	if n.receiveReliable(1, app, 7, 2, []byte("b")); len(received) != 0 {
+		t.Fatalf("message overtaking a missing one was delivered: %q", receivedPayloads(received))
+	}
+	n.receiveReliable(1, app, 7, 1, []byte("a"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("expected a and b in order, got %q", got)
+	}
+	if n.receiveReliable(1, app, 7, 1, []byte("a")); len(received) != 0 {
+		t.Fatalf("duplicate was delivered: %q", receivedPayloads(received))
+	}
+	n.receiveReliable(1, app, 7, 3, []byte("c"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"c"}) {
+		t.Fatalf("expected c, got %q", got)
+	}
+}
+
+func TestReceiveReliableResetsOnNewEpoch(t *testing.T) {
+	n := newReceiveReliableTestNodosum()
+	app := &application{id: 1}
+	received := receiveInto(app)
+
+	n.receiveReliable(1, app, 7, 1, []byte("a"))
+	n.receiveReliable(1, app, 7, 3, []byte("held back"))
+	receivedPayloads(received)
+
+	// The restarted sender counts from 1 again, the held back message of its previous process is gone
+	n.receiveReliable(1, app, 8, 1, []byte("b"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("expected b after the new epoch, got %q", got)
+	}
+	n.receiveReliable(1, app, 8, 2, []byte("c"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"c"}) {
+		t.Fatalf("expected c without the held back message, got %q", got)
+	}
+}
+
+func TestReceiveReliableWaitsForFullReceiveQueue(t *testing.T) {
+	n := newReceiveReliableTestNodosum()
+	app := &application{id: 1}
+	received := make(chan any, 1)
+	app.receiveWorker = &worker.Worker{InputChan: received}
+
+	n.receiveReliable(1, app, 7, 1, []byte("a"))
+	n.receiveReliable(1, app, 7, 3, []byte("c"))
+	// The queue is full, b is not delivered and not acknowledged
+	n.receiveReliable(1, app, 7, 2, []byte("b"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("expected only a, got %q", got)
+	}
+	if drops := app.ReceiveDrops(); drops != 1 {
+		t.Errorf("expected 1 drop, got %d", drops)
+	}
+
+	// The retransmit of b finds room, c is retransmitted as well while the queue is full
+	n.receiveReliable(1, app, 7, 2, []byte("b"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("expected b, got %q", got)
+	}
+	n.receiveReliable(1, app, 7, 3, []byte("c"))
+	if got := receivedPayloads(received); !slices.Equal(got, []string{"c"}) {
+		t.Fatalf("expected c after b, got %q", got)
+	}
+}
+
+func TestOutboxRenumberedForRestartedReceiver(t *testing.T) {
+	n := &Nodosum{outboxes: &sync.Map{}, connections: &sync.Map{}}
+	key := deliveryKey{nodeId: "b", applicationId: 1}
+	ob := &outbox{peerEpoch: 7, nextSeq: 12}
+	for seq := uint64(10); seq <= 12; seq++ {
+		ob.unacked = append(ob.unacked, &unackedMessage{seq: seq, pack: dataPackage{seq: seq}, compression: 0})
+	}
+	n.outboxes.Store(key, ob)
+
+	// An acknowledgement of the previous process arriving late must not drop the renumbered messages
+	n.resetOutboxes("b", 8)
+	n.connections.Store(uint32(1), &nodeConn{connId: 1, nodeId: "b"})
+	n.handleAck(1, &frameHeader{ApplicationID: 1, Extensions: []frameExtension{{Type: EXT_ACK, Value: encodeSequence(7, 12)}}})
+
+	if len(ob.unacked) != 3 || ob.nextSeq != 3 {
+		t.Fatalf("expected 3 messages numbered up to 3, got %d up to %d", len(ob.unacked), ob.nextSeq)
+	}
+	for i, msg := range ob.unacked {
+		if msg.seq != uint64(i+1) || msg.pack.seq != msg.seq || msg.compression != -1 {
+			t.Errorf("message %d was not renumbered: %+v", i, msg)
+		}
+	}
+
+	n.handleAck(1, &frameHeader{ApplicationID: 1, Extensions: []frameExtension{{Type: EXT_ACK, Value: encodeSequence(8, 2)}}})
+	if len(ob.unacked) != 1 {
+		t.Fatalf("expected the acknowledgement of the new process to drop 2 messages, %d left", len(ob.unacked))
+	}
+}
+
+func TestReliableSendBounded(t *testing.T) {
+	appA, _ := newStreamTestPair(t)
+	appA.EnableReliableDelivery()
+
+	if err := appA.Send([]byte("hello"), []string{"c"}); !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("expected ErrNodeUnreachable for a node that was never connected, got %v", err)
+	}
+
+	appA.nodosum.connections.Delete(uint32(1))
+	appA.nodosum.outboxes.Store(deliveryKey{nodeId: "b", applicationId: appA.id}, &outbox{})
+	for range maxUnacked {
+		if err := appA.Send([]byte("hello"), []string{"b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := appA.Send([]byte("hello"), []string{"b"}); !errors.Is(err, ErrOutboxFull) {
+		t.Fatalf("expected ErrOutboxFull, got %v", err)
+	}
+}
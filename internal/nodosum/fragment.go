@@ -0,0 +1,611 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+Fragmentation of large payloads.
+
+Payloads bigger than the fragment size are split into fragments, each sent as its own frame
+with the FRAGMENTED flag and an EXT_FRAGMENT extension. Frames of other applications are interleaved
+between the fragments, so one big message does not block everything else on the connection.
+Every fragment is compressed on its own, the receiver decompresses before reassembling.
+Fragments may be handled out of order by the inbound multiplexer workers,
+so the receiver buffers them until the final fragment and all fragments before it arrived.
+Duplicate fragments are ignored, a message with fragments past its final one is dropped.
+A connection may have at most maxPartialMessages messages waiting for fragments, holding no more than
+partialBufferFactor times the maximum message size together. A peer going beyond that could only
+be trying to exhaust the memory of the receiver, it is disconnected as a protocol violation.
+
+Blobs use the same mechanism for payloads too big to be kept in memory.
+A blob writer sends every chunk as soon as it is full, the receiver hands the chunks in order
+to the io.Reader passed to the blob receive function of the application.
+Blobs have no flow control: chunks the receive function did not read yet are buffered up to the maximum
+message size, beyond that the blob is aborted with errBlobOverflow instead of stalling the connection.
+Streams are the way to go for slow consumers.
+
+Fragment extension value (13 bytes):
+	uint64 id | uint32 index | uint8 flags (FRAGMENT_FINAL, FRAGMENT_BLOB)
+*/
+
+const (
+	FRAGMENT_FINAL uint8 = 1 << iota
+	FRAGMENT_BLOB
+)
+
+const (
+	// DEFAULT_FRAGMENT_SIZE is the fragment and blob chunk size used if no fragment size is configured
+	DEFAULT_FRAGMENT_SIZE = 64 * 1024
+	// DEFAULT_MAX_MESSAGE_SIZE caps reassembled and decompressed messages if no maximum message size is configured
+	DEFAULT_MAX_MESSAGE_SIZE = 64 * 1024 * 1024
+)
+
+const (
+	fragmentInfoSize = 13
+	// fragmentTimeout is how long a partial message or blob may go without new fragments
+	fragmentTimeout = 30 * time.Second
+	// maxPartialMessages limits the partial messages buffered per connection
+	maxPartialMessages = 256
+	// partialBufferFactor times the maximum message size limits the bytes of partial messages buffered per connection
+	partialBufferFactor = 4
+)
+
+var (
+	errFragmentTimeout     = errors.New("timed out waiting for fragments")
+	errMessageTooLarge     = errors.New("reassembled message exceeds maximum message size")
+	errBlobWriterClosed    = errors.New("blob writer closed")
+	errInvalidFragmentInfo = errors.New("invalid fragment extension")
+	errInvalidFragment     = errors.New("invalid fragment")
+	errBlobOverflow        = errors.New("blob receiver fell too far behind")
+	errReassemblyLimit     = errors.New("too many partial messages buffered for connection")
+)
+
+type fragmentInfo struct {
+	id    uint64
+	index uint32
+	flags uint8
+}
+
+func encodeFragmentInfo(fi *fragmentInfo) []byte {
+	buf := make([]byte, fragmentInfoSize)
+	binary.LittleEndian.PutUint64(buf[0:8], fi.id)
+	binary.LittleEndian.PutUint32(buf[8:12], fi.index)
+	buf[12] = fi.flags
+	return buf
+}
+
+func decodeFragmentInfo(b []byte) (*fragmentInfo, error) {
+	if len(b) != fragmentInfoSize {
+		return nil, errInvalidFragmentInfo
+	}
+	return &fragmentInfo{
+		id:    binary.LittleEndian.Uint64(b[0:8]),
+		index: binary.LittleEndian.Uint32(b[8:12]),
+		flags: b[12],
+	}, nil
+}
+
+// encodeFrames turns a dataPackage into one or more frames, fragmenting payloads bigger than the fragment size.
+// Payloads are compressed with algorithm, the one negotiated with the receiving node.
+func (n *Nodosum) encodeFrames(dataPack *dataPackage, algorithm int) [][]byte {
+	chunks, infos := n.chunkPayload(dataPack)
+	frames := make([][]byte, 0, len(chunks))
+	for i, chunk := range chunks {
+		frames = append(frames, n.encodeFrame(dataPack, chunk, infos[i], algorithm))
+	}
+	return frames
+}
+
+// chunkPayload splits the payload of a dataPackage into the chunks sent in one frame each, with their fragment info.
+func (n *Nodosum) chunkPayload(dataPack *dataPackage) ([][]byte, []*fragmentInfo) {
+	// Blob chunks and stream frames are bounded by their writers and never fragmented
+	if dataPack.fragment != nil || dataPack.stream != nil {
+		return [][]byte{dataPack.payload}, []*fragmentInfo{dataPack.fragment}
+	}
+
+	if n.fragmentSize <= 0 || len(dataPack.payload) <= n.fragmentSize {
+		return [][]byte{dataPack.payload}, []*fragmentInfo{nil}
+	}
+
+	id := n.fragmentIds.Add(1)
+	chunks := slices.Collect(slices.Chunk(dataPack.payload, n.fragmentSize))
+	infos := make([]*fragmentInfo, len(chunks))
+	for i := range chunks {
+		infos[i] = &fragmentInfo{id: id, index: uint32(i)}
+		if i == len(chunks)-1 {
+			infos[i].flags |= FRAGMENT_FINAL
+		}
+	}
+	return chunks, infos
+}
+
+func (n *Nodosum) encodeFrame(dataPack *dataPackage, payload []byte, fi *fragmentInfo, algorithm int) []byte {
+	scratch := getScratch()
+	defer putScratch(scratch)
+	payload, compressed := n.maybeCompress(*scratch, payload, dataPack.uncompressed, algorithm)
+	if compressed {
+		// Keep the buffer if the compressor had to grow it
+		*scratch = payload[:0]
+	}
+	return buildFrame(dataPack, payload, compressed, fi)
+}
+
+// buildFrame encodes a frame around a payload that is already compressed if compressed is set.
+func buildFrame(dataPack *dataPackage, payload []byte, compressed bool, fi *fragmentInfo) []byte {
+	fh := frameHeader{
+		Version:       PROTOCOL_VERSION,
+		ApplicationID: dataPack.id,
+		Type:          APP,
+		Length:        uint32(len(payload)),
+	}
+	if compressed {
+		fh.Flag |= COMPRESSED
+	}
+	if fi != nil {
+		fh.Flag |= FRAGMENTED
+		fh.Extensions = append(fh.Extensions, frameExtension{Type: EXT_FRAGMENT, Value: encodeFragmentInfo(fi)})
+	}
+	if dataPack.stream != nil {
+		fh.Extensions = append(fh.Extensions, frameExtension{Type: EXT_STREAM, Value: encodeStreamControl(dataPack.stream)})
+	}
+
+	if dataPack.seq != 0 {
+		fh.Flag |= ACK_REQUESTED
+		fh.Extensions = append(fh.Extensions, frameExtension{Type: EXT_SEQUENCE, Value: encodeSequence(dataPack.epoch, dataPack.seq)})
+	}
+	fh.Extensions = append(fh.Extensions, dataPack.extensions...)
+
+	// The frame is allocated once, the compressed payload is copied out of the scratch buffer
+	headerLen := frameHeaderLen(&fh)
+	frame := make([]byte, headerLen+len(payload))
+	putFrameHeader(frame, &fh)
+	copy(frame[headerLen:], payload)
+	return frame
+}
+
+type fragmentKey struct {
+	connId        uint32
+	applicationId uint32
+	id            uint64
+}
+
+type partialMessage struct {
+	chunks map[uint32][]byte
+	size   int
+	// final is the index of the final fragment, -1 until it arrived, highest the biggest index seen
+	final   int64
+	highest int64
+	updated time.Time
+}
+
+// partialUsage is what the partial messages of a connection hold.
+type partialUsage struct {
+	messages int
+	size     int
+}
+
+type blobChunk struct {
+	index uint32
+	final bool
+	data  []byte
+}
+
+type inboundBlob struct {
+	mu sync.Mutex
+	// pending holds the chunks not written to the pipe yet by index, buffered is the size of their data
+	pending  map[uint32]blobChunk
+	buffered int
+	next     uint32
+	overflow bool
+	// ready signals the writer that chunks arrived
+	ready chan struct{}
+	// pr is read by the blob receive function, pw written with the chunks in order
+	pr *io.PipeReader
+	pw *io.PipeWriter
+}
+
+// add buffers a chunk for the writer. It reports false if that exceeds limit, the blob is aborted then.
+func (b *inboundBlob) add(c blobChunk, limit int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflow {
+		return true
+	}
+	if _, ok := b.pending[c.index]; ok || c.index < b.next {
+		return true
+	}
+	if b.buffered+len(c.data) > limit {
+		b.overflow = true
+		// Closing the pipe unblocks the writer, which then finishes the blob
+		b.pw.CloseWithError(errBlobOverflow)
+		return false
+	}
+	b.pending[c.index] = c
+	b.buffered += len(c.data)
+	return true
+}
+
+// take removes the next chunk in order, if it arrived. It reports false once the blob overflowed.
+func (b *inboundBlob) take() (blobChunk, bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflow {
+		return blobChunk{}, false, false
+	}
+	c, ok := b.pending[b.next]
+	if ok {
+		delete(b.pending, b.next)
+		b.next++
+	}
+	return c, ok, true
+}
+
+// written releases the buffer of a chunk written to the pipe.
+func (b *inboundBlob) written(c blobChunk) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buffered -= len(c.data)
+}
+
+type reassembler struct {
+	mu             sync.Mutex
+	maxMessageSize int
+	messages       map[fragmentKey]*partialMessage
+	// usage holds the partial messages and bytes buffered per connection
+	usage map[uint32]*partialUsage
+	blobs map[fragmentKey]*inboundBlob
+	// finished remembers dropped or completed blobs and messages so late fragments do not start a new one
+	finished map[fragmentKey]time.Time
+	pruned   time.Time
+	clock    Clock
+}
+
+func newReassembler(maxMessageSize int, clock Clock) *reassembler {
+	return &reassembler{
+		maxMessageSize: maxMessageSize,
+		messages:       make(map[fragmentKey]*partialMessage),
+		usage:          make(map[uint32]*partialUsage),
+		blobs:          make(map[fragmentKey]*inboundBlob),
+		finished:       make(map[fragmentKey]time.Time),
+		clock:          clock,
+	}
+}
+
+// addFragment buffers a fragment of a message and returns the complete payload once all fragments arrived.
+func (r *reassembler) addFragment(key fragmentKey, fi *fragmentInfo, payload []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	r.prune(now)
+
+	if _, ok := r.finished[key]; ok {
+		return nil, nil
+	}
+
+	usage, ok := r.usage[key.connId]
+	if !ok {
+		usage = &partialUsage{}
+		r.usage[key.connId] = usage
+	}
+	pm, ok := r.messages[key]
+	if !ok {
+		if usage.messages >= maxPartialMessages {
+			r.dropConn(key.connId, now)
+			return nil, fmt.Errorf("%w: %d messages", errReassemblyLimit, maxPartialMessages)
+		}
+		pm = &partialMessage{chunks: make(map[uint32][]byte), final: -1, highest: -1}
+		r.messages[key] = pm
+		usage.messages++
+	}
+	if _, ok := pm.chunks[fi.index]; ok {
+		return nil, nil
+	}
+
+	final := fi.flags&FRAGMENT_FINAL != 0
+	index := int64(fi.index)
+	// Senders never send empty fragments, which would grow the message without counting against its size
+	invalid := len(payload) == 0 ||
+		(pm.final >= 0 && (final || index > pm.final)) ||
+		(final && index < pm.highest)
+	if invalid {
+		r.dropMessage(key, pm)
+		r.finished[key] = now
+		return nil, fmt.Errorf("%w: index %d, final %d", errInvalidFragment, fi.index, pm.final)
+	}
+
+	pm.size += len(payload)
+	usage.size += len(payload)
+	pm.chunks[fi.index] = payload
+	pm.highest = max(pm.highest, index)
+	pm.updated = now
+	if final {
+		pm.final = index
+	}
+
+	if pm.size > r.maxMessageSize {
+		r.dropMessage(key, pm)
+		r.finished[key] = now
+		return nil, errMessageTooLarge
+	}
+	if usage.size > partialBufferFactor*r.maxMessageSize {
+		r.dropConn(key.connId, now)
+		return nil, fmt.Errorf("%w: %d bytes", errReassemblyLimit, usage.size)
+	}
+
+	if pm.final < 0 || int64(len(pm.chunks)) != pm.final+1 {
+		return nil, nil
+	}
+
+	r.dropMessage(key, pm)
+	r.finished[key] = now
+
+	message := make([]byte, 0, pm.size)
+	for i := range uint32(pm.final + 1) {
+		message = append(message, pm.chunks[i]...)
+	}
+	return message, nil
+}
+
+// blob returns the blob for key, the second return value reports whether it was just created.
+// A nil blob means the blob already finished and the chunk is to be dropped.
+func (r *reassembler) blob(key fragmentKey) (*inboundBlob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(r.clock.Now())
+
+	if _, ok := r.finished[key]; ok {
+		return nil, false
+	}
+	if b, ok := r.blobs[key]; ok {
+		return b, false
+	}
+
+	pr, pw := io.Pipe()
+	b := &inboundBlob{
+		pending: make(map[uint32]blobChunk),
+		ready:   make(chan struct{}, 1),
+		pr:      pr,
+		pw:      pw,
+	}
+	r.blobs[key] = b
+	return b, true
+}
+
+func (r *reassembler) finishBlob(key fragmentKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.blobs, key)
+	r.finished[key] = r.clock.Now()
+}
+
+// dropMessage removes a partial message and releases what it held from the usage of its connection.
+func (r *reassembler) dropMessage(key fragmentKey, pm *partialMessage) {
+	delete(r.messages, key)
+	usage := r.usage[key.connId]
+	usage.messages--
+	usage.size -= pm.size
+	if usage.messages == 0 {
+		delete(r.usage, key.connId)
+	}
+}
+
+// dropConn removes all partial messages of a connection, late fragments of them are ignored.
+func (r *reassembler) dropConn(connId uint32, now time.Time) {
+	for key, pm := range r.messages {
+		if key.connId == connId {
+			r.dropMessage(key, pm)
+			r.finished[key] = now
+		}
+	}
+	delete(r.usage, connId)
+}
+
+// prune drops partial messages and finished markers older than fragmentTimeout, at most once per second.
+func (r *reassembler) prune(now time.Time) {
+	if now.Sub(r.pruned) < time.Second {
+		return
+	}
+	r.pruned = now
+
+	for key, pm := range r.messages {
+		if now.Sub(pm.updated) > fragmentTimeout {
+			r.dropMessage(key, pm)
+		}
+	}
+	for key, t := range r.finished {
+		if now.Sub(t) > fragmentTimeout {
+			delete(r.finished, key)
+		}
+	}
+}
+
+// handleFragment processes an inbound fragment. It returns the reassembled payload of a message once complete.
+func (n *Nodosum) handleFragment(connId uint32, app *application, header *frameHeader, payload []byte) ([]byte, bool) {
+	value, ok := header.extension(EXT_FRAGMENT)
+	if !ok {
+		n.logger.Error("fragmented frame without fragment extension", "application", app.id, "conn", connId)
+		return nil, false
+	}
+	fi, err := decodeFragmentInfo(value)
+	if err != nil {
+		n.logger.Error("error decoding fragment extension", "error", err.Error(), "application", app.id, "conn", connId)
+		return nil, false
+	}
+
+	key := fragmentKey{connId: connId, applicationId: app.id, id: fi.id}
+
+	if fi.flags&FRAGMENT_BLOB != 0 {
+		n.handleBlobChunk(key, app, fi, payload)
+		return nil, false
+	}
+
+	message, err := n.reassembler.addFragment(key, fi, payload)
+	if errors.Is(err, errReassemblyLimit) {
+		n.protocolViolation(connId, err)
+		return nil, false
+	}
+	if err != nil {
+		n.logger.Warn("dropping fragmented message", "error", err.Error(), "application", app.id, "conn", connId)
+		return nil, false
+	}
+	return message, message != nil
+}
+
+// handleBlobChunk hands a chunk to the writer of its blob without blocking the inbound multiplexer.
+func (n *Nodosum) handleBlobChunk(key fragmentKey, app *application, fi *fragmentInfo, payload []byte) {
+	b, created := n.reassembler.blob(key)
+	if b == nil {
+		return
+	}
+
+	if created {
+		receiveFunc := app.blobReceiveFunc.Load()
+		if receiveFunc == nil || *receiveFunc == nil {
+			n.logger.Warn("dropping blob, application has no blob receive function", "application", app.id, "conn", key.connId)
+			n.reassembler.finishBlob(key)
+			b.pw.Close()
+			return
+		}
+
+		n.wg.Go(func() {
+			n.writeBlob(key, b)
+		})
+		n.wg.Go(func() {
+			err := (*receiveFunc)(b.pr)
+			if err != nil {
+				n.logger.Error("error in blob receive function", "error", err.Error(), "application", app.id)
+			}
+			b.pr.Close()
+		})
+	}
+
+	c := blobChunk{index: fi.index, final: fi.flags&FRAGMENT_FINAL != 0, data: payload}
+	if !b.add(c, n.reassembler.maxMessageSize) {
+		n.logger.Warn("dropping blob", "error", errBlobOverflow.Error(), "application", app.id, "conn", key.connId)
+	}
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// writeBlob writes the chunks of a blob in order to the pipe read by the blob receive function.
+func (n *Nodosum) writeBlob(key fragmentKey, b *inboundBlob) {
+	defer n.reassembler.finishBlob(key)
+
+	timeout := n.clock.NewTimer(fragmentTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			b.pw.CloseWithError(n.ctx.Err())
+			return
+		case <-timeout.C():
+			n.logger.Warn("dropping blob", "error", errFragmentTimeout.Error(), "application", key.applicationId, "conn", key.connId)
+			b.pw.CloseWithError(errFragmentTimeout)
+			return
+		case <-b.ready:
+			timeout.Reset(fragmentTimeout)
+			for {
+				c, ok, open := b.take()
+				if !open {
+					return
+				}
+				if !ok {
+					break
+				}
+
+				_, err := b.pw.Write(c.data)
+				b.written(c)
+				if err != nil {
+					// The receiver stopped reading or the blob overflowed, remaining chunks are dropped
+					return
+				}
+				if c.final {
+					b.pw.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// blobWriter sends everything written to it as chunks of a blob.
+type blobWriter struct {
+	ctx    context.Context
+	app    *application
+	ids    []string
+	id     uint64
+	index  uint32
+	size   int
+	buf    []byte
+	closed bool
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errBlobWriterClosed
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		take := min(w.size-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+
+		if len(w.buf) == w.size {
+			err := w.send(false)
+			if err != nil {
+				return written - len(p), err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close sends the final chunk, the blob is only complete on the receiver after Close.
+func (w *blobWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.send(true)
+}
+
+func (w *blobWriter) send(final bool) error {
+	fi := &fragmentInfo{id: w.id, index: w.index, flags: FRAGMENT_BLOB}
+	if final {
+		fi.flags |= FRAGMENT_FINAL
+	}
+
+	dataPack := &dataPackage{
+		id:             w.app.id,
+		payload:        w.buf,
+		receivingNodes: w.ids,
+		uncompressed:   w.app.uncompressed.Load(),
+		fragment:       fi,
+	}
+
+	err := w.app.nodosum.send(w.ctx, dataPack)
+	if err != nil {
+		return err
+	}
+
+	w.index++
+	w.buf = make([]byte, 0, w.size)
+	return nil
+}
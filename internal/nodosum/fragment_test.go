@@ -0,0 +1,287 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newFragmentTestNodosum(t *testing.T) *Nodosum {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	n := &Nodosum{
+		clock:              realClock{},
+		ctx:                ctx,
+		wg:                 wg,
+		logger:             slog.Default(),
+		fragmentSize:       1024,
+		reassembler:        newReassembler(1024*1024, realClock{}),
+		connections:        &sync.Map{},
+		violations:         &sync.Map{},
+		remoteApplications: &sync.Map{},
+	}
+	n.connections.Store(uint32(1), &nodeConn{connId: 1, nodeId: "node", ctx: ctx, queue: newSendQueue(1024, nil)})
+	return n
+}
+
+// receiveFrame runs a frame through the fragment handling of the inbound multiplexer.
+func receiveFrame(t *testing.T, n *Nodosum, app *application, frame []byte) ([]byte, bool) {
+	header, payload, err := decodeFrame(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Flag&FRAGMENTED == 0 {
+		return payload, true
+	}
+	return n.handleFragment(1, app, header, payload)
+}
+
+func TestFragmentedMessageReassembly(t *testing.T) {
+	n := newFragmentTestNodosum(t)
+	app := &application{id: 7, nodosum: n}
+
+	payload := make([]byte, 10*1024+100)
+	rand.Read(payload)
+
+	frames := n.encodeFrames(&dataPackage{id: app.id, payload: payload}, COMPRESSION_NONE)
+	if len(frames) != 11 {
+		t.Fatalf("Expected 11 fragments, got %d", len(frames))
+	}
+	mathrand.Shuffle(len(frames), func(i, j int) {
+		frames[i], frames[j] = frames[j], frames[i]
+	})
+
+	var message []byte
+	for i, frame := range frames {
+		out, ok := receiveFrame(t, n, app, frame)
+		if ok {
+			if i != len(frames)-1 {
+				t.Fatalf("Expected message to be complete after the last fragment, got it after %d", i)
+			}
+			message = out
+		}
+	}
+
+	if !bytes.Equal(message, payload) {
+		t.Error("Reassembled message does not match payload")
+	}
+}
+
+func TestFragmentedMessageTooLarge(t *testing.T) {
+	n := newFragmentTestNodosum(t)
+	n.reassembler = newReassembler(2048, realClock{})
+	app := &application{id: 7, nodosum: n}
+
+	for _, frame := range n.encodeFrames(&dataPackage{id: app.id, payload: make([]byte, 4096)}, COMPRESSION_NONE) {
+		if _, ok := receiveFrame(t, n, app, frame); ok {
+			t.Fatal("Expected message above maximum size to be dropped")
+		}
+	}
+}
+
+func TestFragmentIndexes(t *testing.T) {
+	r := newReassembler(1024, realClock{})
+	key := fragmentKey{connId: 1, applicationId: 7, id: 1}
+
+	// A duplicate does not count twice towards completing the message
+	r.addFragment(key, &fragmentInfo{id: 1, index: 0}, []byte("a"))
+	r.addFragment(key, &fragmentInfo{id: 1, index: 0}, []byte("x"))
+	message, err := r.addFragment(key, &fragmentInfo{id: 1, index: 2, flags: FRAGMENT_FINAL}, []byte("c"))
+	if err != nil || message != nil {
+		t.Fatalf("Expected message to wait for fragment 1, got %q, %v", message, err)
+	}
+	message, err = r.addFragment(key, &fragmentInfo{id: 1, index: 1}, []byte("b"))
+	if err != nil || string(message) != "abc" {
+		t.Fatalf("Expected abc, got %q, %v", message, err)
+	}
+
+	invalid := map[string][]*fragmentInfo{
+		"past final":     {{index: 1, flags: FRAGMENT_FINAL}, {index: 2}},
+		"final too low":  {{index: 3}, {index: 1, flags: FRAGMENT_FINAL}},
+		"second final":   {{index: 1, flags: FRAGMENT_FINAL}, {index: 0, flags: FRAGMENT_FINAL}},
+		"empty fragment": {{index: 0}, {index: 1}},
+	}
+	for name, infos := range invalid {
+		key := fragmentKey{connId: 1, applicationId: 7, id: uint64(len(name))}
+		payload := []byte("x")
+		for i, fi := range infos {
+			if name == "empty fragment" && i == 1 {
+				payload = nil
+			}
+			_, err = r.addFragment(key, fi, payload)
+		}
+		if !errors.Is(err, errInvalidFragment) {
+			t.Errorf("Expected %s to be rejected, got %v", name, err)
+		}
+		if _, err := r.addFragment(key, &fragmentInfo{index: 0, flags: FRAGMENT_FINAL}, payload); err != nil {
+			t.Errorf("Expected fragments of the dropped %s message to be ignored, got %v", name, err)
+		}
+	}
+}
+
+func TestReassemblyLimits(t *testing.T) {
+	r := newReassembler(1024, realClock{})
+	other := fragmentKey{connId: 2, applicationId: 7, id: 1}
+	if _, err := r.addFragment(other, &fragmentInfo{id: 1, index: 0}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Too many partial messages
+	var err error
+	for i := range maxPartialMessages + 1 {
+		_, err = r.addFragment(fragmentKey{connId: 1, applicationId: 7, id: uint64(i)}, &fragmentInfo{id: uint64(i), index: 0}, []byte("x"))
+		if i < maxPartialMessages && err != nil {
+			t.Fatalf("Expected message %d to be buffered, got %v", i, err)
+		}
+	}
+	if !errors.Is(err, errReassemblyLimit) {
+		t.Fatalf("Expected too many partial messages to be rejected, got %v", err)
+	}
+	if len(r.messages) != 1 || r.usage[1] != nil {
+		t.Fatalf("Expected the partial messages of the connection to be dropped, %d left", len(r.messages))
+	}
+	message, err := r.addFragment(fragmentKey{connId: 1, applicationId: 7, id: 0}, &fragmentInfo{id: 0, index: 1, flags: FRAGMENT_FINAL}, []byte("y"))
+	if err != nil || message != nil {
+		t.Fatalf("Expected late fragments of a dropped message to be ignored, got %q, %v", message, err)
+	}
+
+	// Too many bytes in messages of the maximum size
+	for i := range partialBufferFactor + 1 {
+		key := fragmentKey{connId: 3, applicationId: 7, id: uint64(i)}
+		_, err = r.addFragment(key, &fragmentInfo{id: uint64(i), index: 0}, make([]byte, 1000))
+		if i < partialBufferFactor && err != nil {
+			t.Fatalf("Expected message %d to be buffered, got %v", i, err)
+		}
+	}
+	if !errors.Is(err, errReassemblyLimit) {
+		t.Fatalf("Expected too many buffered bytes to be rejected, got %v", err)
+	}
+
+	message, err = r.addFragment(other, &fragmentInfo{id: 1, index: 1, flags: FRAGMENT_FINAL}, []byte("y"))
+	if err != nil || string(message) != "xy" {
+		t.Fatalf("Expected other connections to be unaffected, got %q, %v", message, err)
+	}
+	if len(r.messages) != 0 || len(r.usage) != 0 {
+		t.Fatalf("Expected nothing buffered, got %d messages and usage of %d connections", len(r.messages), len(r.usage))
+	}
+}
+
+func TestPartialMessagesPrunedByClock(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	r := newReassembler(1024, clock)
+	key := fragmentKey{connId: 1, applicationId: 7, id: 1}
+
+	if _, err := r.addFragment(key, &fragmentInfo{id: 1, index: 0}, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(fragmentTimeout + time.Second)
+	if _, err := r.addFragment(fragmentKey{connId: 1, applicationId: 7, id: 2}, &fragmentInfo{id: 2, index: 0}, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.messages[key]; ok {
+		t.Fatal("Expected the partial message to be pruned once the clock passed the fragment timeout")
+	}
+	if usage := r.usage[1]; usage == nil || usage.messages != 1 || usage.size != 1 {
+		t.Fatalf("Expected only the new message to be buffered, got %+v", usage)
+	}
+}
+
+func TestBlobOverflow(t *testing.T) {
+	n := newFragmentTestNodosum(t)
+	n.reassembler = newReassembler(4096, realClock{})
+	app := &application{id: 7, nodosum: n}
+
+	release := make(chan struct{})
+	result := make(chan error, 1)
+	app.SetBlobReceiveFunc(func(r io.Reader) error {
+		<-release
+		_, err := io.Copy(io.Discard, r)
+		result <- err
+		return nil
+	})
+
+	// The receiver does not read, chunks beyond the maximum message size must not block the multiplexer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		header := &frameHeader{Flag: FRAGMENTED}
+		for i := range 8 {
+			fi := &fragmentInfo{id: 1, index: uint32(i), flags: FRAGMENT_BLOB}
+			header.Extensions = []frameExtension{{Type: EXT_FRAGMENT, Value: encodeFragmentInfo(fi)}}
+			n.handleFragment(1, app, header, make([]byte, 1024))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected chunks of a blob falling behind to not block")
+	}
+
+	close(release)
+	select {
+	case err := <-result:
+		if !errors.Is(err, errBlobOverflow) {
+			t.Errorf("Expected the blob to be aborted with %v, got %v", errBlobOverflow, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the blob receiver")
+	}
+}
+
+func TestBlobStreaming(t *testing.T) {
+	n := newFragmentTestNodosum(t)
+	app := &application{id: 7, nodosum: n}
+
+	received := make(chan []byte, 1)
+	app.SetBlobReceiveFunc(func(r io.Reader) error {
+		data, err := io.ReadAll(r)
+		received <- data
+		return err
+	})
+
+	blob := make([]byte, 100*1024+1)
+	rand.Read(blob)
+
+	w := app.NewBlobWriter(context.Background(), []string{"node"})
+	if _, err := io.Copy(w, bytes.NewReader(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, _ := n.nodeConnection("node")
+	var frames [][]byte
+	for frame, ok := nc.queue.pop(); ok; frame, ok = nc.queue.pop() {
+		frames = append(frames, frame)
+	}
+	mathrand.Shuffle(len(frames), func(i, j int) {
+		frames[i], frames[j] = frames[j], frames[i]
+	})
+	for _, frame := range frames {
+		if _, ok := receiveFrame(t, n, app, frame); ok {
+			t.Fatal("Expected blob chunks to not be delivered as messages")
+		}
+	}
+
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, blob) {
+			t.Errorf("Received blob of %d bytes does not match sent blob of %d bytes", len(data), len(blob))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for blob")
+	}
+}
@@ -0,0 +1,458 @@
+package nodosum
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+/*
+Connection handshake
+
+Before any frame is exchanged, both ends of a new connection prove that they know a shared secret
+and tell each other their node IDs. The dialing node goes first:
+
+	dialer -> HELLO nonce, stripe, max frame size, node ID
+	dialer <- HELLO nonce, stripe, max frame size, node ID
+	dialer -> AUTH  HMAC-SHA256(primary secret, nonce of the peer | own node ID)
+	dialer <- AUTH  HMAC-SHA256(matched secret, nonce of the peer | own node ID)
+
+The AUTH of the peer is verified against all secrets of the keyring. The dialed node answers with the secret
+the dialer used, so during a rotation nodes still on the previous secret can connect to rotated ones.
+Handshake messages are SYSTEM frames with an EXT_HANDSHAKE extension naming the message.
+
+The stripe is the index of the connection among all connections the dialer keeps to the peer,
+the dialed node echoes it. Both ends use the smaller of both maximum frame sizes for the connection.
+Only one connection per pair of nodes and stripe is kept. If both dialed
+each other at the same time, the connection dialed by the node with the lower ID wins and the other one is closed.
+
+Handshake extension value (1 byte):
+	uint8 message (HANDSHAKE_HELLO, HANDSHAKE_AUTH)
+
+HELLO frames also carry an EXT_COMPRESSION extension with the algorithms the node can decompress,
+every connection compresses with the configured algorithm only if the peer announced it,
+and an EXT_EPOCH extension with the uint64 epoch of the process used by reliable delivery.
+
+HELLO payload (21 bytes + node ID):
+	[16]byte nonce
+	uint8    stripe
+	uint32   max frame size
+	[]byte   node ID
+*/
+
+const (
+	HANDSHAKE_HELLO uint8 = iota + 1
+	HANDSHAKE_AUTH
+)
+
+const (
+	handshakeNonceSize = 16
+	// helloSize is the size of the HELLO payload without the node ID
+	helloSize = handshakeNonceSize + 5
+	// maxHandshakeFrame limits what is read from a connection before it is authenticated
+	maxHandshakeFrame         = 1024
+	DEFAULT_HANDSHAKE_TIMEOUT = 2 * time.Second
+	// DEFAULT_RECONNECT_INTERVAL is how often connections to peers added with AddPeer are checked and redialed
+	DEFAULT_RECONNECT_INTERVAL = time.Second
+)
+
+var (
+	errHandshakeFailed = errors.New("handshake failed")
+	errDuplicateConn   = errors.New("already connected to node")
+	errSelfConnect     = errors.New("connected to itself")
+	errInvalidStripe   = errors.New("invalid stripe")
+)
+
+// hello is what a node tells about itself in the HELLO message.
+type hello struct {
+	nonce        []byte
+	stripe       uint8
+	maxFrameSize uint32
+	nodeId       string
+	// compression is the bitset of algorithms the node can decompress, sent as EXT_COMPRESSION
+	compression uint8
+	// epoch identifies the process of the node, sent as EXT_EPOCH, 0 if not announced
+	epoch uint64
+}
+
+func encodeHello(h *hello) []byte {
+	buf := make([]byte, helloSize, helloSize+len(h.nodeId))
+	copy(buf, h.nonce)
+	buf[handshakeNonceSize] = h.stripe
+	binary.LittleEndian.PutUint32(buf[handshakeNonceSize+1:helloSize], h.maxFrameSize)
+	return append(buf, h.nodeId...)
+}
+
+func decodeHello(payload []byte) (*hello, error) {
+	if len(payload) <= helloSize {
+		return nil, fmt.Errorf("%w: invalid hello", errHandshakeFailed)
+	}
+	return &hello{
+		nonce:        payload[:handshakeNonceSize],
+		stripe:       payload[handshakeNonceSize],
+		maxFrameSize: binary.LittleEndian.Uint32(payload[handshakeNonceSize+1 : helloSize]),
+		nodeId:       string(payload[helloSize:]),
+	}, nil
+}
+
+func handshakeFrame(message uint8, payload []byte, extensions ...frameExtension) []byte {
+	fh := frameHeader{
+		Version:    PROTOCOL_VERSION,
+		Type:       SYSTEM,
+		Length:     uint32(len(payload)),
+		Extensions: append([]frameExtension{{Type: EXT_HANDSHAKE, Value: []byte{message}}}, extensions...),
+	}
+	return append(encodeFrameHeader(&fh), payload...)
+}
+
+func helloFrame(h *hello) []byte {
+	return handshakeFrame(HANDSHAKE_HELLO, encodeHello(h),
+		frameExtension{Type: EXT_COMPRESSION, Value: []byte{h.compression}},
+		frameExtension{Type: EXT_EPOCH, Value: binary.LittleEndian.AppendUint64(nil, h.epoch)},
+	)
+}
+
+// readHello reads the HELLO of the peer. Without EXT_COMPRESSION, the peer can decompress every algorithm.
+func readHello(conn net.Conn) (*hello, error) {
+	fh, payload, err := readHandshakeFrame(conn, HANDSHAKE_HELLO)
+	if err != nil {
+		return nil, err
+	}
+	h, err := decodeHello(payload)
+	if err != nil {
+		return nil, err
+	}
+	h.compression = compressionSupported
+	if value, ok := fh.extension(EXT_COMPRESSION); ok {
+		if len(value) != 1 {
+			return nil, fmt.Errorf("%w: invalid compression extension", errHandshakeFailed)
+		}
+		h.compression = value[0]
+	}
+	if value, ok := fh.extension(EXT_EPOCH); ok {
+		if len(value) != 8 {
+			return nil, fmt.Errorf("%w: invalid epoch extension", errHandshakeFailed)
+		}
+		h.epoch = binary.LittleEndian.Uint64(value)
+	}
+	return h, nil
+}
+
+// readHandshakeFrame reads a single frame of at most maxHandshakeFrame bytes and returns it if it is the given message.
+func readHandshakeFrame(conn net.Conn, message uint8) (*frameHeader, []byte, error) {
+	header := make([]byte, frameHeaderSize+extensionAreaHeaderSize)
+	if _, err := io.ReadFull(conn, header[:frameHeaderSize]); err != nil {
+		return nil, nil, err
+	}
+	if err := checkFrameHeader(header[:frameHeaderSize]); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errHandshakeFailed, err)
+	}
+	if headerFlags(header)&EXTENDED == 0 {
+		return nil, nil, fmt.Errorf("%w: missing handshake extension", errHandshakeFailed)
+	}
+	if _, err := io.ReadFull(conn, header[frameHeaderSize:]); err != nil {
+		return nil, nil, err
+	}
+
+	length := frameHeaderSize + extensionAreaHeaderSize +
+		int(binary.LittleEndian.Uint16(header[frameHeaderSize:])) + int(binary.LittleEndian.Uint32(header[7:11]))
+	if length > maxHandshakeFrame {
+		return nil, nil, fmt.Errorf("%w: frame of %d bytes", errHandshakeFailed, length)
+	}
+	frame := make([]byte, length)
+	copy(frame, header)
+	if _, err := io.ReadFull(conn, frame[len(header):]); err != nil {
+		return nil, nil, err
+	}
+
+	fh, payload, err := decodeFrame(frame)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, ok := fh.extension(EXT_HANDSHAKE)
+	if fh.Type != SYSTEM || !ok || len(value) != 1 || value[0] != message {
+		return nil, nil, fmt.Errorf("%w: unexpected frame", errHandshakeFailed)
+	}
+	return fh, payload, nil
+}
+
+func handshakeMac(secret string, nonce []byte, nodeId string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	mac.Write([]byte(nodeId))
+	return mac.Sum(nil)
+}
+
+// handshake authenticates a new connection and returns the HELLO of the node on the other end.
+// The dialer sends stripe, the other end returns the one it received.
+func (n *Nodosum) handshake(conn net.Conn, dialer bool, stripe uint8) (*hello, error) {
+	err := conn.SetDeadline(time.Now().Add(n.handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	own := &hello{
+		nonce:        make([]byte, handshakeNonceSize),
+		stripe:       stripe,
+		maxFrameSize: uint32(n.maxFrameSize),
+		nodeId:       n.nodeId,
+		compression:  compressionSupported,
+		epoch:        n.epoch,
+	}
+	if _, err := rand.Read(own.nonce); err != nil {
+		return nil, err
+	}
+
+	var peer *hello
+	if dialer {
+		if _, err = conn.Write(helloFrame(own)); err == nil {
+			peer, err = readHello(conn)
+		}
+	} else {
+		if peer, err = readHello(conn); err == nil {
+			own.stripe = peer.stripe
+			_, err = conn.Write(helloFrame(own))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if peer.stripe != own.stripe || peer.stripe >= MAX_CONNECTIONS_PER_PEER {
+		return nil, fmt.Errorf("%w: %w %d", errHandshakeFailed, errInvalidStripe, peer.stripe)
+	}
+	if peer.maxFrameSize < maxHandshakeFrame {
+		return nil, fmt.Errorf("%w: maximum frame size of %d bytes", errHandshakeFailed, peer.maxFrameSize)
+	}
+	if peer.nodeId == n.nodeId {
+		return nil, errSelfConnect
+	}
+
+	// The dialer proves its primary secret, the other end answers with whichever secret matched
+	// so a node that was not rotated yet can still connect to one that was.
+	if dialer {
+		auth := handshakeFrame(HANDSHAKE_AUTH, handshakeMac(n.keyring.primarySecret(), peer.nonce, n.nodeId))
+		if _, err = conn.Write(auth); err != nil {
+			return nil, err
+		}
+	}
+	_, peerAuth, err := readHandshakeFrame(conn, HANDSHAKE_AUTH)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := n.verifyHandshakeMac(peerAuth, own.nonce, peer.nodeId)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s does not know a shared secret", errHandshakeFailed, peer.nodeId)
+	}
+	if !dialer {
+		auth := handshakeFrame(HANDSHAKE_AUTH, handshakeMac(secret, peer.nonce, n.nodeId))
+		if _, err = conn.Write(auth); err != nil {
+			return nil, err
+		}
+	}
+	return peer, nil
+}
+
+// verifyHandshakeMac returns the secret of the keyring the peer authenticated with.
+func (n *Nodosum) verifyHandshakeMac(mac, nonce []byte, peerId string) (string, bool) {
+	for _, secret := range n.keyring.active() {
+		if hmac.Equal(mac, handshakeMac(secret, nonce, peerId)) {
+			return secret, true
+		}
+	}
+	return "", false
+}
+
+// registerConn adds an authenticated connection and starts its loops.
+// Only one connection per node and stripe is kept: of two connections dialed in opposite directions
+// the one dialed by the node with the lower ID wins, a connection dialed in the same direction
+// replaces the existing one as the peer apparently lost it.
+func (n *Nodosum) registerConn(conn net.Conn, peer *hello, outbound bool) (uint32, error) {
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+
+	nodeId := peer.nodeId
+	if existing, ok := n.stripeConnection(nodeId, peer.stripe); ok {
+		dialedByLower := (outbound && n.nodeId < nodeId) || (!outbound && nodeId < n.nodeId)
+		if existing.outbound != outbound && !dialedByLower {
+			return 0, fmt.Errorf("%w: %s", errDuplicateConn, nodeId)
+		}
+		n.closeConnChannel(existing.connId)
+	}
+
+	n.resetOutboxes(nodeId, peer.epoch)
+	id := n.connIds.Add(1)
+	n.createConnChannel(id, peer, outbound, conn)
+
+	n.wg.Add(1)
+	go n.startRwLoops(id)
+	return id, nil
+}
+
+// dial connects to addr over the transport, upgrading to TLS if enabled.
+func (n *Nodosum) dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := n.transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !n.tlsEnabled {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, n.tlsConfig)
+	hsCtx, cancel := context.WithTimeout(ctx, n.handshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Connect dials the node listening on addr and returns its node ID once the connections are established.
+// With several connections per peer, the node ID is returned even if only some of them could be established.
+func (n *Nodosum) Connect(ctx context.Context, addr string) (string, error) {
+	nodeId, err := n.connectStripe(ctx, addr, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var errs []error
+	for stripe := 1; stripe < n.connectionsPerPeer; stripe++ {
+		if _, err := n.connectStripe(ctx, addr, uint8(stripe)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nodeId, errors.Join(errs...)
+}
+
+// connectStripe dials a single connection with the given stripe to the node listening on addr.
+func (n *Nodosum) connectStripe(ctx context.Context, addr string, stripe uint8) (string, error) {
+	conn, err := n.dial(ctx, addr)
+	if err != nil {
+		return "", err
+	}
+
+	peer, err := n.handshake(conn, true, stripe)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	_, err = n.registerConn(conn, peer, true)
+	if errors.Is(err, errDuplicateConn) {
+		// The peer dialed us at the same time and its connection won
+		conn.Close()
+		return peer.nodeId, nil
+	}
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	n.logger.Debug("connected to node", "node", peer.nodeId, "addr", addr, "stripe", stripe)
+	return peer.nodeId, nil
+}
+
+// AddPeer keeps a connection to the node listening on addr, redialing it whenever it is lost.
+func (n *Nodosum) AddPeer(addr string) {
+	n.peerAddrs.LoadOrStore(addr, "")
+	select {
+	case n.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// RemovePeer stops redialing addr, an established connection stays open.
+func (n *Nodosum) RemovePeer(addr string) {
+	n.peerAddrs.Delete(addr)
+}
+
+// maintainPeers dials all peers without a connection every reconnectInterval until the node shuts down.
+func (n *Nodosum) maintainPeers() {
+	ticker := n.clock.NewTicker(n.reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		// Peers are dialed in a stable order, which keeps simulations reproducible
+		var addrs []string
+		n.peerAddrs.Range(func(k, v any) bool {
+			addrs = append(addrs, k.(string))
+			return true
+		})
+		slices.Sort(addrs)
+		for _, addr := range addrs {
+			n.connectPeer(addr)
+		}
+
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C():
+		case <-n.reconnect:
+		}
+	}
+}
+
+// connectPeer dials a peer added with AddPeer unless all connections to its node are established already.
+func (n *Nodosum) connectPeer(addr string) {
+	v, ok := n.peerAddrs.Load(addr)
+	if !ok {
+		return
+	}
+	nodeId := v.(string)
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.handshakeTimeout)
+	defer cancel()
+
+	if nodeId != "" {
+		if len(n.nodeConnections(nodeId)) >= n.connectionsPerPeer {
+			return
+		}
+		// Only some stripes were lost, they are redialed on their own
+		if _, ok := n.stripeConnection(nodeId, 0); ok {
+			for stripe := 1; stripe < n.connectionsPerPeer; stripe++ {
+				if _, ok := n.stripeConnection(nodeId, uint8(stripe)); ok {
+					continue
+				}
+				if _, err := n.connectStripe(ctx, addr, uint8(stripe)); err != nil {
+					n.logger.Debug("error connecting to peer", "addr", addr, "stripe", stripe, "error", err.Error())
+				}
+			}
+			return
+		}
+	}
+
+	id, err := n.Connect(ctx, addr)
+	if errors.Is(err, errSelfConnect) {
+		// Static address lists usually contain the node itself
+		n.peerAddrs.Delete(addr)
+		return
+	}
+	if err != nil {
+		n.logger.Debug("error connecting to peer", "addr", addr, "error", err.Error())
+	}
+	if id == "" {
+		return
+	}
+	// Only remember the ID if the peer was not removed meanwhile
+	n.peerAddrs.CompareAndSwap(addr, nodeId, id)
+}
+
+// Addr returns the address other nodes connect to.
+func (n *Nodosum) Addr() string {
+	return n.listener.Addr().String()
+}
+
+// NodeId returns the ID of this node.
+func (n *Nodosum) NodeId() string {
+	return n.nodeId
+}
@@ -0,0 +1,132 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func waitForPeers(t *testing.T, n *Nodosum, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(n.Peers()) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to have %d peers, got %d", n.NodeId(), count, len(n.Peers()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandshakeWrongSecret(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	b.keyring.set("other", nil)
+
+	_, err := b.Connect(context.Background(), "a")
+	if err == nil {
+		t.Fatal("Expected handshake with a different secret to fail")
+	}
+	if len(a.Peers()) != 0 || len(b.Peers()) != 0 {
+		t.Error("Expected no connection after failed handshake")
+	}
+}
+
+func TestHandshakePreviousSecret(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	a.keyring.rotate("next")
+
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatalf("Expected handshake during rotation to succeed: %v", err)
+	}
+}
+
+func TestHandshakeRejectsGarbage(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+
+	conn, err := memory.Transport("x").Dial(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	frame := make([]byte, frameHeaderSize+extensionAreaHeaderSize)
+	frame[0] = PROTOCOL_VERSION
+	frame[6] = byte(EXTENDED)
+	frame[7], frame[8], frame[9] = 0xff, 0xff, 0xff
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected node to close the connection, got %v", err)
+	}
+	if len(a.Peers()) != 0 {
+		t.Error("Expected no peer for an oversized handshake frame")
+	}
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := a.Connect(context.Background(), "b")
+		errs <- err
+	}()
+	go func() {
+		_, err := b.Connect(context.Background(), "a")
+		errs <- err
+	}()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The connection dialed by a, the lower ID, wins on both ends
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fromA, okA := a.nodeConnection("b")
+		fromB, okB := b.nodeConnection("a")
+		if okA && okB && fromA.outbound && !fromB.outbound && len(a.Peers()) == 1 && len(b.Peers()) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected both nodes to keep only the connection dialed by a")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAddPeerReconnects(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+
+	b.AddPeer("a")
+	waitForPeers(t, a, 1)
+
+	closed, _ := a.nodeConnection("b")
+	a.closeConnChannel(closed.connId)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if nc, ok := a.nodeConnection("b"); ok && nc.connId != closed.connId {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected b to reconnect to a")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
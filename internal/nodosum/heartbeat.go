@@ -0,0 +1,163 @@
+package nodosum
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+/*
+Heartbeats and idle detection
+
+Every heartbeatInterval each connection sends a SYSTEM frame with an EXT_HEARTBEAT ping
+carrying the local send time. The peer answers with a pong echoing that time,
+so the round trip time is measured on the clock of the pinging node only.
+Being SYSTEM frames, pings and pongs overtake queued application traffic and measure the network, not the queue.
+
+Every received frame counts as a sign of life. A connection that was silent for idleTimeout
+is closed, which also ends half open TCP connections that would otherwise block the read loop forever.
+
+Heartbeat extension value (9 bytes):
+	uint8 kind (HEARTBEAT_PING, HEARTBEAT_PONG) | int64 unix nano send time of the ping
+*/
+
+const (
+	HEARTBEAT_PING uint8 = iota + 1
+	HEARTBEAT_PONG
+)
+
+const (
+	DEFAULT_HEARTBEAT_INTERVAL = time.Second
+	DEFAULT_IDLE_TIMEOUT       = 10 * time.Second
+	heartbeatSize              = 9
+)
+
+// PeerStatus describes a connection to another node.
+type PeerStatus struct {
+	NodeId  string
+	Address string
+	// RTT is the smoothed round trip time of heartbeats, 0 until the first pong arrived
+	RTT            time.Duration
+	LastSeen       time.Time
+	SendQueueDepth int
+	// Connections is the number of connections to the node, see Config.ConnectionsPerPeer
+	Connections int
+	// ProtocolViolations counts the frames of the node that broke the protocol, each one cost it a connection
+	ProtocolViolations uint64
+}
+
+func encodeHeartbeat(kind uint8, sent int64) []byte {
+	buf := make([]byte, heartbeatSize)
+	buf[0] = kind
+	binary.LittleEndian.PutUint64(buf[1:9], uint64(sent))
+	return buf
+}
+
+func decodeHeartbeat(b []byte) (uint8, int64, error) {
+	if len(b) != heartbeatSize {
+		return 0, 0, errors.New("invalid heartbeat extension")
+	}
+	return b[0], int64(binary.LittleEndian.Uint64(b[1:9])), nil
+}
+
+func heartbeatFrame(kind uint8, sent int64) []byte {
+	fh := frameHeader{
+		Version:    PROTOCOL_VERSION,
+		Type:       SYSTEM,
+		Extensions: []frameExtension{{Type: EXT_HEARTBEAT, Value: encodeHeartbeat(kind, sent)}},
+	}
+	return encodeFrameHeader(&fh)
+}
+
+// heartbeatLoop pings the peer of a connection and closes the connection once it went silent.
+func (n *Nodosum) heartbeatLoop(id uint32) {
+	defer n.wg.Done()
+
+	v, ok := n.connections.Load(id)
+	if !ok {
+		return
+	}
+	nc := v.(*nodeConn)
+
+	ticker := n.clock.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-nc.ctx.Done():
+			return
+		case now := <-ticker.C():
+			if now.Sub(time.Unix(0, nc.lastSeen.Load())) > n.idleTimeout {
+				n.logger.Warn("closing idle connection", "conn", id, "node", nc.nodeId, "remote", nc.addr)
+				n.closeConnChannel(id)
+				return
+			}
+			// A ping that does not fit into the queue is skipped, the next one follows soon enough
+			_ = n.enqueue(nc.ctx, nc, heartbeatFrame(HEARTBEAT_PING, now.UnixNano()), SEND_QUEUE_DROP_NEWEST)
+		}
+	}
+}
+
+// handleHeartbeat answers pings and measures the round trip time from pongs.
+func (n *Nodosum) handleHeartbeat(connId uint32, header *frameHeader) {
+	v, ok := n.connections.Load(connId)
+	if !ok || v == nil {
+		return
+	}
+	nc := v.(*nodeConn)
+
+	value, _ := header.extension(EXT_HEARTBEAT)
+	kind, sent, err := decodeHeartbeat(value)
+	if err != nil {
+		n.logger.Error("error decoding heartbeat", "error", err.Error(), "conn", connId)
+		return
+	}
+
+	switch kind {
+	case HEARTBEAT_PING:
+		_ = n.enqueue(nc.ctx, nc, heartbeatFrame(HEARTBEAT_PONG, sent), SEND_QUEUE_DROP_NEWEST)
+	case HEARTBEAT_PONG:
+		sample := n.clock.Now().Sub(time.Unix(0, sent))
+		if sample < 0 {
+			return
+		}
+		// Smoothed like the TCP srtt, 7/8 of the previous value and 1/8 of the sample
+		rtt := time.Duration(nc.rtt.Load())
+		if rtt == 0 {
+			rtt = sample
+		} else {
+			rtt = rtt - rtt/8 + sample/8
+		}
+		nc.rtt.Store(int64(rtt))
+	}
+}
+
+// Peers returns the status of all connected nodes. With several connections to a node,
+// the address and RTT are those of its first connection, the queue depths are added up.
+func (n *Nodosum) Peers() []PeerStatus {
+	var peers []PeerStatus
+	for _, nodeId := range n.connectedNodes() {
+		conns := n.nodeConnections(nodeId)
+		if len(conns) == 0 {
+			continue
+		}
+		status := PeerStatus{
+			NodeId:      nodeId,
+			RTT:         time.Duration(conns[0].rtt.Load()),
+			Connections: len(conns),
+
+			ProtocolViolations: n.ProtocolViolations(nodeId),
+		}
+		if conns[0].addr != nil {
+			status.Address = conns[0].addr.String()
+		}
+		for _, nc := range conns {
+			if lastSeen := time.Unix(0, nc.lastSeen.Load()); lastSeen.After(status.LastSeen) {
+				status.LastSeen = lastSeen
+			}
+			status.SendQueueDepth += nc.queue.len()
+		}
+		peers = append(peers, status)
+	}
+	return peers
+}
@@ -0,0 +1,100 @@
+package nodosum
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatMeasuresRTT(t *testing.T) {
+	appA, _ := newStreamTestPair(t)
+	a := appA.nodosum
+	nc, _ := a.nodeConnection("b")
+
+	if err := a.enqueue(context.Background(), nc, heartbeatFrame(HEARTBEAT_PING, time.Now().UnixNano()), SEND_QUEUE_BLOCK); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for nc.rtt.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pong received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	peers := a.Peers()
+	if len(peers) != 1 || peers[0].NodeId != "b" || peers[0].RTT <= 0 {
+		t.Fatalf("unexpected peer status %+v", peers)
+	}
+}
+
+// newIdleTestNodosum returns a node closing connections after 50ms without traffic, with conn registered as connection 1.
+func newIdleTestNodosum(t *testing.T, conn net.Conn) *Nodosum {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Nodosum{
+		clock:              realClock{},
+		ctx:                ctx,
+		wg:                 &sync.WaitGroup{},
+		logger:             slog.Default(),
+		connections:        &sync.Map{},
+		violations:         &sync.Map{},
+		remoteApplications: &sync.Map{},
+		admission:          newAdmission(0, 0, 0),
+		streams:            &sync.Map{},
+		rpcCalls:           &sync.Map{},
+		sendQueueSize:      16,
+		heartbeatInterval:  10 * time.Millisecond,
+		idleTimeout:        50 * time.Millisecond,
+	}
+	t.Cleanup(func() {
+		cancel()
+		n.wg.Wait()
+	})
+
+	n.createConnChannel(1, &hello{}, false, conn)
+	n.wg.Add(1)
+	go n.heartbeatLoop(1)
+	return n
+}
+
+func TestIdleConnectionClosed(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	n := newIdleTestNodosum(t, conn)
+
+	// The peer never answers, so the connection has to be closed after the idle timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := n.connections.Load(uint32(1)); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowFrameKeepsConnection(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	n := newIdleTestNodosum(t, conn)
+	n.wg.Add(1)
+	go n.readLoop(1)
+
+	// A frame trickling in for several idle timeouts is traffic, even before it is complete
+	frame := testFrame(APP, 1, 16)
+	for _, b := range frame {
+		if _, err := peer.Write([]byte{b}); err != nil {
+			t.Fatalf("connection was closed while the frame was read: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := n.connections.Load(uint32(1)); !ok {
+		t.Fatal("connection receiving a frame was closed as idle")
+	}
+}
@@ -0,0 +1,145 @@
+package nodosum
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+)
+
+/*
+The keyring holds the cluster secrets.
+
+The primary secret is used for everything this node sends.
+Previous secrets are still accepted from peers so the secret can be rotated during a rolling deploy:
+1. Rotate every node to the new secret, keeping the old one as previous.
+2. Once all nodes run with the new primary, drop the old secret.
+*/
+
+var (
+	errRetirePrimary = errors.New("the primary shared secret can not be retired, rotate to a new one first")
+	errUnknownSecret = errors.New("shared secret is not accepted by this node")
+)
+
+type keyring struct {
+	mu       sync.RWMutex
+	primary  string
+	previous []string
+}
+
+func newKeyring(primary string, previous []string) *keyring {
+	return &keyring{
+		primary:  primary,
+		previous: slices.Clone(previous),
+	}
+}
+
+func (k *keyring) primarySecret() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+// active returns the primary secret followed by all previous secrets.
+func (k *keyring) active() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]string{k.primary}, k.previous...)
+}
+
+func (k *keyring) set(primary string, previous []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.primary = primary
+	k.previous = slices.Clone(previous)
+}
+
+// rotate makes secret the primary and keeps the former primary as accepted previous secret.
+func (k *keyring) rotate(secret string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if secret == k.primary {
+		return
+	}
+	previous := []string{k.primary}
+	for _, s := range k.previous {
+		if s != secret && s != k.primary {
+			previous = append(previous, s)
+		}
+	}
+	k.primary = secret
+	k.previous = previous
+}
+
+// retire stops accepting a previous secret. The primary secret can not be retired.
+func (k *keyring) retire(secret string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(k.primary)) == 1 {
+		return errRetirePrimary
+	}
+	k.previous = slices.DeleteFunc(k.previous, func(s string) bool {
+		return s == secret
+	})
+	return nil
+}
+
+// accepts reports whether secret is one of the active secrets.
+func (k *keyring) accepts(secret string) bool {
+	ok := 0
+	for _, s := range k.active() {
+		ok |= subtle.ConstantTimeCompare([]byte(s), []byte(secret))
+	}
+	return ok == 1
+}
+
+// acceptsFingerprint reports whether fp belongs to one of the active secrets.
+func (k *keyring) acceptsFingerprint(fp uint32) bool {
+	ok := 0
+	for _, s := range k.active() {
+		ok |= subtle.ConstantTimeEq(int32(secretFingerprint(s)), int32(fp))
+	}
+	return ok == 1
+}
+
+func secretFingerprint(secret string) uint32 {
+	sum := sha256.Sum256([]byte(secret))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// SetSharedSecrets replaces all cluster secrets at runtime.
+func (n *Nodosum) SetSharedSecrets(primary string, previous []string) error {
+	if primary == "" {
+		return errors.New("primary shared secret must not be empty")
+	}
+	n.keyring.set(primary, previous)
+	n.logger.Info("shared secrets updated", "previous", len(previous))
+	return nil
+}
+
+// RotateSharedSecret makes secret the primary one while the current primary stays accepted until retired.
+func (n *Nodosum) RotateSharedSecret(secret string) error {
+	if secret == "" {
+		return errors.New("shared secret must not be empty")
+	}
+	n.keyring.rotate(secret)
+	n.logger.Info("shared secret rotated")
+	return nil
+}
+
+// RetireSharedSecret stops accepting a previous secret.
+// It fails if the secret is the primary one or not accepted at all.
+func (n *Nodosum) RetireSharedSecret(secret string) error {
+	if !n.keyring.accepts(secret) {
+		return errUnknownSecret
+	}
+	if err := n.keyring.retire(secret); err != nil {
+		return err
+	}
+	n.logger.Info("shared secret retired")
+	return nil
+}
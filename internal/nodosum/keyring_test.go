@@ -0,0 +1,38 @@
+package nodosum
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	k := newKeyring("old", nil)
+
+	k.rotate("new")
+	if k.primarySecret() != "new" {
+		t.Errorf("Expected primary secret to be new, got %s", k.primarySecret())
+	}
+	if !k.accepts("old") || !k.accepts("new") {
+		t.Error("Expected old and new secret to be accepted during rotation")
+	}
+	if !k.acceptsFingerprint(secretFingerprint("old")) {
+		t.Error("Expected fingerprint of old secret to be accepted during rotation")
+	}
+
+	if err := k.retire("old"); err != nil {
+		t.Fatal(err)
+	}
+	if k.accepts("old") {
+		t.Error("Expected retired secret to be rejected")
+	}
+	if k.acceptsFingerprint(secretFingerprint("old")) {
+		t.Error("Expected fingerprint of retired secret to be rejected")
+	}
+
+	if err := k.retire("new"); !errors.Is(err, errRetirePrimary) {
+		t.Errorf("Expected retiring the primary secret to fail, got %v", err)
+	}
+	if !k.accepts("new") {
+		t.Error("Expected primary secret to not be retired")
+	}
+}
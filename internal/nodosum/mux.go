@@ -1,6 +1,10 @@
 package nodosum
 
-import "github.com/conamu/go-worker"
+import (
+	"fmt"
+
+	"github.com/conamu/go-worker"
+)
 
 /*
 Connection Multiplexing and application traffic filtering
@@ -11,7 +15,8 @@ Instance has N channels for outgoing connection to N instances.
 read incoming packets:
 Packets/Commands have an application identifier.
 If an application is actively registered through nodosum,
-the command gets routed to its read channel.
+the command gets routed to its read channel. The channel is bounded and never waited for,
+payloads arriving while it is full are dropped and counted.
 
 */
 
@@ -22,47 +27,114 @@ func (n *Nodosum) StartMultiplexer() {
 		mpWorker.InputChan = n.globalReadChannel
 		go mpWorker.Start()
 	}
+}
 
-	for range n.muxWorkerCount {
-		mpWorker := worker.NewWorker(n.ctx, "multiplexer-outbound", n.wg, n.multiplexerTaskOutbound, n.logger, 0)
-		mpWorker.InputChan = n.globalWriteChannel
-		go mpWorker.Start()
-	}
-
+// inboundFrame is a frame read from a connection, tagged with the connection it arrived on
+type inboundFrame struct {
+	connId uint32
+	frame  []byte
 }
 
 // multiplexerTaskInbound processes all packets coming from individual connections
 func (n *Nodosum) multiplexerTaskInbound(w *worker.Worker, msg any) {
-	frame := msg.([]byte)
-	header := decodeFrameHeader(frame[0:11])
+	in := msg.(*inboundFrame)
+	header, payload, err := decodeFrame(in.frame)
+	if err != nil {
+		n.protocolViolation(in.connId, err)
+		return
+	}
+	if header.Type == SYSTEM {
+		n.handleSystemFrame(in.connId, header, payload)
+		return
+	}
 	val, ok := n.applications.Load(header.ApplicationID)
-	if ok && val != nil {
-		app := val.(application)
-		// Only send payload to application
-		app.receiveWorker.InputChan <- frame[11:]
+	if !ok || val == nil {
+		n.rejectUnknownApplication(in.connId, header)
+		return
+	}
+	app := val.(*application)
+	if !n.senderAllowed(app, in.connId) || n.applicationConflict(in.connId, app) {
+		return
+	}
+
+	// A relayed broadcast has to be allowed from its origin as well
+	var route *broadcastRoute
+	if value, isBroadcast := header.extension(EXT_BROADCAST); isBroadcast {
+		route, err = decodeBroadcastRoute(value)
+		if err != nil {
+			n.protocolViolation(in.connId, err)
+			return
+		}
+		if !n.originAllowed(app, in.connId, route.origin) {
+			return
+		}
+	}
+
+	if header.Flag&COMPRESSED != 0 {
+		payload, err = decompressPayload(payload, n.reassembler.maxMessageSize)
+		if err != nil {
+			n.protocolViolation(in.connId, fmt.Errorf("error decompressing payload of application %d: %w", header.ApplicationID, err))
+			return
+		}
+	}
+
+	if _, isStream := header.extension(EXT_STREAM); isStream {
+		n.handleStreamFrame(in.connId, app, header, payload)
+		return
 	}
-}
 
-// multiplexerTaskInbound processes all packets from applications, routing them to specified individual connections
-func (n *Nodosum) multiplexerTaskOutbound(w *worker.Worker, msg any) {
-	dataPack := msg.(*dataPackage)
+	if header.Flag&FRAGMENTED != 0 {
+		payload, ok = n.handleFragment(in.connId, app, header, payload)
+		if !ok {
+			return
+		}
+	}
 
-	fh := frameHeader{
-		Version:       0,
-		ApplicationID: dataPack.id,
-		Type:          APP,
-		Length:        uint32(len(dataPack.payload)),
+	if route != nil {
+		n.relayBroadcast(app, route, payload)
 	}
 
-	header := encodeFrameHeader(&fh)
-	frame := append(header, dataPack.payload...)
+	if _, isRpc := header.extension(EXT_RPC); isRpc {
+		n.handleRpcFrame(in.connId, app, header, payload)
+		return
+	}
 
-	for _, id := range dataPack.receivingNodes {
-		val, ok := n.connections.Load(id)
-		if ok && val != nil {
-			nc := val.(*nodeConn)
-			nc.writeChan <- frame
+	if value, isReliable := header.extension(EXT_SEQUENCE); isReliable {
+		epoch, seq, err := decodeSequence(value)
+		if err != nil {
+			n.logger.Error("error decoding sequence", "error", err.Error(), "application", header.ApplicationID, "conn", in.connId)
+			return
 		}
+		n.receiveReliable(in.connId, app, epoch, seq, payload)
+		return
 	}
 
+	// Only send payload to application
+	n.deliver(app, payload)
+}
+
+// deliver queues a payload for the receive worker of an application without waiting, so a slow application
+// can not hold up the inbound multiplexer. It reports false and counts the drop if the queue is full.
+func (n *Nodosum) deliver(app *application, payload []byte) bool {
+	select {
+	case app.receiveWorker.InputChan <- payload:
+		return true
+	default:
+		app.receiveDrops.Add(1)
+		n.logger.Debug("dropping payload, receive queue full", "application", app.id)
+		return false
+	}
+}
+
+// handleSystemFrame processes control frames between nodes that are not routed to an application.
+func (n *Nodosum) handleSystemFrame(connId uint32, header *frameHeader, payload []byte) {
+	if _, isAck := header.extension(EXT_ACK); isAck {
+		n.handleAck(connId, header)
+	}
+	if _, isHeartbeat := header.extension(EXT_HEARTBEAT); isHeartbeat {
+		n.handleHeartbeat(connId, header)
+	}
+	if _, isApplications := header.extension(EXT_APPLICATIONS); isApplications {
+		n.handleApplications(connId, payload)
+	}
 }
@@ -0,0 +1,137 @@
+package nodosum
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/conamu/go-worker"
+)
+
+func TestDeliverDropsWhenReceiveQueueFull(t *testing.T) {
+	n := &Nodosum{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	app := &application{id: 1, receiveWorker: &worker.Worker{InputChan: make(chan any, 2)}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 5 {
+			n.deliver(app, []byte("x"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected delivery not to wait for a full receive queue")
+	}
+	if drops := app.ReceiveDrops(); drops != 3 {
+		t.Errorf("Expected 3 drops, got %d", drops)
+	}
+}
+
+func TestSetReceiveFuncWhileReceiving(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	sender, err := a.RegisterApplication("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := b.RegisterApplication("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Connect(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	// Receive functions and handlers are swapped while frames arrive, the race detector checks the rest
+	var received atomic.Int64
+	set := func() {
+		receiver.SetReceiveFunc(func(payload []byte) error {
+			received.Add(1)
+			return nil
+		})
+		receiver.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+			return payload, nil
+		})
+		receiver.SetBlobReceiveFunc(func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		})
+	}
+	set()
+	go func() {
+		for range 100 {
+			set()
+		}
+	}()
+	for range 100 {
+		if err := sender.Send([]byte("hello"), []string{"b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sender.Request(context.Background(), "b", []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected payloads to be received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChangeApplicationSettingsWhileSending(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	sender, err := a.RegisterApplication("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := b.RegisterApplication("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received atomic.Int64
+	receiver.SetReceiveFunc(func(payload []byte) error {
+		received.Add(1)
+		return nil
+	})
+	if _, err := a.Connect(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	// Settings are changed while the application sends and the write loop schedules, the race detector checks the rest
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			sender.SetWeight(i%4 + 1)
+			if i == 50 {
+				sender.DisableCompression()
+				sender.EnableReliableDelivery()
+			}
+		}
+	}()
+	for range 100 {
+		if err := sender.Send([]byte("hello"), []string{"b"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	deadline := time.Now().Add(5 * time.Second)
+	for received.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected payloads to be received")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
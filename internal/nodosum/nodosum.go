@@ -3,9 +3,12 @@ package nodosum
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"log/slog"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,63 +30,222 @@ SCOPE
 type Nodosum struct {
 	nodeId       string
 	ctx          context.Context
-	listenerTcp  net.Listener
-	udpConn      *net.UDPConn
-	sharedSecret string
+	transport    Transport
+	listener     net.Listener
+	packetConn   net.PacketConn
+	keyring      *keyring
+	udpCipher    *packetCipher
 	logger       *slog.Logger
 	connections  *sync.Map
 	applications *sync.Map
 	// globalReadChannel transfers all incoming packets from connections to the multiplexer
-	globalReadChannel chan any
-	// globalWriteChannel transfers all outgoing packets from applications to the multiplexer
-	globalWriteChannel    chan any
+	globalReadChannel     chan any
 	wg                    *sync.WaitGroup
 	handshakeTimeout      time.Duration
 	tlsEnabled            bool
 	tlsConfig             *tls.Config
 	multiplexerBufferSize int
 	muxWorkerCount        int
+	audit                 *auditLog
+	peerRoles             map[string][]string
+	admission             *admission
+	connFrameRate         float64
+	connByteRate          float64
+	rateLimitAction       int
+	compression           int
+	compressionThreshold  int
+	fragmentSize          int
+	fragmentIds           atomic.Uint64
+	reassembler           *reassembler
+	streams               *sync.Map
+	streamIds             atomic.Uint32
+	rpcIds                atomic.Uint64
+	// rpcCalls holds requests waiting for a response by correlation id
+	rpcCalls *sync.Map
+	// rpcHandling holds the cancel funcs of requests currently handled by handlingKey
+	rpcHandling *sync.Map
+	// rpcSlots bounds the number of request handlers running at the same time
+	rpcSlots chan struct{}
+	// outboxes and inboxes hold the state of reliable delivery by deliveryKey
+	outboxes *sync.Map
+	inboxes  *sync.Map
+	// epoch identifies this process to the reliable delivery of other nodes
+	epoch              uint64
+	retransmitInterval time.Duration
+	sendQueueSize      int
+	sendQueuePolicy    int
+	heartbeatInterval  time.Duration
+	idleTimeout        time.Duration
+	connIds            atomic.Uint32
+	// connMu serializes registering connections so only one per node is kept
+	connMu sync.Mutex
+	// peerAddrs holds the addresses added with AddPeer and the ID of the node last seen on them
+	peerAddrs         *sync.Map
+	reconnect         chan struct{}
+	reconnectInterval time.Duration
+	// connectionsPerPeer is the number of connections dialed to every peer
+	connectionsPerPeer int
+	// maxFrameSize is the largest frame accepted from peers, violations counts protocol violations by node ID
+	maxFrameSize int
+	violations   *sync.Map
+	// remoteApplications holds the applications announced by every connected node, by node ID
+	remoteApplications *sync.Map
+	// broadcastFanout is the number of nodes a broadcast is sent to by each node of its tree, 0 sends to all directly
+	broadcastFanout int
+	// chaos controls the faults of the transport, nil unless it is a chaos transport
+	chaos *Chaos
+	clock Clock
 }
 
 func New(cfg *Config) (*Nodosum, error) {
 	var tlsConf *tls.Config
 
-	tcpLocalAddr := &net.TCPAddr{Port: cfg.ListenPort}
-	addrString := tcpLocalAddr.String()
+	transport := cfg.Transport
+	if transport == nil {
+		transport = NewTCPTransport(fmt.Sprintf(":%d", cfg.ListenPort))
+	}
 
 	if cfg.TlsEnabled {
 		cfg.Logger.Debug("running with TLS enabled")
+		// The same config is used for both ends, peers authenticate each other with certificates of the cluster CA
 		tlsConf = &tls.Config{
 			ServerName:   cfg.TlsHostName,
 			RootCAs:      cfg.TlsCACert,
+			ClientCAs:    cfg.TlsCACert,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
 			Certificates: []tls.Certificate{*cfg.TlsCert},
 		}
 	}
-	listenerTcp, err := net.Listen("tcp", addrString)
+
+	maxFrameSize := cfg.MaxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DEFAULT_MAX_FRAME_SIZE
+	}
+	chunkSize := cfg.FragmentSize
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_FRAGMENT_SIZE
+	}
+	maxMessageSize := cfg.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DEFAULT_MAX_MESSAGE_SIZE
+	}
+	if maxFrameSize < maxHandshakeFrame || chunkSize >= maxFrameSize {
+		return nil, fmt.Errorf("maximum frame size of %d bytes is too small for fragments of %d bytes", maxFrameSize, chunkSize)
+	}
+
+	listener, err := transport.Listen()
+	if err != nil {
+		return nil, err
+	}
+
+	packetConn, err := transport.ListenPacket()
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
 
-	udpLocalAddr := &net.UDPAddr{Port: cfg.ListenPort}
-	listenerUdp, err := net.ListenUDP("udp", udpLocalAddr)
+	kr := newKeyring(cfg.SharedSecret, cfg.PreviousSharedSecrets)
+
+	sendQueueSize := cfg.SendQueueSize
+	if sendQueueSize <= 0 {
+		sendQueueSize = DEFAULT_SEND_QUEUE_SIZE
+	}
+	heartbeatInterval := cfg.HeartbeatInterval
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+	handshakeTimeout := cfg.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	auditBufferSize := cfg.AuditBufferSize
+	if auditBufferSize <= 0 {
+		auditBufferSize = DEFAULT_AUDIT_BUFFER_SIZE
+	}
+	reconnectInterval := cfg.ReconnectInterval
+	if reconnectInterval <= 0 {
+		reconnectInterval = DEFAULT_RECONNECT_INTERVAL
+	}
+
+	maxConcurrentRequests := cfg.MaxConcurrentRequests
+	if maxConcurrentRequests <= 0 {
+		maxConcurrentRequests = DEFAULT_MAX_CONCURRENT_REQUESTS
+	}
+
+	connectionsPerPeer := min(cfg.ConnectionsPerPeer, MAX_CONNECTIONS_PER_PEER)
+	if connectionsPerPeer <= 0 {
+		connectionsPerPeer = DEFAULT_CONNECTIONS_PER_PEER
+	}
+
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	var chaos *Chaos
+	if t, ok := transport.(interface{ Chaos() *Chaos }); ok {
+		chaos = t.Chaos()
+	}
+
+	peerAddrs := &sync.Map{}
+	for _, addr := range cfg.Peers {
+		peerAddrs.Store(addr, "")
+	}
 
 	return &Nodosum{
 		nodeId:                cfg.NodeId,
 		ctx:                   cfg.Ctx,
-		listenerTcp:           listenerTcp,
-		udpConn:               listenerUdp,
-		sharedSecret:          cfg.SharedSecret,
+		transport:             transport,
+		listener:              listener,
+		packetConn:            packetConn,
+		keyring:               kr,
+		udpCipher:             newPacketCipher(kr),
 		logger:                cfg.Logger,
 		connections:           &sync.Map{},
 		applications:          &sync.Map{},
 		globalReadChannel:     make(chan any, cfg.MultiplexerBufferSize),
-		globalWriteChannel:    make(chan any, cfg.MultiplexerBufferSize),
 		wg:                    cfg.Wg,
-		handshakeTimeout:      cfg.HandshakeTimeout,
+		handshakeTimeout:      handshakeTimeout,
 		tlsEnabled:            cfg.TlsEnabled,
 		tlsConfig:             tlsConf,
 		multiplexerBufferSize: cfg.MultiplexerBufferSize,
 		muxWorkerCount:        cfg.MultiplexerWorkerCount,
+		audit:                 newAuditLog(cfg.AuditSink, auditBufferSize, cfg.Logger),
+		peerRoles:             cfg.PeerRoles,
+		admission:             newAdmission(cfg.MaxConnections, cfg.MaxConnectionsPerIP, cfg.MaxHandshakes),
+		connFrameRate:         cfg.ConnFrameRate,
+		connByteRate:          cfg.ConnByteRate,
+		rateLimitAction:       cfg.RateLimitAction,
+		compression:           cfg.Compression,
+		compressionThreshold:  cfg.CompressionThreshold,
+		fragmentSize:          chunkSize,
+		reassembler:           newReassembler(maxMessageSize, clock),
+		streams:               &sync.Map{},
+		rpcCalls:              &sync.Map{},
+		rpcHandling:           &sync.Map{},
+		rpcSlots:              make(chan struct{}, maxConcurrentRequests),
+		outboxes:              &sync.Map{},
+		inboxes:               &sync.Map{},
+		epoch:                 newEpoch(),
+		retransmitInterval:    cfg.RetransmitInterval,
+		sendQueueSize:         sendQueueSize,
+		sendQueuePolicy:       cfg.SendQueuePolicy,
+		heartbeatInterval:     heartbeatInterval,
+		idleTimeout:           idleTimeout,
+		peerAddrs:             peerAddrs,
+		reconnect:             make(chan struct{}, 1),
+		reconnectInterval:     reconnectInterval,
+		connectionsPerPeer:    connectionsPerPeer,
+		maxFrameSize:          maxFrameSize,
+		violations:            &sync.Map{},
+		remoteApplications:    &sync.Map{},
+		broadcastFanout:       min(max(cfg.BroadcastFanout, 0), math.MaxUint8),
+		chaos:                 chaos,
+		clock:                 clock,
 	}, nil
 }
 
@@ -93,12 +255,22 @@ func (n *Nodosum) Start() {
 
 	n.wg.Go(
 		func() {
-			n.listenTcp()
+			n.listenConns()
+		},
+	)
+	n.wg.Go(
+		func() {
+			n.listenPackets()
+		},
+	)
+	n.wg.Go(
+		func() {
+			n.retransmitLoop()
 		},
 	)
 	n.wg.Go(
 		func() {
-			n.listenUdp()
+			n.maintainPeers()
 		},
 	)
 }
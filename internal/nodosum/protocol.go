@@ -2,6 +2,8 @@ package nodosum
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
 /*
@@ -25,13 +27,81 @@ This is not designed to be the absolute high performance cluster protocol
 but it tries to adhere to good performance standards to at least leverage an own implementation.
 This includes optional compression, Multiplexing readiness, shared buffers and direct binary encoding.
 
+Wire format, version 3. All integers are little endian.
+
+Frame header (11 bytes):
+	offset 0  uint8   Version
+	offset 1  uint32  ApplicationID
+	offset 5  uint8   Type
+	offset 6  uint8   Flag, a bitset of messageFlag
+	offset 7  uint32  Length of the payload
+
+If the EXTENDED flag is set, the extension area follows the header:
+	uint16  length of all entries
+	entries of uint8 type | uint16 length | value
+Receivers skip entries of unknown types, so new extensions like trace context or deadlines
+can be added without bumping the version. An extension area without entries is invalid.
+
+The payload of Length bytes follows the extension area.
+
+Receivers check Version and Type and the size of the whole frame against the maximum frame size
+agreed on in the handshake before anything behind the header is read.
+
+Version 1 has no flags, its flag byte is ignored. Version 2 adds the flags and the extension area.
+Version 3 negotiates compression: the HELLO of the handshake carries an EXT_COMPRESSION extension
+with a uint8 bitset of the algorithms the node can decompress, 1 << algorithm for every algorithm it supports.
+COMPRESSED is only set on frames to nodes that announced the algorithm. A HELLO without the extension,
+sent by a node of an older version, announces every algorithm, as all of them could decompress them.
+
+Handshake packet (11 bytes):
+	offset 0  uint8   Version
+	offset 1  uint8   Type
+	offset 2  uint8   ConnInit
+	offset 3  uint32  Id
+	offset 7  uint32  Secret
+
+Golden vectors for every frame and handshake packet type live in testdata/glutamate_v<version>.json.
+Any change to the encoding has to bump PROTOCOL_VERSION and add a new set of vectors
+instead of changing the existing ones.
+
 */
 
+// PROTOCOL_VERSION is the version of the Glutamate wire format written by this node
+const PROTOCOL_VERSION uint8 = 3
+
+const (
+	frameHeaderSize     = 11
+	handshakePacketSize = 11
+	// extensionAreaHeaderSize is the uint16 length in front of the extension entries
+	extensionAreaHeaderSize = 2
+	// extensionEntryHeaderSize is the type and length in front of every extension value
+	extensionEntryHeaderSize = 3
+)
+
+// DEFAULT_MAX_FRAME_SIZE is the largest frame, header and extensions included, a node accepts by default
+const DEFAULT_MAX_FRAME_SIZE = 16 * 1024 * 1024
+
+var (
+	errFrameShort         = errors.New("frame too short")
+	errEmptyExtensionArea = errors.New("EXTENDED flag set without extensions")
+	errUnknownVersion     = errors.New("unknown protocol version")
+	errUnknownType        = errors.New("unknown message type")
+	// ErrFrameTooLarge is returned when sending a frame bigger than the maximum frame size of the receiving node
+	ErrFrameTooLarge = errors.New("frame exceeds maximum frame size")
+)
+
 type messageFlag uint8
 type messageType uint8
+type extensionType uint8
 
 const (
-	COMPRESSED messageFlag = iota
+	COMPRESSED messageFlag = 1 << iota
+	FRAGMENTED
+	ACK_REQUESTED
+	TRACED
+	PRIORITY
+	// EXTENDED is set by encodeFrameHeader if the frame carries extensions
+	EXTENDED
 )
 
 const (
@@ -39,38 +109,186 @@ const (
 	APP
 )
 
+const (
+	EXT_TRACE_CONTEXT extensionType = iota + 1
+	EXT_DEADLINE
+	EXT_FRAGMENT
+	EXT_STREAM
+	EXT_RPC
+	EXT_SEQUENCE
+	EXT_ACK
+	EXT_HEARTBEAT
+	EXT_HANDSHAKE
+	EXT_BROADCAST
+	EXT_APPLICATIONS
+	EXT_COMPRESSION
+	EXT_EPOCH
+)
+
 type frameHeader struct {
 	Version       uint8
 	ApplicationID uint32      // ID for multiplexer to route to subsystem
 	Type          messageType // message type (e.g. DATA, CONTROL, PING, etc.)
-	Flag          messageFlag // optional flag for behavior
+	Flag          messageFlag // bitset of flags for behavior
 	Length        uint32      // length of payload following this header
+	Extensions    []frameExtension
 }
 
+type frameExtension struct {
+	Type  extensionType
+	Value []byte
+}
+
+// extension returns the value of the first extension of type t.
+func (fh *frameHeader) extension(t extensionType) ([]byte, bool) {
+	for _, ext := range fh.Extensions {
+		if ext.Type == t {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+// checkFrameHeader validates the version and type of the fixed header of a frame.
+// Every version 1 frame is a valid version 2 frame, so all versions up to PROTOCOL_VERSION are accepted.
+func checkFrameHeader(header []byte) error {
+	if len(header) < frameHeaderSize {
+		return errFrameShort
+	}
+	if header[0] == 0 || header[0] > PROTOCOL_VERSION {
+		return fmt.Errorf("%w: %d", errUnknownVersion, header[0])
+	}
+	if messageType(header[5]) > APP {
+		return fmt.Errorf("%w: %d", errUnknownType, header[5])
+	}
+	return nil
+}
+
+// headerFlags returns the flags of an encoded frame header, version 1 frames have none.
+func headerFlags(header []byte) messageFlag {
+	if header[0] < 2 {
+		return 0
+	}
+	return messageFlag(header[6])
+}
+
+// encodeFrameHeader encodes the header and, if there are any, the extensions.
+// The EXTENDED flag is derived from the presence of extensions.
+// All extensions together have to stay below 64kb.
 func encodeFrameHeader(fh *frameHeader) []byte {
-	buf := make([]byte, 12)
+	buf := make([]byte, frameHeaderLen(fh))
+	putFrameHeader(buf, fh)
+	return buf
+}
+
+// frameHeaderLen returns the encoded size of the header including its extension area.
+func frameHeaderLen(fh *frameHeader) int {
+	size := frameHeaderSize
+	if len(fh.Extensions) > 0 {
+		size += extensionAreaHeaderSize
+		for _, ext := range fh.Extensions {
+			size += extensionEntryHeaderSize + len(ext.Value)
+		}
+	}
+	return size
+}
+
+// putFrameHeader encodes the header into buf, which has to hold at least frameHeaderLen bytes.
+func putFrameHeader(buf []byte, fh *frameHeader) {
+	size := frameHeaderLen(fh)
+
+	flag := fh.Flag &^ EXTENDED
+	if len(fh.Extensions) > 0 {
+		flag |= EXTENDED
+	}
 
 	buf[0] = fh.Version
-	binary.LittleEndian.PutUint32(buf[1:], fh.ApplicationID)
-	buf[6] = uint8(fh.Type)
-	buf[7] = uint8(fh.Flag)
-	binary.LittleEndian.PutUint32(buf[8:], fh.Length)
+	binary.LittleEndian.PutUint32(buf[1:5], fh.ApplicationID)
+	buf[5] = uint8(fh.Type)
+	buf[6] = uint8(flag)
+	binary.LittleEndian.PutUint32(buf[7:11], fh.Length)
 
-	return buf
+	if len(fh.Extensions) == 0 {
+		return
+	}
+
+	binary.LittleEndian.PutUint16(buf[frameHeaderSize:], uint16(size-frameHeaderSize-extensionAreaHeaderSize))
+	offset := frameHeaderSize + extensionAreaHeaderSize
+	for _, ext := range fh.Extensions {
+		buf[offset] = uint8(ext.Type)
+		binary.LittleEndian.PutUint16(buf[offset+1:], uint16(len(ext.Value)))
+		offset += extensionEntryHeaderSize
+		offset += copy(buf[offset:], ext.Value)
+	}
 }
 
+// decodeFrameHeader decodes the fixed size part of a header, extensions are decoded with decodeFrameExtensions.
 func decodeFrameHeader(frameHeaderBytes []byte) *frameHeader {
 	fh := frameHeader{}
 
 	fh.Version = frameHeaderBytes[0]
 	fh.ApplicationID = binary.LittleEndian.Uint32(frameHeaderBytes[1:5])
-	fh.Type = messageType(frameHeaderBytes[6])
-	fh.Flag = messageFlag(frameHeaderBytes[7])
-	fh.Length = binary.LittleEndian.Uint32(frameHeaderBytes[8:11])
+	fh.Type = messageType(frameHeaderBytes[5])
+	fh.Flag = headerFlags(frameHeaderBytes)
+	fh.Length = binary.LittleEndian.Uint32(frameHeaderBytes[7:11])
 
 	return &fh
 }
 
+// decodeFrameExtensions decodes the entries of an extension area, without its length prefix.
+func decodeFrameExtensions(area []byte) ([]frameExtension, error) {
+	if len(area) == 0 {
+		return nil, errEmptyExtensionArea
+	}
+
+	var exts []frameExtension
+	for len(area) > 0 {
+		if len(area) < extensionEntryHeaderSize {
+			return nil, errFrameShort
+		}
+		length := int(binary.LittleEndian.Uint16(area[1:3]))
+		if len(area) < extensionEntryHeaderSize+length {
+			return nil, errFrameShort
+		}
+		exts = append(exts, frameExtension{
+			Type:  extensionType(area[0]),
+			Value: area[extensionEntryHeaderSize : extensionEntryHeaderSize+length],
+		})
+		area = area[extensionEntryHeaderSize+length:]
+	}
+	return exts, nil
+}
+
+// decodeFrame decodes a complete frame and returns its header and payload.
+func decodeFrame(frame []byte) (*frameHeader, []byte, error) {
+	if err := checkFrameHeader(frame); err != nil {
+		return nil, nil, err
+	}
+	fh := decodeFrameHeader(frame)
+	rest := frame[frameHeaderSize:]
+
+	if fh.Flag&EXTENDED != 0 {
+		if len(rest) < extensionAreaHeaderSize {
+			return nil, nil, errFrameShort
+		}
+		length := int(binary.LittleEndian.Uint16(rest))
+		if len(rest) < extensionAreaHeaderSize+length {
+			return nil, nil, errFrameShort
+		}
+		exts, err := decodeFrameExtensions(rest[extensionAreaHeaderSize : extensionAreaHeaderSize+length])
+		if err != nil {
+			return nil, nil, err
+		}
+		fh.Extensions = exts
+		rest = rest[extensionAreaHeaderSize+length:]
+	}
+
+	if uint64(len(rest)) < uint64(fh.Length) {
+		return nil, nil, errFrameShort
+	}
+	return fh, rest[:fh.Length], nil
+}
+
 /*
 	UDP handshake protocol
 	1. Node ID exchange
@@ -81,13 +299,13 @@ func decodeFrameHeader(frameHeaderBytes []byte) *frameHeader {
 */
 
 func encodeHandshakePacket(hp *handshakeUdpPacket) []byte {
-	buf := make([]byte, 11)
+	buf := make([]byte, handshakePacketSize)
 
 	buf[0] = hp.Version
 	buf[1] = uint8(hp.Type)
 	buf[2] = hp.ConnInit
-	binary.LittleEndian.PutUint32(buf[3:], hp.Id)
-	binary.LittleEndian.PutUint32(buf[7:], hp.Secret)
+	binary.LittleEndian.PutUint32(buf[3:7], hp.Id)
+	binary.LittleEndian.PutUint32(buf[7:11], hp.Secret)
 
 	return buf
 }
@@ -98,8 +316,8 @@ func decodeHandshakePacket(bytes []byte) *handshakeUdpPacket {
 	hp.Version = bytes[0]
 	hp.Type = handshakeMessage(bytes[1])
 	hp.ConnInit = bytes[2]
-	hp.Id = binary.LittleEndian.Uint32(bytes[3:6])
-	hp.Secret = binary.LittleEndian.Uint32(bytes[7:10])
+	hp.Id = binary.LittleEndian.Uint32(bytes[3:7])
+	hp.Secret = binary.LittleEndian.Uint32(bytes[7:11])
 
 	return &hp
 }
@@ -109,7 +327,7 @@ type handshakeUdpPacket struct {
 	Type     handshakeMessage
 	ConnInit uint8
 	Id       uint32
-	Secret   uint32
+	Secret   uint32 // fingerprint of the senders primary shared secret
 }
 
 type handshakeMessage uint8
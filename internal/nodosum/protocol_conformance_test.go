@@ -0,0 +1,322 @@
+package nodosum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type goldenVectors struct {
+	Version uint8 `json:"version"`
+	Frames  []struct {
+		Name          string `json:"name"`
+		Version       uint8  `json:"version"`
+		ApplicationID uint32 `json:"applicationId"`
+		Type          uint8  `json:"type"`
+		Flag          uint8  `json:"flag"`
+		Length        uint32 `json:"length"`
+		Extensions    []struct {
+			Type  uint8  `json:"type"`
+			Value string `json:"value"`
+		} `json:"extensions"`
+		Hex string `json:"hex"`
+	} `json:"frames"`
+	Handshakes []struct {
+		Name     string `json:"name"`
+		Version  uint8  `json:"version"`
+		Type     uint8  `json:"type"`
+		ConnInit uint8  `json:"connInit"`
+		Id       uint32 `json:"id"`
+		Secret   uint32 `json:"secret"`
+		Hex      string `json:"hex"`
+	} `json:"handshakes"`
+}
+
+func loadGoldenVectors(t testing.TB, version uint8) *goldenVectors {
+	t.Helper()
+
+	data, err := os.ReadFile(fmt.Sprintf("testdata/glutamate_v%d.json", version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &goldenVectors{}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Version != version {
+		t.Fatalf("Expected vectors for version %d, got %d", version, v.Version)
+	}
+	return v
+}
+
+// TestGoldenFrameHeaders checks the vectors of every version, older frames have to stay decodable.
+func TestGoldenFrameHeaders(t *testing.T) {
+	for version := uint8(1); version <= PROTOCOL_VERSION; version++ {
+		for _, vec := range loadGoldenVectors(t, version).Frames {
+			t.Run(fmt.Sprintf("v%d/%s", version, vec.Name), func(t *testing.T) {
+				wire, err := hex.DecodeString(vec.Hex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fh := frameHeader{
+					Version:       vec.Version,
+					ApplicationID: vec.ApplicationID,
+					Type:          messageType(vec.Type),
+					Flag:          messageFlag(vec.Flag),
+					Length:        vec.Length,
+				}
+				for _, ext := range vec.Extensions {
+					value, err := hex.DecodeString(ext.Value)
+					if err != nil {
+						t.Fatal(err)
+					}
+					fh.Extensions = append(fh.Extensions, frameExtension{Type: extensionType(ext.Type), Value: value})
+				}
+
+				if encoded := encodeFrameHeader(&fh); !bytes.Equal(encoded, wire) {
+					t.Errorf("Encoding mismatch: expected %x, got %x", wire, encoded)
+				}
+
+				decoded := decodeFrameHeader(wire)
+				if decoded.Flag&EXTENDED != 0 {
+					decoded.Extensions, err = decodeFrameExtensions(wire[frameHeaderSize+extensionAreaHeaderSize:])
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if !reflect.DeepEqual(*decoded, fh) {
+					t.Errorf("Decoding mismatch: expected %+v, got %+v", fh, *decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestGoldenHandshakePackets(t *testing.T) {
+	for version := uint8(1); version <= PROTOCOL_VERSION; version++ {
+		for _, vec := range loadGoldenVectors(t, version).Handshakes {
+			t.Run(fmt.Sprintf("v%d/%s", version, vec.Name), func(t *testing.T) {
+				wire, err := hex.DecodeString(vec.Hex)
+				if err != nil {
+					t.Fatal(err)
+				}
+				hp := handshakeUdpPacket{
+					Version:  vec.Version,
+					Type:     handshakeMessage(vec.Type),
+					ConnInit: vec.ConnInit,
+					Id:       vec.Id,
+					Secret:   vec.Secret,
+				}
+
+				if encoded := encodeHandshakePacket(&hp); !bytes.Equal(encoded, wire) {
+					t.Errorf("Encoding mismatch: expected %x, got %x", wire, encoded)
+				}
+				if decoded := decodeHandshakePacket(wire); *decoded != hp {
+					t.Errorf("Decoding mismatch: expected %+v, got %+v", hp, *decoded)
+				}
+			})
+		}
+	}
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, vec := range loadGoldenVectors(f, PROTOCOL_VERSION).Frames {
+		wire, _ := hex.DecodeString(vec.Hex)
+		if vec.Length <= 4096 {
+			wire = append(wire, make([]byte, vec.Length)...)
+		}
+		f.Add(wire)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := decodeFrame(data)
+		if err != nil {
+			return
+		}
+		encoded := append(encodeFrameHeader(header), payload...)
+		want := bytes.Clone(data[:len(encoded)])
+		// The flag byte of version 1 is ignored and encoded as 0
+		if want[0] == 1 {
+			want[6] = 0
+		}
+		if !bytes.Equal(encoded, want) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", want, encoded)
+		}
+	})
+}
+
+func FuzzDecodeHandshakePacket(f *testing.F) {
+	for _, vec := range loadGoldenVectors(f, PROTOCOL_VERSION).Handshakes {
+		wire, _ := hex.DecodeString(vec.Hex)
+		f.Add(wire)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < handshakePacketSize {
+			t.Skip()
+		}
+		packet := decodeHandshakePacket(data)
+		if encoded := encodeHandshakePacket(packet); !bytes.Equal(encoded, data[:handshakePacketSize]) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data[:handshakePacketSize], encoded)
+		}
+	})
+}
+
+func FuzzPacketCipherOpen(f *testing.F) {
+	sealed, err := newPacketCipher(newKeyring("secret", nil)).seal([]byte("hello"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(sealed)
+	f.Add([]byte{udpEnvelopeVersion})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := newPacketCipher(newKeyring("secret", nil))
+		payload, err := c.open(data)
+		// Only the sealed seed is authentic, everything else has to be rejected
+		if err == nil && !bytes.Equal(payload, []byte("hello")) {
+			t.Errorf("Expected forged packet to be rejected, opened %q", payload)
+		}
+	})
+}
+
+func FuzzDecodeFrameExtensions(f *testing.F) {
+	f.Add([]byte{uint8(EXT_RPC), 1, 0, 'x'})
+	f.Add([]byte{uint8(EXT_ACK), 0, 0, uint8(EXT_HEARTBEAT), 2, 0, 1, 2})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		exts, err := decodeFrameExtensions(data)
+		if err != nil {
+			return
+		}
+		encoded := encodeFrameHeader(&frameHeader{Version: PROTOCOL_VERSION, Type: APP, Extensions: exts})
+		if area := encoded[frameHeaderSize+extensionAreaHeaderSize:]; !bytes.Equal(area, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, area)
+		}
+	})
+}
+
+func FuzzDecodeHello(f *testing.F) {
+	f.Add(encodeHello(&hello{nonce: make([]byte, handshakeNonceSize), stripe: 1, maxFrameSize: 1 << 20, nodeId: "node-1"}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := decodeHello(data)
+		if err != nil {
+			return
+		}
+		if encoded := encodeHello(h); !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
+
+func FuzzReadPacket(f *testing.F) {
+	packet, err := Pack(SET, []byte("data"), "token")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packet)
+	f.Add([]byte{PULSE_MAGIC, GET, 0, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		p, err := ReadPacket(r)
+		if err != nil {
+			return
+		}
+		read := data[:len(data)-r.Len()]
+		encoded, err := Pack(p.Command, p.Data, p.Token)
+		if err != nil {
+			t.Fatalf("Expected a read packet to be packable, got %v", err)
+		}
+		if !bytes.Equal(encoded, read) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", read, encoded)
+		}
+	})
+}
+
+func FuzzDecodeBroadcastRoute(f *testing.F) {
+	route, err := encodeBroadcastRoute(&broadcastRoute{fanout: 2, origin: "node-0", nodes: []string{"node-1", "node-2"}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(route)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		route, err := decodeBroadcastRoute(data)
+		if err != nil {
+			return
+		}
+		encoded, err := encodeBroadcastRoute(route)
+		if err != nil {
+			// A route can be decoded that is too big to be sent along with other extensions
+			if len(data) <= maxBroadcastRoute {
+				t.Fatalf("Expected a decoded route to be encodable, got %v", err)
+			}
+			return
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeStreamControl(f *testing.F) {
+	f.Add(encodeStreamControl(&streamControl{id: 1, flags: STREAM_FIN, offset: 1024, window: streamInitialWindow}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sc, err := decodeStreamControl(data)
+		if err != nil {
+			return
+		}
+		if encoded := encodeStreamControl(sc); !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeFragmentInfo(f *testing.F) {
+	f.Add(encodeFragmentInfo(&fragmentInfo{id: 1, index: 2, flags: FRAGMENT_FINAL}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fi, err := decodeFragmentInfo(data)
+		if err != nil {
+			return
+		}
+		if encoded := encodeFragmentInfo(fi); !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeSequence(f *testing.F) {
+	f.Add(encodeSequence(7, 42))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		epoch, seq, err := decodeSequence(data)
+		if err != nil {
+			return
+		}
+		if encoded := encodeSequence(epoch, seq); !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodeRpcHeader(f *testing.F) {
+	f.Add(encodeRpcHeader(&rpcHeader{id: 1, kind: RPC_REQUEST}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rh, err := decodeRpcHeader(data)
+		if err != nil {
+			return
+		}
+		if encoded := encodeRpcHeader(rh); !bytes.Equal(encoded, data) {
+			t.Errorf("Round trip mismatch: expected %x, got %x", data, encoded)
+		}
+	})
+}
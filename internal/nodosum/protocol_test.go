@@ -23,18 +23,18 @@ func TestEncodeFrameHeader(t *testing.T) {
 		t.Errorf("Expected version to be 1, got %d", encoded[0])
 	}
 
-	if encoded[6] != uint8(SYSTEM) {
-		t.Errorf("Expected type to be %d, got %d", SYSTEM, encoded[6])
+	if encoded[5] != uint8(SYSTEM) {
+		t.Errorf("Expected type to be %d, got %d", SYSTEM, encoded[5])
 	}
 
-	if encoded[7] != uint8(COMPRESSED) {
-		t.Errorf("Expected flag to be %d, got %d", COMPRESSED, encoded[7])
+	if encoded[6] != uint8(COMPRESSED) {
+		t.Errorf("Expected flag to be %d, got %d", COMPRESSED, encoded[6])
 	}
 }
 
 func TestDecodeFrameHeader(t *testing.T) {
 	frameBytes := []byte{
-		1,                      // Version
+		2,                      // Version
 		0x78, 0x56, 0x34, 0x12, // ApplicationID (little endian)
 		uint8(APP),             // Type
 		uint8(COMPRESSED),      // Flag
@@ -43,8 +43,8 @@ func TestDecodeFrameHeader(t *testing.T) {
 
 	decoded := decodeFrameHeader(frameBytes)
 
-	if decoded.Version != 1 {
-		t.Errorf("Expected version to be 1, got %d", decoded.Version)
+	if decoded.Version != 2 {
+		t.Errorf("Expected version to be 2, got %d", decoded.Version)
 	}
 
 	if decoded.ApplicationID != 0x12345678 {
@@ -62,6 +62,12 @@ func TestDecodeFrameHeader(t *testing.T) {
 	if decoded.Length != 1024 {
 		t.Errorf("Expected length to be 1024, got %d", decoded.Length)
 	}
+
+	// Version 1 has no flags
+	frameBytes[0] = 1
+	if decoded := decodeFrameHeader(frameBytes); decoded.Flag != 0 {
+		t.Errorf("Expected flags of version 1 to be ignored, got %d", decoded.Flag)
+	}
 }
 
 func TestEncodeDecodeRoundTrip(t *testing.T) {
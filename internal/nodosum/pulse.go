@@ -0,0 +1,280 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+Pulse command protocol
+
+Pulse, the CLI in cmd/pulse.go, connects to the same listener as the nodes of the cluster.
+Its connections are told apart by the first byte: every Pulse packet starts with PULSE_MAGIC,
+which is no valid protocol version and so never starts a node handshake.
+
+The CLI opens with HELLO and the node answers with its node ID. Every following packet is a command
+with the token of the caller and is answered by exactly one packet, the command with its result
+or ERROR with the reason it failed. Commands are checked by the ACL middleware and privileged ones
+are recorded in the audit log. EXIT closes the connection.
+
+SET and GET address a key of an application registered on the node, their data is
+"application key", followed by " value" for SET. They are answered by the command handler
+of the application, the audit log records the application and key.
+
+Packet:
+	uint8   PULSE_MAGIC
+	uint8   command
+	uint8   token length
+	[]byte  token
+	uint32  data length
+	[]byte  data
+*/
+
+const (
+	PULSE_MAGIC uint8 = 'P'
+	// maxPulseData limits the data of a single packet in both directions
+	maxPulseData = 1024 * 1024
+)
+
+var (
+	errPulsePacket        = errors.New("invalid pulse packet")
+	errPermissionDenied   = errors.New("permission denied")
+	errUnsupportedCommand = errors.New("unsupported command")
+	errPulseKey           = errors.New("expected application and key")
+)
+
+// Packet is a command sent by Pulse or the answer of a node.
+type Packet struct {
+	Command int
+	Token   string
+	Data    []byte
+}
+
+// Pack encodes a Pulse packet.
+func Pack(cmd int, data []byte, token string) ([]byte, error) {
+	if cmd < 0 || cmd > math.MaxUint8 || len(token) > math.MaxUint8 || len(data) > maxPulseData {
+		return nil, fmt.Errorf("%w: command %d with %d bytes token and %d bytes data", errPulsePacket, cmd, len(token), len(data))
+	}
+
+	buf := make([]byte, 0, 7+len(token)+len(data))
+	buf = append(buf, PULSE_MAGIC, uint8(cmd), uint8(len(token)))
+	buf = append(buf, token...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+	return append(buf, data...), nil
+}
+
+// ReadPacket reads a single Pulse packet from r.
+func ReadPacket(r io.Reader) (*Packet, error) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0] != PULSE_MAGIC {
+		return nil, errPulsePacket
+	}
+
+	token := make([]byte, head[2])
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(length)
+	if size > maxPulseData {
+		return nil, fmt.Errorf("%w: %d bytes of data", errPulsePacket, size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return &Packet{Command: int(head[1]), Token: string(token), Data: data}, nil
+}
+
+// peekedConn hands out bytes read ahead before reading from the connection again.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.peeked)
+	c.peeked = c.peeked[n:]
+	return n, nil
+}
+
+// detectPulse reads the first byte of an accepted connection and reports whether Pulse is on the other end.
+// The returned connection reads the byte again.
+func (n *Nodosum) detectPulse(conn net.Conn) (net.Conn, bool, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(n.handshakeTimeout)); err != nil {
+		return nil, false, err
+	}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return nil, false, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, false, err
+	}
+	return &peekedConn{Conn: conn, peeked: first}, first[0] == PULSE_MAGIC, nil
+}
+
+// handlePulse answers the commands of a Pulse connection until it exits or the node shuts down.
+func (n *Nodosum) handlePulse(conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(n.ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := n.pulseHello(conn); err != nil {
+		n.logger.Warn("error in pulse handshake", "error", err.Error(), "remote", conn.RemoteAddr())
+		return
+	}
+
+	for {
+		p, err := ReadPacket(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				n.logger.Debug("closing pulse connection", "error", err.Error(), "remote", conn.RemoteAddr())
+			}
+			return
+		}
+		if p.Command == EXIT && n.authorize(conn, EXIT, p.Token, 0, "") {
+			return
+		}
+
+		cmd := p.Command
+		data, err := n.runCommand(conn, p)
+		if err != nil {
+			cmd, data = ERROR, []byte(err.Error())
+		}
+		response, err := Pack(cmd, data, "")
+		if err != nil {
+			response, _ = Pack(ERROR, []byte(err.Error()), "")
+		}
+		if _, err := conn.Write(response); err != nil {
+			n.logger.Debug("error answering pulse command", "error", err.Error(), "remote", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+// pulseHello expects the HELLO of the CLI and answers with the node ID.
+func (n *Nodosum) pulseHello(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(n.handshakeTimeout)); err != nil {
+		return err
+	}
+	p, err := ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	if p.Command != int(HELLO) {
+		return fmt.Errorf("%w: expected HELLO, got %s", errPulsePacket, commandName(p.Command))
+	}
+	hello, err := Pack(int(HELLO), []byte(n.nodeId), "")
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(hello); err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// pulseKey is the application and key a SET or GET addresses, with the value of a SET.
+type pulseKey struct {
+	application string
+	key         string
+	value       []byte
+}
+
+// parsePulseKey parses the data of SET and GET: "application key", followed by " value" for SET.
+func parsePulseKey(cmd int, data []byte) (*pulseKey, error) {
+	parts := 2
+	if cmd == SET {
+		parts = 3
+	}
+	fields := strings.SplitN(string(data), " ", parts)
+	if len(fields) != parts || fields[0] == "" || fields[1] == "" {
+		return nil, fmt.Errorf("%w: %q", errPulseKey, data)
+	}
+	pk := &pulseKey{application: fields[0], key: fields[1]}
+	if cmd == SET {
+		pk.value = []byte(fields[2])
+	}
+	return pk, nil
+}
+
+// runCommand checks a Pulse command against the ACL middleware and executes it.
+// Privileged commands are recorded in the audit log, including the ones failing.
+func (n *Nodosum) runCommand(conn net.Conn, p *Packet) ([]byte, error) {
+	var pk *pulseKey
+	var keyErr error
+	var appId uint32
+	var key string
+	if p.Command == SET || p.Command == GET {
+		pk, keyErr = parsePulseKey(p.Command, p.Data)
+		if keyErr == nil {
+			appId, key = applicationId(pk.application), pk.key
+		}
+	}
+
+	if !n.authorize(conn, p.Command, p.Token, appId, key) {
+		return nil, fmt.Errorf("%w: %s", errPermissionDenied, commandName(p.Command))
+	}
+
+	var data []byte
+	var err error
+	switch p.Command {
+	case ID:
+		data = []byte(n.nodeId)
+	case AUDIT:
+		data, err = n.queryAudit(p.Data)
+	case ROTATE:
+		if err = n.RotateSharedSecret(string(p.Data)); err == nil {
+			data = []byte("shared secret rotated")
+		}
+	case RETIRE:
+		if err = n.RetireSharedSecret(string(p.Data)); err == nil {
+			data = []byte("shared secret retired")
+		}
+	case CHAOS:
+		data, err = n.chaosCommand(p.Data)
+	case SET, GET:
+		err = keyErr
+		if err == nil {
+			data, err = n.keyCommand(p.Command, pk)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", errUnsupportedCommand, commandName(p.Command))
+	}
+
+	if err != nil && privileged(p.Command) {
+		n.auditFailure(conn, p.Command, p.Token, appId, key, err)
+	}
+	return data, err
+}
+
+// keyCommand runs SET or GET with the command handler of the addressed application.
+func (n *Nodosum) keyCommand(cmd int, pk *pulseKey) ([]byte, error) {
+	v, ok := n.applications.Load(applicationId(pk.application))
+	if !ok || v.(*application).name != pk.application {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownApplication, pk.application)
+	}
+	handler := v.(*application).commandHandler.Load()
+	if handler == nil || *handler == nil {
+		return nil, fmt.Errorf("%w: %s for %s", errUnsupportedCommand, commandName(cmd), pk.application)
+	}
+	return (*handler)(cmd, pk.key, pk.value)
+}
@@ -0,0 +1,202 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialPulse connects to the node listening on addr like the CLI does and returns the connection after HELLO.
+func dialPulse(t *testing.T, memory *MemoryNetwork, addr string) net.Conn {
+	t.Helper()
+	conn, err := memory.Transport("pulse").Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	hello, err := Pack(int(HELLO), []byte("CLI"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Command != int(HELLO) || string(p.Data) != addr {
+		t.Fatalf("Expected HELLO from %s, got %s %q", addr, commandName(p.Command), p.Data)
+	}
+	return conn
+}
+
+func pulseCommand(t *testing.T, conn net.Conn, cmd int, data []byte, token string) *Packet {
+	t.Helper()
+	packet, err := Pack(cmd, data, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPulsePacketRoundTrip(t *testing.T) {
+	packet, err := Pack(SET, []byte("key value"), godToken.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPacket(bytes.NewReader(packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Command != SET || p.Token != godToken.token || string(p.Data) != "key value" {
+		t.Fatalf("Unexpected packet %+v", p)
+	}
+
+	if _, err := ReadPacket(bytes.NewReader([]byte{1, 0, 0})); !errors.Is(err, errPulsePacket) {
+		t.Errorf("Expected packet without magic to be rejected, got %v", err)
+	}
+	if _, err := Pack(ID, make([]byte, maxPulseData+1), ""); !errors.Is(err, errPulsePacket) {
+		t.Errorf("Expected oversized packet to be rejected, got %v", err)
+	}
+}
+
+func TestPulseCommands(t *testing.T) {
+	memory := NewMemoryNetwork()
+	n := newMemoryNode(t, memory, "a")
+	conn := dialPulse(t, memory, "a")
+
+	if p := pulseCommand(t, conn, ID, nil, ""); p.Command != ERROR {
+		t.Errorf("Expected ID to be denied anonymously, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, ID, nil, godToken.token); p.Command != ID || string(p.Data) != "a" {
+		t.Errorf("Expected node ID, got %s %q", commandName(p.Command), p.Data)
+	}
+	app, err := n.RegisterApplication("cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string][]byte{}
+	app.SetCommandHandler(func(command int, key string, value []byte) ([]byte, error) {
+		if command == SET {
+			values[key] = value
+			return []byte("OK"), nil
+		}
+		return values[key], nil
+	})
+	if p := pulseCommand(t, conn, SET, []byte("cache user-1 alice smith"), godToken.token); p.Command != SET || string(p.Data) != "OK" {
+		t.Errorf("Expected SET to be answered by the application, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, GET, []byte("cache user-1"), ""); p.Command != GET || string(p.Data) != "alice smith" {
+		t.Errorf("Expected GET to return the value, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, SET, []byte("ledger user-1 alice"), godToken.token); p.Command != ERROR {
+		t.Errorf("Expected SET of an unknown application to fail, got %s %q", commandName(p.Command), p.Data)
+	}
+
+	p := pulseCommand(t, conn, AUDIT, []byte("10"), godToken.token)
+	if p.Command != AUDIT {
+		t.Fatalf("Expected audit entries, got %s %q", commandName(p.Command), p.Data)
+	}
+	var outcomes []auditOutcome
+	var entries []auditEntry
+	for _, line := range bytes.Split(bytes.TrimSpace(p.Data), []byte("\n")) {
+		e := auditEntry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(e.RemoteAddr, "pulse") {
+			t.Errorf("Expected entry of remote pulse, got %+v", e)
+		}
+		outcomes = append(outcomes, e.Outcome)
+		entries = append(entries, e)
+	}
+	// ID denied, ID allowed, SET allowed, SET of an unknown application allowed and failed, the AUDIT command itself
+	want := []auditOutcome{AUDIT_DENIED, AUDIT_ALLOWED, AUDIT_ALLOWED, AUDIT_ALLOWED, AUDIT_FAILED, AUDIT_ALLOWED}
+	if len(outcomes) != len(want) {
+		t.Fatalf("Expected outcomes %v, got %v", want, outcomes)
+	}
+	for i := range want {
+		if outcomes[i] != want[i] {
+			t.Fatalf("Expected outcomes %v, got %v", want, outcomes)
+		}
+	}
+	if set := entries[2]; set.Command != "SET" || set.ApplicationID != applicationId("cache") || set.Key != "user-1" {
+		t.Errorf("Expected SET of user-1 in cache to be audited, got %+v", set)
+	}
+	if failed := entries[4]; failed.ApplicationID != applicationId("ledger") || failed.Key != "user-1" || failed.Error == "" {
+		t.Errorf("Expected the failed SET with its application and key, got %+v", failed)
+	}
+
+	exit, _ := Pack(EXIT, nil, "")
+	if _, err := conn.Write(exit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EXIT to close the connection, got %v", err)
+	}
+	if len(n.Peers()) != 0 {
+		t.Error("Expected the pulse connection not to become a peer")
+	}
+}
+
+func TestPulseRotateRetire(t *testing.T) {
+	memory := NewMemoryNetwork()
+	n := newMemoryNode(t, memory, "a")
+	conn := dialPulse(t, memory, "a")
+
+	if p := pulseCommand(t, conn, ROTATE, []byte("fresh"), godToken.token); p.Command != ROTATE {
+		t.Fatalf("Expected ROTATE to succeed, got %s %q", commandName(p.Command), p.Data)
+	}
+	if n.keyring.primarySecret() != "fresh" {
+		t.Errorf("Expected primary secret to be fresh, got %s", n.keyring.primarySecret())
+	}
+	if p := pulseCommand(t, conn, RETIRE, []byte("fresh"), godToken.token); p.Command != ERROR {
+		t.Errorf("Expected retiring the primary secret to fail, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, RETIRE, []byte("unknown"), godToken.token); p.Command != ERROR {
+		t.Errorf("Expected retiring an unknown secret to fail, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, RETIRE, []byte("secret"), godToken.token); p.Command != RETIRE {
+		t.Fatalf("Expected RETIRE to succeed, got %s %q", commandName(p.Command), p.Data)
+	}
+	if n.keyring.accepts("secret") {
+		t.Error("Expected the retired secret to be rejected")
+	}
+	if p := pulseCommand(t, conn, ROTATE, []byte("other"), ""); p.Command != ERROR {
+		t.Errorf("Expected ROTATE to be denied anonymously, got %s %q", commandName(p.Command), p.Data)
+	}
+}
+
+func TestPulseChaos(t *testing.T) {
+	memory := NewMemoryNetwork()
+	chaos := NewChaos(1)
+	newTransportNode(t, "a", chaos.Transport(memory.Transport("a"), "a"))
+	conn := dialPulse(t, memory, "a")
+
+	p := pulseCommand(t, conn, CHAOS, []byte("partition a b"), godToken.token)
+	if p.Command != CHAOS || !strings.Contains(string(p.Data), "partition a b") {
+		t.Fatalf("Expected the partition in the chaos status, got %s %q", commandName(p.Command), p.Data)
+	}
+	if p := pulseCommand(t, conn, CHAOS, []byte("heal"), ""); p.Command != ERROR {
+		t.Errorf("Expected CHAOS to be denied anonymously, got %s %q", commandName(p.Command), p.Data)
+	}
+	if !strings.Contains(chaos.Status(), "partition a b") {
+		t.Error("Expected the denied command not to heal the partition")
+	}
+}
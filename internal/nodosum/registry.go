@@ -5,35 +5,110 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"sync/atomic"
 )
 
 type nodeConn struct {
-	connId    uint32
-	addr      net.Addr
-	ctx       context.Context
-	cancel    context.CancelFunc
-	conn      net.Conn
-	readChan  chan any
-	writeChan chan any
+	connId   uint32
+	nodeId   string
+	addr     net.Addr
+	identity string
+	roles    []string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conn     net.Conn
+	readChan chan any
+	// queue holds the frames waiting for the write loop
+	queue *sendQueue
+	// outbound is set if this node dialed the connection
+	outbound bool
+	// stripe is the index of the connection among all connections to the same node
+	stripe uint8
+	// maxFrameSize is the largest frame both ends accept, 0 if unlimited
+	maxFrameSize int
+	// compression is the algorithm payloads to this node are compressed with, negotiated in the handshake
+	compression int
+	// epoch identifies the process on the other end, announced in the handshake
+	epoch uint64
+	// drops counts frames dropped because the send queue was full
+	drops atomic.Uint64
+	// lastSeen is the unix nano time bytes were last read, rtt the smoothed heartbeat round trip time
+	lastSeen atomic.Int64
+	rtt      atomic.Int64
+
+	// frameLimiter and byteLimiter limit inbound traffic, nil if unlimited
+	frameLimiter *rateLimiter
+	byteLimiter  *rateLimiter
 }
 
-func (n *Nodosum) createConnChannel(id uint32, conn net.Conn) {
+func (n *Nodosum) createConnChannel(id uint32, peer *hello, outbound bool, conn net.Conn) {
 	ctx, cancel := context.WithCancel(n.ctx)
+	identity := peerIdentity(conn)
+
+	// Both ends agree on the smaller maximum frame size, 0 is unlimited
+	maxFrameSize := n.maxFrameSize
+	if peer.maxFrameSize > 0 && (maxFrameSize <= 0 || int(peer.maxFrameSize) < maxFrameSize) {
+		maxFrameSize = int(peer.maxFrameSize)
+	}
+
+	nc := &nodeConn{
+		connId:       id,
+		nodeId:       peer.nodeId,
+		outbound:     outbound,
+		stripe:       peer.stripe,
+		addr:         conn.RemoteAddr(),
+		identity:     identity,
+		roles:        n.peerRoles[identity],
+		conn:         conn,
+		ctx:          ctx,
+		cancel:       cancel,
+		readChan:     n.globalReadChannel,
+		queue:        newSendQueue(n.sendQueueSize, n.applicationWeight),
+		maxFrameSize: maxFrameSize,
+		compression:  n.connCompression(peer.compression),
+		epoch:        peer.epoch,
+
+		frameLimiter: newRateLimiter(n.connFrameRate, n.clock),
+		byteLimiter:  newRateLimiter(n.connByteRate, n.clock),
+	}
+	nc.lastSeen.Store(n.clock.Now().UnixNano())
+	n.connections.Store(id, nc)
+}
+
+// nodeIdOf returns the ID of the node on the other end of a connection.
+func (n *Nodosum) nodeIdOf(connId uint32) string {
+	v, ok := n.connections.Load(connId)
+	if !ok || v == nil {
+		return ""
+	}
+	return v.(*nodeConn).nodeId
+}
+
+// nodeConnection returns the connection to the node with the given id, the one with the lowest stripe if there are several.
+func (n *Nodosum) nodeConnection(nodeId string) (*nodeConn, bool) {
+	conns := n.nodeConnections(nodeId)
+	if len(conns) == 0 {
+		return nil, false
+	}
+	return conns[0], true
+}
 
-	n.connections.Store(id, &nodeConn{
-		connId:    id,
-		addr:      conn.RemoteAddr(),
-		conn:      conn,
-		ctx:       ctx,
-		cancel:    cancel,
-		readChan:  n.globalReadChannel,
-		writeChan: make(chan any),
+// connectedNodes returns the IDs of all nodes with an established connection.
+func (n *Nodosum) connectedNodes() []string {
+	var ids []string
+	n.connections.Range(func(k, v any) bool {
+		if nc, ok := v.(*nodeConn); ok && nc.nodeId != "" && !slices.Contains(ids, nc.nodeId) {
+			ids = append(ids, nc.nodeId)
+		}
+		return true
 	})
+	return ids
 }
 
 func (n *Nodosum) closeConnChannel(id uint32) {
 	n.logger.Debug(fmt.Sprintf("closing connection channel for %d", id))
-	c, ok := n.connections.Load(id)
+	c, ok := n.connections.LoadAndDelete(id)
 	if ok {
 		conn := c.(*nodeConn)
 		conn.cancel()
@@ -41,6 +116,14 @@ func (n *Nodosum) closeConnChannel(id uint32) {
 		if err != nil && !errors.Is(err, net.ErrClosed) {
 			n.logger.Error("error closing comms channels for", "error", err.Error())
 		}
+		// Only inbound connections were admitted
+		if !conn.outbound {
+			n.admission.release(conn.addr)
+		}
+		n.failPendingCalls(conn.nodeId)
+		n.resetStreams(conn.nodeId)
+		if _, connected := n.nodeConnection(conn.nodeId); !connected {
+			n.remoteApplications.Delete(conn.nodeId)
+		}
 	}
-	n.connections.Delete(id)
 }
@@ -0,0 +1,319 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+Request/response on top of the Application API.
+
+A request is an APP frame with an EXT_RPC extension carrying a correlation id, unique per requesting node.
+The time left until the context deadline of the caller is sent along as EXT_DEADLINE, relative so
+clocks of both nodes do not have to agree. The handler on the remote node runs with a context
+expiring after that timeout. If the caller gives up before a response arrived,
+an RPC_CANCEL frame cancels the handlers context.
+
+At most MaxConcurrentRequests handlers run at the same time on a node, further requests are answered
+with RPC_ERROR right away.
+
+The handler answers with RPC_RESPONSE carrying the returned payload or RPC_ERROR carrying the error message.
+Requests for an application that is not registered on the node are answered with RPC_ERROR as well.
+
+RPC extension value (9 bytes):
+	uint64 correlation id | uint8 kind
+
+Deadline extension value (8 bytes):
+	uint64 timeout in nanoseconds
+*/
+
+const (
+	RPC_REQUEST uint8 = iota + 1
+	RPC_RESPONSE
+	RPC_ERROR
+	RPC_CANCEL
+)
+
+const rpcHeaderSize = 9
+
+// DEFAULT_MAX_CONCURRENT_REQUESTS is the number of request handlers running at the same time by default
+const DEFAULT_MAX_CONCURRENT_REQUESTS = 256
+
+var (
+	// ErrRequestTimeout is returned by Request if the context expired before a response arrived.
+	ErrRequestTimeout = errors.New("request timed out")
+	// ErrNodeUnreachable is returned by Request if there is no connection to the node or it dropped.
+	ErrNodeUnreachable  = errors.New("node unreachable")
+	errNoRequestHandler = errors.New("application has no request handler")
+	errTooManyRequests  = errors.New("too many concurrent requests")
+)
+
+// RemoteError is returned by Request if the handler on the remote node failed.
+type RemoteError struct {
+	NodeId  string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote handler on %s failed: %s", e.NodeId, e.Message)
+}
+
+// rpcErrors are the errors a node answers requests with itself, a RemoteError with their message wraps them.
+var rpcErrors = []error{ErrUnknownApplication, errNoRequestHandler, errTooManyRequests}
+
+func (e *RemoteError) Unwrap() error {
+	for _, err := range rpcErrors {
+		if e.Message == err.Error() {
+			return err
+		}
+	}
+	return nil
+}
+
+type rpcHeader struct {
+	id   uint64
+	kind uint8
+}
+
+func encodeRpcHeader(rh *rpcHeader) []byte {
+	buf := make([]byte, rpcHeaderSize)
+	binary.LittleEndian.PutUint64(buf[0:8], rh.id)
+	buf[8] = rh.kind
+	return buf
+}
+
+func decodeRpcHeader(b []byte) (*rpcHeader, error) {
+	if len(b) != rpcHeaderSize {
+		return nil, errors.New("invalid rpc extension")
+	}
+	return &rpcHeader{
+		id:   binary.LittleEndian.Uint64(b[0:8]),
+		kind: b[8],
+	}, nil
+}
+
+func encodeTimeout(d time.Duration) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(max(d, 0)))
+	return buf
+}
+
+func decodeTimeout(b []byte) (time.Duration, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	d := binary.LittleEndian.Uint64(b)
+	if d > math.MaxInt64 {
+		return 0, false
+	}
+	return time.Duration(d), true
+}
+
+type rpcResult struct {
+	payload []byte
+	err     error
+}
+
+type pendingCall struct {
+	nodeId string
+	result chan rpcResult
+}
+
+type handlingKey struct {
+	nodeId string
+	id     uint64
+}
+
+func (n *Nodosum) sendRpc(ctx context.Context, app *application, nodeId string, rh *rpcHeader, deadline time.Time, payload []byte, policy int) error {
+	exts := []frameExtension{{Type: EXT_RPC, Value: encodeRpcHeader(rh)}}
+	if !deadline.IsZero() {
+		exts = append(exts, frameExtension{Type: EXT_DEADLINE, Value: encodeTimeout(time.Until(deadline))})
+	}
+
+	dataPack := &dataPackage{
+		id:             app.id,
+		payload:        payload,
+		receivingNodes: []string{nodeId},
+		uncompressed:   app.uncompressed.Load(),
+		extensions:     exts,
+		queuePolicy:    policy,
+	}
+
+	return n.send(ctx, dataPack)
+}
+
+// request sends payload to the application on nodeId and waits for the response of its request handler.
+func (n *Nodosum) request(ctx context.Context, app *application, nodeId string, payload []byte) ([]byte, error) {
+	if _, ok := n.nodeConnection(nodeId); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNodeUnreachable, nodeId)
+	}
+
+	id := n.rpcIds.Add(1)
+	call := &pendingCall{nodeId: nodeId, result: make(chan rpcResult, 1)}
+	n.rpcCalls.Store(id, call)
+	defer n.rpcCalls.Delete(id)
+
+	deadline, _ := ctx.Deadline()
+	err := n.sendRpc(ctx, app, nodeId, &rpcHeader{id: id, kind: RPC_REQUEST}, deadline, payload, SEND_QUEUE_BLOCK)
+	if err != nil {
+		return nil, requestContextError(err)
+	}
+
+	select {
+	case res := <-call.result:
+		return res.payload, res.err
+	case <-ctx.Done():
+		_ = n.sendRpc(n.ctx, app, nodeId, &rpcHeader{id: id, kind: RPC_CANCEL}, time.Time{}, nil, SEND_QUEUE_BLOCK)
+		return nil, requestContextError(ctx.Err())
+	case <-n.ctx.Done():
+		return nil, n.ctx.Err()
+	}
+}
+
+func requestContextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrRequestTimeout, err)
+	}
+	return err
+}
+
+// failPendingCalls fails all requests waiting for a response from nodeId, used when its connection dropped.
+func (n *Nodosum) failPendingCalls(nodeId string) {
+	n.rpcCalls.Range(func(k, v any) bool {
+		call := v.(*pendingCall)
+		if call.nodeId == nodeId {
+			select {
+			case call.result <- rpcResult{err: fmt.Errorf("%w: %s", ErrNodeUnreachable, nodeId)}:
+			default:
+			}
+		}
+		return true
+	})
+}
+
+// handleRpcFrame handles inbound requests, responses and cancellations.
+func (n *Nodosum) handleRpcFrame(connId uint32, app *application, header *frameHeader, payload []byte) {
+	value, _ := header.extension(EXT_RPC)
+	rh, err := decodeRpcHeader(value)
+	if err != nil {
+		n.logger.Error("error decoding rpc extension", "error", err.Error(), "application", app.id, "conn", connId)
+		return
+	}
+	nodeId := n.nodeIdOf(connId)
+
+	switch rh.kind {
+	case RPC_RESPONSE, RPC_ERROR:
+		v, ok := n.rpcCalls.Load(rh.id)
+		if !ok {
+			return
+		}
+		call := v.(*pendingCall)
+		if call.nodeId != nodeId {
+			return
+		}
+		res := rpcResult{payload: payload}
+		if rh.kind == RPC_ERROR {
+			res = rpcResult{err: &RemoteError{NodeId: nodeId, Message: string(payload)}}
+		}
+		select {
+		case call.result <- res:
+		default:
+		}
+	case RPC_CANCEL:
+		v, ok := n.rpcHandling.Load(handlingKey{nodeId: nodeId, id: rh.id})
+		if ok {
+			v.(context.CancelFunc)()
+		}
+	case RPC_REQUEST:
+		n.handleRequest(app, nodeId, rh.id, header, payload)
+	}
+}
+
+// rejectUnknownApplication answers a request for an application that is not registered on this node,
+// so the caller does not wait for a response that never comes. Only the first fragment of a request is answered.
+func (n *Nodosum) rejectUnknownApplication(connId uint32, header *frameHeader) {
+	value, ok := header.extension(EXT_RPC)
+	if !ok {
+		return
+	}
+	rh, err := decodeRpcHeader(value)
+	if err != nil || rh.kind != RPC_REQUEST {
+		return
+	}
+	if header.Flag&FRAGMENTED != 0 {
+		value, _ := header.extension(EXT_FRAGMENT)
+		if fi, err := decodeFragmentInfo(value); err != nil || fi.index != 0 {
+			return
+		}
+	}
+
+	// The multiplexer must not wait for a full send queue, the caller times out if the rejection is dropped
+	nodeId := n.nodeIdOf(connId)
+	app := &application{id: header.ApplicationID}
+	rh = &rpcHeader{id: rh.id, kind: RPC_ERROR}
+	err = n.sendRpc(n.ctx, app, nodeId, rh, time.Time{}, []byte(ErrUnknownApplication.Error()), SEND_QUEUE_DROP_NEWEST)
+	if err != nil && !errors.Is(err, errFrameDropped) {
+		n.logger.Error("error rejecting request", "error", err.Error(), "application", header.ApplicationID, "node", nodeId)
+	}
+}
+
+// requestContext derives the context of a handler from the node, expiring after the timeout sent by the caller.
+func (n *Nodosum) requestContext(header *frameHeader) (context.Context, context.CancelFunc) {
+	if value, ok := header.extension(EXT_DEADLINE); ok {
+		if timeout, ok := decodeTimeout(value); ok {
+			return context.WithTimeout(n.ctx, timeout)
+		}
+	}
+	return context.WithCancel(n.ctx)
+}
+
+func (n *Nodosum) handleRequest(app *application, nodeId string, id uint64, header *frameHeader, payload []byte) {
+	select {
+	case n.rpcSlots <- struct{}{}:
+	default:
+		// The multiplexer must not wait for a full send queue, the caller times out if the rejection is dropped
+		rh := &rpcHeader{id: id, kind: RPC_ERROR}
+		err := n.sendRpc(n.ctx, app, nodeId, rh, time.Time{}, []byte(errTooManyRequests.Error()), SEND_QUEUE_DROP_NEWEST)
+		if err != nil && !errors.Is(err, errFrameDropped) {
+			n.logger.Error("error rejecting request", "error", err.Error(), "application", app.id, "node", nodeId)
+		}
+		return
+	}
+
+	ctx, cancel := n.requestContext(header)
+
+	key := handlingKey{nodeId: nodeId, id: id}
+	n.rpcHandling.Store(key, cancel)
+
+	n.wg.Go(func() {
+		defer func() { <-n.rpcSlots }()
+		defer cancel()
+		defer n.rpcHandling.Delete(key)
+
+		handler := app.requestHandler.Load()
+		var response []byte
+		err := errNoRequestHandler
+		if handler != nil && *handler != nil {
+			response, err = (*handler)(ctx, payload)
+		}
+
+		// The caller already gave up, there is nobody to answer
+		if ctx.Err() != nil {
+			return
+		}
+
+		rh := &rpcHeader{id: id, kind: RPC_RESPONSE}
+		if err != nil {
+			rh.kind = RPC_ERROR
+			response = []byte(err.Error())
+		}
+		err = n.sendRpc(ctx, app, nodeId, rh, time.Time{}, response, SEND_QUEUE_BLOCK)
+		if err != nil {
+			n.logger.Error("error sending rpc response", "error", err.Error(), "application", app.id, "node", nodeId)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRequestResponse(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appB.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+		return append([]byte("re: "), payload...), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Large enough to be fragmented, the correlation id has to survive reassembly
+	payload := bytes.Repeat([]byte("x"), 3*DEFAULT_FRAGMENT_SIZE)
+	res, err := appA.Request(ctx, "b", payload)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if !bytes.Equal(res, append([]byte("re: "), payload...)) {
+		t.Fatalf("unexpected response of %d bytes", len(res))
+	}
+}
+
+func TestRequestRemoteError(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appB.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := appA.Request(ctx, "b", []byte("hi"))
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("expected RemoteError, got %v", err)
+	}
+	if remote.NodeId != "b" || remote.Message != "boom" {
+		t.Fatalf("unexpected remote error %+v", remote)
+	}
+
+	// Without a handler the remote side answers with an error too
+	appB.SetRequestHandler(nil)
+	_, err = appA.Request(ctx, "b", []byte("hi"))
+	if !errors.As(err, &remote) {
+		t.Fatalf("expected RemoteError without handler, got %v", err)
+	}
+}
+
+func TestRequestUnknownApplication(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appB.nodosum.applications.Delete(appB.id)
+
+	// Without a deadline the caller depends on the rejection, fragmented requests are rejected once
+	for _, payload := range [][]byte{[]byte("hi"), bytes.Repeat([]byte("x"), 3*DEFAULT_FRAGMENT_SIZE)} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := appA.Request(context.Background(), "b", payload)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			var remote *RemoteError
+			if !errors.As(err, &remote) || !errors.Is(err, ErrUnknownApplication) {
+				t.Fatalf("expected ErrUnknownApplication from b, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected request to an unknown application to be answered")
+		}
+	}
+}
+
+func TestRequestTimeoutCancelsHandler(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	handlerDone := make(chan error, 1)
+	appB.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			handlerDone <- errors.New("deadline not propagated")
+			return nil, nil
+		}
+		<-ctx.Done()
+		handlerDone <- nil
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := appA.Request(ctx, "b", []byte("slow"))
+	if !errors.Is(err, ErrRequestTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+
+	select {
+	case err := <-handlerDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote handler was not cancelled")
+	}
+}
+
+func TestRequestUnreachable(t *testing.T) {
+	appA, _ := newStreamTestPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := appA.Request(ctx, "c", []byte("hi"))
+	if !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("expected ErrNodeUnreachable, got %v", err)
+	}
+}
+
+func TestPendingCallsFailOnDisconnect(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	started := make(chan struct{})
+	appB.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		<-started
+		appA.nodosum.failPendingCalls("b")
+	}()
+
+	_, err := appA.Request(ctx, "b", []byte("hi"))
+	if !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("expected ErrNodeUnreachable, got %v", err)
+	}
+}
+
+func TestRequestHandlersBounded(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	appB.nodosum.rpcSlots = make(chan struct{}, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	appB.SetRequestHandler(func(ctx context.Context, payload []byte) ([]byte, error) {
+		close(started)
+		<-release
+		return payload, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := appA.Request(ctx, "b", []byte("first"))
+		first <- err
+	}()
+	<-started
+
+	_, err := appA.Request(ctx, "b", []byte("second"))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != errTooManyRequests.Error() {
+		t.Fatalf("expected the request beyond the limit to be rejected, got %v", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Fatalf("expected the running request to complete, got %v", err)
+	}
+}
+
+func TestRequestTimeoutIsRelative(t *testing.T) {
+	n := &Nodosum{ctx: context.Background()}
+	header := &frameHeader{Extensions: []frameExtension{{Type: EXT_DEADLINE, Value: encodeTimeout(time.Minute)}}}
+	ctx, cancel := n.requestContext(header)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Minute || time.Until(deadline) < 50*time.Second {
+		t.Fatalf("expected the handler to expire in a minute, got %v", deadline)
+	}
+}
@@ -0,0 +1,245 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"sync"
+)
+
+/*
+Write scheduling
+
+The send queue of a connection holds one queue for SYSTEM frames and one per application.
+SYSTEM frames like acknowledgements and heartbeats have strict priority, they are written
+as soon as the frame in flight is done, no matter how much application traffic is queued.
+
+Applications share the rest with deficit round robin: every application queue gets
+schedulerQuantum bytes times the weight of its application per round, so a bulk transfer
+gets its share of the connection without delaying small messages of other applications
+by more than one round.
+
+Every queue is bounded by the send queue size on its own, a full queue only affects its application.
+SEND_QUEUE_DROP_OLDEST only evicts frames queued with that policy that hold a whole message,
+fragments, streams, blobs and requests are never evicted. Without such a frame the new one is dropped instead.
+*/
+
+// schedulerQuantum is the number of bytes an application with weight 1 may write per round
+const schedulerQuantum = 16 * 1024
+
+const (
+	// writeBatchFrames and writeBatchBytes limit the frames coalesced into a single write
+	writeBatchFrames = 64
+	writeBatchBytes  = 256 * 1024
+)
+
+// queuedFrame is a frame waiting in the queue of an application.
+type queuedFrame struct {
+	frame []byte
+	// evictable is set for unfragmented messages queued with SEND_QUEUE_DROP_OLDEST
+	evictable bool
+}
+
+type appQueue struct {
+	id      uint32
+	frames  []queuedFrame
+	deficit int
+	// active is set while the queue is part of the round robin
+	active bool
+}
+
+type sendQueue struct {
+	mu     sync.Mutex
+	size   int
+	system [][]byte
+	apps   map[uint32]*appQueue
+	// active holds the application queues with frames in round robin order
+	active []*appQueue
+	// credited is set once the queue at the head of active got its quantum for the current round
+	credited bool
+	length   int
+	// weightOf returns the scheduling weight of an application
+	weightOf func(applicationId uint32) int
+	// ready is signalled when frames are queued
+	ready chan struct{}
+	// space is closed and replaced when a frame is taken from the queue while senders wait for space
+	space   chan struct{}
+	waiting bool
+}
+
+func newSendQueue(size int, weightOf func(applicationId uint32) int) *sendQueue {
+	return &sendQueue{
+		size:     size,
+		apps:     make(map[uint32]*appQueue),
+		weightOf: weightOf,
+		ready:    make(chan struct{}, 1),
+		space:    make(chan struct{}),
+	}
+}
+
+// push queues a frame according to the overflow policy, it returns the number of frames dropped.
+// Frames are classified by their header, SYSTEM frames go to the priority queue.
+// If the frame itself is dropped, it fails with errFrameDropped.
+func (q *sendQueue) push(ctx context.Context, done <-chan struct{}, frame []byte, policy int) (int, error) {
+	system := messageType(frame[5]) == SYSTEM
+	applicationId := binary.LittleEndian.Uint32(frame[1:5])
+	evictable := !system && policy == SEND_QUEUE_DROP_OLDEST && headerFlags(frame)&FRAGMENTED == 0
+
+	for {
+		q.mu.Lock()
+		var aq *appQueue
+		queued := len(q.system)
+		if !system {
+			var ok bool
+			aq, ok = q.apps[applicationId]
+			if !ok {
+				aq = &appQueue{id: applicationId}
+				q.apps[applicationId] = aq
+			}
+			queued = len(aq.frames)
+		}
+
+		dropped := 0
+		if queued >= q.size {
+			switch policy {
+			case SEND_QUEUE_DROP_NEWEST:
+				q.mu.Unlock()
+				return 1, errFrameDropped
+			case SEND_QUEUE_ERROR:
+				q.mu.Unlock()
+				return 0, ErrSendQueueFull
+			case SEND_QUEUE_DROP_OLDEST:
+				if aq == nil || !aq.evictOldest() {
+					q.mu.Unlock()
+					return 1, errFrameDropped
+				}
+				q.length--
+				dropped = 1
+			default:
+				space := q.space
+				q.waiting = true
+				q.mu.Unlock()
+				select {
+				case <-space:
+					continue
+				case <-done:
+					return 0, ErrNodeUnreachable
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				}
+			}
+		}
+
+		if system {
+			q.system = append(q.system, frame)
+		} else {
+			aq.frames = append(aq.frames, queuedFrame{frame: frame, evictable: evictable})
+		}
+		q.length++
+		if aq != nil && !aq.active {
+			aq.active = true
+			q.active = append(q.active, aq)
+		}
+		q.mu.Unlock()
+
+		select {
+		case q.ready <- struct{}{}:
+		default:
+		}
+		return dropped, nil
+	}
+}
+
+// evictOldest removes the oldest evictable frame, it returns false if there is none.
+func (aq *appQueue) evictOldest() bool {
+	for i, qf := range aq.frames {
+		if qf.evictable {
+			aq.frames = slices.Delete(aq.frames, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// pop takes the next frame to write, SYSTEM frames first, then applications by deficit round robin.
+func (q *sendQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.next()
+}
+
+// popBatch appends up to maxFrames frames, together at most maxBytes unless the first is bigger, to batch.
+func (q *sendQueue) popBatch(batch [][]byte, maxFrames int, maxBytes int) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := 0
+	for len(batch) < maxFrames && size < maxBytes {
+		frame, ok := q.next()
+		if !ok {
+			break
+		}
+		batch = append(batch, frame)
+		size += len(frame)
+	}
+	return batch
+}
+
+func (q *sendQueue) next() ([]byte, bool) {
+	if q.length == 0 {
+		return nil, false
+	}
+	defer q.freeSpace()
+
+	if len(q.system) > 0 {
+		frame := q.system[0]
+		q.system = q.system[1:]
+		q.length--
+		return frame, true
+	}
+
+	for {
+		aq := q.active[0]
+		if !q.credited {
+			weight := 1
+			if q.weightOf != nil {
+				weight = max(q.weightOf(aq.id), 1)
+			}
+			aq.deficit += schedulerQuantum * weight
+			q.credited = true
+		}
+
+		frame := aq.frames[0].frame
+		if len(frame) <= aq.deficit {
+			aq.frames = aq.frames[1:]
+			aq.deficit -= len(frame)
+			q.length--
+			if len(aq.frames) == 0 {
+				aq.deficit = 0
+				aq.active = false
+				q.active = q.active[1:]
+				q.credited = false
+			}
+			return frame, true
+		}
+
+		// Out of credit, the next application gets its turn
+		q.active = append(q.active[1:], aq)
+		q.credited = false
+	}
+}
+
+func (q *sendQueue) freeSpace() {
+	if !q.waiting {
+		return
+	}
+	close(q.space)
+	q.space = make(chan struct{})
+	q.waiting = false
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.length
+}
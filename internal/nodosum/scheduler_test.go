@@ -0,0 +1,120 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func testFrame(t messageType, applicationId uint32, size int) []byte {
+	fh := frameHeader{Version: PROTOCOL_VERSION, ApplicationID: applicationId, Type: t, Length: uint32(size)}
+	return append(encodeFrameHeader(&fh), make([]byte, size)...)
+}
+
+func pushFrame(t *testing.T, q *sendQueue, frame []byte) {
+	t.Helper()
+	if _, err := q.push(context.Background(), nil, frame, SEND_QUEUE_ERROR); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSchedulerSystemFirst(t *testing.T) {
+	q := newSendQueue(16, nil)
+	for range 10 {
+		pushFrame(t, q, testFrame(APP, 1, 64*1024))
+	}
+	pushFrame(t, q, testFrame(SYSTEM, 0, 8))
+
+	frame, _ := q.pop()
+	if messageType(frame[5]) != SYSTEM {
+		t.Fatal("Expected SYSTEM frame to overtake queued application frames")
+	}
+	if q.len() != 10 {
+		t.Fatalf("Expected 10 frames left, got %d", q.len())
+	}
+}
+
+func TestSchedulerWeightedFairness(t *testing.T) {
+	weights := map[uint32]int{1: 3, 2: 1}
+	q := newSendQueue(1024, func(id uint32) int { return weights[id] })
+
+	// Frames of exactly 4kb on the wire, so a quantum fits 4 of them
+	for range 400 {
+		pushFrame(t, q, testFrame(APP, 1, 4*1024-frameHeaderSize))
+		pushFrame(t, q, testFrame(APP, 2, 4*1024-frameHeaderSize))
+	}
+
+	written := map[uint32]int{}
+	for range 400 {
+		frame, _ := q.pop()
+		decoded := decodeFrameHeader(frame)
+		written[decoded.ApplicationID]++
+	}
+
+	if written[1] != 3*written[2] {
+		t.Fatalf("Expected a 3:1 share, got %d:%d", written[1], written[2])
+	}
+}
+
+func TestSchedulerSmallMessageNotStuckBehindBulk(t *testing.T) {
+	q := newSendQueue(1024, nil)
+	for range 100 {
+		pushFrame(t, q, testFrame(APP, 1, 64*1024))
+	}
+	pushFrame(t, q, testFrame(APP, 2, 100))
+
+	for range 3 {
+		frame, _ := q.pop()
+		if decodeFrameHeader(frame).ApplicationID == 2 {
+			return
+		}
+	}
+	t.Fatal("Expected small message to be written within one round")
+}
+
+func TestSchedulerQueuesBoundedPerApplication(t *testing.T) {
+	q := newSendQueue(2, nil)
+	pushFrame(t, q, testFrame(APP, 1, 8))
+	pushFrame(t, q, testFrame(APP, 1, 8))
+
+	if _, err := q.push(context.Background(), nil, testFrame(APP, 1, 8), SEND_QUEUE_ERROR); err == nil {
+		t.Fatal("Expected full application queue to reject frame")
+	}
+	pushFrame(t, q, testFrame(APP, 2, 8))
+	pushFrame(t, q, testFrame(SYSTEM, 0, 8))
+
+	if q.len() != 4 {
+		t.Fatalf("Expected 4 queued frames, got %d", q.len())
+	}
+}
+
+func TestSchedulerDropOldestOnlyEvictsWholeMessages(t *testing.T) {
+	fragment := testFrame(APP, 1, 8)
+	fragment[6] |= byte(FRAGMENTED)
+
+	q := newSendQueue(2, nil)
+	if _, err := q.push(context.Background(), nil, fragment, SEND_QUEUE_DROP_OLDEST); err != nil {
+		t.Fatal(err)
+	}
+	pushFrame(t, q, testFrame(APP, 1, 8))
+	if _, err := q.push(context.Background(), nil, testFrame(APP, 1, 8), SEND_QUEUE_DROP_OLDEST); !errors.Is(err, errFrameDropped) {
+		t.Fatalf("Expected the new frame to be dropped without an evictable one queued, got %v", err)
+	}
+
+	q = newSendQueue(2, nil)
+	if _, err := q.push(context.Background(), nil, fragment, SEND_QUEUE_DROP_OLDEST); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.push(context.Background(), nil, testFrame(APP, 1, 16), SEND_QUEUE_DROP_OLDEST); err != nil {
+		t.Fatal(err)
+	}
+	dropped, err := q.push(context.Background(), nil, testFrame(APP, 1, 32), SEND_QUEUE_DROP_OLDEST)
+	if err != nil || dropped != 1 {
+		t.Fatalf("Expected the whole message to be evicted, got %d dropped and %v", dropped, err)
+	}
+	first, _ := q.pop()
+	second, _ := q.pop()
+	if headerFlags(first)&FRAGMENTED == 0 || decodeFrameHeader(second).Length != 32 {
+		t.Fatal("Expected the fragment and the new frame to stay queued")
+	}
+}
@@ -0,0 +1,118 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/*
+Bounded send queues
+
+Every connection has its own queue of encoded frames, drained by its write loop in the order of the scheduler.
+Frames are queued by the goroutine sending them, so a slow peer only holds up the senders
+writing to it and not the multiplexer or traffic to other nodes.
+
+What happens if a queue is full is decided by the overflow policy. It applies to messages sent
+with Application.Send, streams, blobs and requests always wait for space as dropping
+their frames would break them. Acknowledgements are dropped, they are cumulative and the next one covers it. Once a frame of a fragmented message is dropped, the remaining fragments
+are not queued for that node, the message could not be reassembled anyway.
+*/
+
+const (
+	// SEND_QUEUE_BLOCK waits for space in the queue until the context of the sender is done
+	SEND_QUEUE_BLOCK = iota
+	// SEND_QUEUE_DROP_OLDEST drops the oldest queued message that was not fragmented to make space
+	SEND_QUEUE_DROP_OLDEST
+	// SEND_QUEUE_DROP_NEWEST drops the message that is sent
+	SEND_QUEUE_DROP_NEWEST
+	// SEND_QUEUE_ERROR fails the send with ErrSendQueueFull
+	SEND_QUEUE_ERROR
+)
+
+const DEFAULT_SEND_QUEUE_SIZE = 1024
+
+var (
+	// ErrSendQueueFull is returned by Send with the SEND_QUEUE_ERROR policy if the queue of a receiving node is full.
+	ErrSendQueueFull = errors.New("send queue full")
+	// errFrameDropped is returned by enqueue if the frame was dropped by the queue policy, it is not an error to the sender
+	errFrameDropped = errors.New("frame dropped")
+)
+
+// enqueue queues a frame for the write loop of a connection, handling a full queue according to policy.
+func (n *Nodosum) enqueue(ctx context.Context, nc *nodeConn, frame []byte, policy int) error {
+	if nc.maxFrameSize > 0 && len(frame) > nc.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes to %s", ErrFrameTooLarge, len(frame), nc.nodeId)
+	}
+	dropped, err := nc.queue.push(ctx, nc.ctx.Done(), frame, policy)
+	if dropped > 0 {
+		nc.drops.Add(uint64(dropped))
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, nc.nodeId)
+	}
+	return nil
+}
+
+// send encodes a package and queues its frames for every receiving node.
+// Nodes without a connection are skipped, unless the package is delivered reliably.
+func (n *Nodosum) send(ctx context.Context, dataPack *dataPackage) error {
+	if dataPack.broadcast && !dataPack.reliable && n.broadcastFanout > 0 {
+		return n.broadcast(ctx, dataPack, n.broadcastFanout, n.nodeId)
+	}
+	if dataPack.reliable {
+		var errs []error
+		for _, id := range dataPack.receivingNodes {
+			errs = append(errs, n.sendReliable(ctx, dataPack, id))
+		}
+		return errors.Join(errs...)
+	}
+
+	// Payloads are encoded once per compression algorithm negotiated with the receiving nodes
+	key := dataPack.stripeKey()
+	groups := make(map[int][]*nodeConn)
+	for _, id := range dataPack.receivingNodes {
+		if nc, ok := n.nodeConnectionFor(id, key); ok {
+			groups[nc.compression] = append(groups[nc.compression], nc)
+		}
+	}
+
+	var errs []error
+	for algorithm, conns := range groups {
+		// Fragments are queued one by one so frames of other applications can be interleaved
+		for _, frame := range n.encodeFrames(dataPack, algorithm) {
+			for i, nc := range conns {
+				if nc == nil {
+					continue
+				}
+				err := n.enqueue(ctx, nc, frame, dataPack.queuePolicy)
+				if err != nil {
+					// The rest of the message is useless to this node
+					if !errors.Is(err, errFrameDropped) {
+						errs = append(errs, err)
+					}
+					conns[i] = nil
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendQueueDepth returns the number of frames waiting to be written to nodeId.
+func (n *Nodosum) SendQueueDepth(nodeId string) int {
+	depth := 0
+	for _, nc := range n.nodeConnections(nodeId) {
+		depth += nc.queue.len()
+	}
+	return depth
+}
+
+// SendQueueDrops returns the number of frames to nodeId dropped because its queue was full.
+func (n *Nodosum) SendQueueDrops(nodeId string) uint64 {
+	var drops uint64
+	for _, nc := range n.nodeConnections(nodeId) {
+		drops += nc.drops.Load()
+	}
+	return drops
+}
@@ -0,0 +1,147 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSendQueueTestNodosum(t *testing.T, size int, policy int) (*Nodosum, *application, *nodeConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	n := &Nodosum{
+		clock:              realClock{},
+		ctx:                ctx,
+		connections:        &sync.Map{},
+		violations:         &sync.Map{},
+		remoteApplications: &sync.Map{},
+		sendQueuePolicy:    policy,
+	}
+	nc := &nodeConn{connId: 1, nodeId: "b", ctx: ctx, queue: newSendQueue(size, nil)}
+	n.connections.Store(uint32(1), nc)
+	app := &application{id: 1, nodosum: n}
+	app.DisableCompression()
+	return n, app, nc
+}
+
+func queuedPayloads(t *testing.T, nc *nodeConn) []string {
+	t.Helper()
+	var payloads []string
+	for frame, ok := nc.queue.pop(); ok; frame, ok = nc.queue.pop() {
+		_, payload, err := decodeFrame(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(payload))
+	}
+	return payloads
+}
+
+func TestSendQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy int
+		want   []string
+		err    error
+		drops  uint64
+	}{
+		{"drop oldest", SEND_QUEUE_DROP_OLDEST, []string{"2", "3"}, nil, 1},
+		{"drop newest", SEND_QUEUE_DROP_NEWEST, []string{"1", "2"}, nil, 1},
+		{"error", SEND_QUEUE_ERROR, []string{"1", "2"}, ErrSendQueueFull, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, app, nc := newSendQueueTestNodosum(t, 2, tt.policy)
+
+			var err error
+			for _, p := range []string{"1", "2", "3"} {
+				err = app.Send([]byte(p), []string{"b"})
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if depth := n.SendQueueDepth("b"); depth != 2 {
+				t.Fatalf("expected queue depth 2, got %d", depth)
+			}
+			if drops := n.SendQueueDrops("b"); drops != tt.drops {
+				t.Fatalf("expected %d drops, got %d", tt.drops, drops)
+			}
+
+			got := queuedPayloads(t, nc)
+			if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+				t.Fatalf("expected queued %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSendQueueBlocksUntilContextDone(t *testing.T) {
+	_, app, nc := newSendQueueTestNodosum(t, 1, SEND_QUEUE_BLOCK)
+
+	if err := app.Send([]byte("1"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := app.SendContext(ctx, []byte("2"), []string{"b"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected send to block until the deadline, got %v", err)
+	}
+
+	// Once the write loop drained the queue the send goes through
+	nc.queue.pop()
+	if err := app.SendContext(context.Background(), []byte("3"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := queuedPayloads(t, nc); len(got) != 1 || got[0] != "3" {
+		t.Fatalf("expected only 3 queued, got %v", got)
+	}
+}
+
+func TestSendAckDoesNotWaitForFullQueue(t *testing.T) {
+	n, _, nc := newSendQueueTestNodosum(t, 1, SEND_QUEUE_BLOCK)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.sendAck(1, 1, 4)
+		n.sendAck(1, 1, 5)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the ack to be dropped instead of waiting for a full queue")
+	}
+	if drops := n.SendQueueDrops("b"); drops != 1 {
+		t.Errorf("expected 1 drop, got %d", drops)
+	}
+	if depth := nc.queue.len(); depth != 1 {
+		t.Fatalf("expected only the first ack queued, got %d frames", depth)
+	}
+}
+
+func TestSendQueueDropsRestOfFragmentedMessage(t *testing.T) {
+	n, app, nc := newSendQueueTestNodosum(t, 3, SEND_QUEUE_DROP_NEWEST)
+	n.fragmentSize = 4
+
+	if err := app.Send([]byte("x"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	// 4 fragments, the third does not fit and the fourth is useless without it
+	if err := app.Send([]byte("0123456789abcdef"), []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.SendQueueDrops("b"); drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+	nc.queue.pop()
+	nc.queue.pop()
+	if depth := n.SendQueueDepth("b"); depth != 1 {
+		t.Fatalf("expected only the second fragment left, got %d frames", depth)
+	}
+}
@@ -0,0 +1,528 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Logical streams multiplexed over the node connections.
+
+A stream belongs to an application and behaves like a net.Conn, so arbitrary protocols can be tunneled
+between cluster members. Every frame of a stream carries an EXT_STREAM extension.
+
+Flow control is windowed per stream: a sender may only have streamInitialWindow unacknowledged bytes in flight,
+the receiver hands out more window with STREAM_WINDOW frames as the application reads.
+Data frames carry their offset in the stream, so the receiver can reorder frames
+handled out of order by the multiplexer workers.
+
+CloseWrite half-closes a stream by sending STREAM_FIN with the final offset, Reset aborts both directions.
+Close half-closes the stream like CloseWrite and stops reading, data arriving afterwards is discarded.
+Data sent before Close stays readable by the remote, only Reset throws it away.
+Frames in flight are lost with a dropped connection, so all streams of a node fail with ErrNodeUnreachable
+once one of its connections closes.
+
+Stream extension value (17 bytes):
+	uint32 id | uint8 flags | uint64 offset | uint32 window increment
+*/
+
+const (
+	// STREAM_SYN opens a stream
+	STREAM_SYN uint8 = 1 << iota
+	// STREAM_FIN closes the senders direction, offset is the final offset
+	STREAM_FIN
+	// STREAM_RST aborts the stream in both directions
+	STREAM_RST
+	// STREAM_WINDOW grants the window increment to the sender
+	STREAM_WINDOW
+	// STREAM_OPENER is set on frames sent by the node that opened the stream
+	STREAM_OPENER
+)
+
+const (
+	streamControlSize   = 17
+	streamInitialWindow = 256 * 1024
+	streamMaxChunk      = 16 * 1024
+	streamAcceptBacklog = 16
+)
+
+var (
+	errStreamReset   = errors.New("stream reset")
+	errStreamClosed  = errors.New("stream closed")
+	errStreamRefused = errors.New("stream refused")
+	errStreamWindow  = errors.New("stream flow control window exceeded")
+)
+
+// Stream is a bidirectional, flow controlled byte stream to an application on another node.
+type Stream interface {
+	net.Conn
+	// CloseWrite closes the sending direction, the remote reads io.EOF once it received all data.
+	CloseWrite() error
+	// Reset aborts the stream in both directions.
+	Reset() error
+}
+
+type streamControl struct {
+	id     uint32
+	flags  uint8
+	offset uint64
+	window uint32
+}
+
+func encodeStreamControl(sc *streamControl) []byte {
+	buf := make([]byte, streamControlSize)
+	binary.LittleEndian.PutUint32(buf[0:4], sc.id)
+	buf[4] = sc.flags
+	binary.LittleEndian.PutUint64(buf[5:13], sc.offset)
+	binary.LittleEndian.PutUint32(buf[13:17], sc.window)
+	return buf
+}
+
+func decodeStreamControl(b []byte) (*streamControl, error) {
+	if len(b) != streamControlSize {
+		return nil, errors.New("invalid stream extension")
+	}
+	return &streamControl{
+		id:     binary.LittleEndian.Uint32(b[0:4]),
+		flags:  b[4],
+		offset: binary.LittleEndian.Uint64(b[5:13]),
+		window: binary.LittleEndian.Uint32(b[13:17]),
+	}, nil
+}
+
+type streamKey struct {
+	nodeId        string
+	applicationId uint32
+	id            uint32
+	// opener is true if this node opened the stream
+	opener bool
+}
+
+type streamAddr struct {
+	nodeId string
+	id     uint32
+}
+
+func (a streamAddr) Network() string { return "mycorrizal" }
+func (a streamAddr) String() string  { return fmt.Sprintf("%s/%d", a.nodeId, a.id) }
+
+type stream struct {
+	n   *Nodosum
+	app *application
+	key streamKey
+
+	mu sync.Mutex
+	// readBuf holds in order data not yet read, pending holds data received ahead of readOffset
+	readBuf    []byte
+	pending    map[uint64][]byte
+	buffered   int
+	readOffset uint64
+	finOffset  int64
+	consumed   uint32
+	// readClosed is set by Close, nothing is read or buffered afterwards
+	readClosed bool
+
+	sendOffset  uint64
+	sendWindow  int64
+	writeClosed bool
+
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+}
+
+func newStream(n *Nodosum, app *application, key streamKey) *stream {
+	return &stream{
+		n:           n,
+		app:         app,
+		key:         key,
+		pending:     make(map[uint64][]byte),
+		finOffset:   -1,
+		sendWindow:  streamInitialWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passed or the node shuts down.
+func (s *stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.n.ctx.Done():
+		return errStreamClosed
+	}
+}
+
+func (s *stream) send(ctx context.Context, flags uint8, offset uint64, window uint32, payload []byte) error {
+	if s.key.opener {
+		flags |= STREAM_OPENER
+	}
+
+	dataPack := &dataPackage{
+		id:             s.app.id,
+		payload:        payload,
+		receivingNodes: []string{s.key.nodeId},
+		uncompressed:   s.app.uncompressed.Load(),
+		stream:         &streamControl{id: s.key.id, flags: flags, offset: offset, window: window},
+	}
+
+	return s.n.send(ctx, dataPack)
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.readClosed {
+			s.mu.Unlock()
+			return 0, errStreamClosed
+		}
+		if len(s.readBuf) > 0 {
+			nr := copy(p, s.readBuf)
+			s.readBuf = s.readBuf[nr:]
+			s.buffered -= nr
+			s.consumed += uint32(nr)
+
+			var update uint32
+			if s.consumed >= streamInitialWindow/2 {
+				update, s.consumed = s.consumed, 0
+			}
+			s.mu.Unlock()
+
+			if update > 0 {
+				_ = s.send(s.n.ctx, STREAM_WINDOW, 0, update, nil)
+			}
+			return nr, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		if s.finOffset >= 0 && s.readOffset == uint64(s.finOffset) {
+			s.mu.Unlock()
+			s.removeIfDone()
+			return 0, io.EOF
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		err := s.wait(s.readNotify, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.writeClosed {
+			s.mu.Unlock()
+			return written, errStreamClosed
+		}
+		if s.sendWindow <= 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			err := s.wait(s.writeNotify, deadline)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		chunk := min(len(p)-written, streamMaxChunk, int(s.sendWindow))
+		offset := s.sendOffset
+		s.sendOffset += uint64(chunk)
+		s.sendWindow -= int64(chunk)
+		s.mu.Unlock()
+
+		data := make([]byte, chunk)
+		copy(data, p[written:written+chunk])
+		err := s.send(s.n.ctx, 0, offset, 0, data)
+		if err != nil {
+			return written, err
+		}
+		written += chunk
+	}
+	return written, nil
+}
+
+func (s *stream) CloseWrite() error {
+	s.mu.Lock()
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	if s.writeClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.writeClosed = true
+	offset := s.sendOffset
+	s.mu.Unlock()
+
+	err := s.send(s.n.ctx, STREAM_FIN, offset, 0, nil)
+	s.removeIfDone()
+	return err
+}
+
+// Close closes the sending direction gracefully and stops reading. The stream is forgotten
+// once the remote finished too, so frames still in flight are not answered with a reset.
+func (s *stream) Close() error {
+	s.mu.Lock()
+	failed := s.err != nil
+	s.mu.Unlock()
+
+	var err error
+	if !failed {
+		err = s.CloseWrite()
+	}
+
+	s.mu.Lock()
+	s.readClosed = true
+	s.readBuf = nil
+	clear(s.pending)
+	s.buffered = 0
+	s.mu.Unlock()
+	notify(s.readNotify)
+
+	if failed {
+		s.n.streams.Delete(s.key)
+		return nil
+	}
+	s.removeIfDone()
+	return err
+}
+
+func (s *stream) Reset() error {
+	s.mu.Lock()
+	alreadyFailed := s.err != nil
+	s.mu.Unlock()
+
+	s.fail(errStreamReset)
+	s.n.streams.Delete(s.key)
+	if alreadyFailed {
+		return nil
+	}
+	return s.send(s.n.ctx, STREAM_RST, 0, 0, nil)
+}
+
+// fail terminates both directions with err and wakes up blocked readers and writers.
+func (s *stream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.readBuf = nil
+	s.pending = nil
+	s.mu.Unlock()
+
+	notify(s.readNotify)
+	notify(s.writeNotify)
+}
+
+// removeIfDone forgets the stream once both directions are finished.
+func (s *stream) removeIfDone() {
+	s.mu.Lock()
+	read := s.readClosed || s.readOffset == uint64(s.finOffset) && len(s.readBuf) == 0
+	done := s.writeClosed && s.finOffset >= 0 && read
+	s.mu.Unlock()
+
+	if done {
+		s.n.streams.Delete(s.key)
+	}
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	return streamAddr{nodeId: s.n.nodeId, id: s.key.id}
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	return streamAddr{nodeId: s.key.nodeId, id: s.key.id}
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readNotify)
+	return nil
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeNotify)
+	return nil
+}
+
+// receive handles an inbound frame of this stream.
+func (s *stream) receive(sc *streamControl, payload []byte) {
+	if sc.flags&STREAM_RST != 0 {
+		s.fail(errStreamReset)
+		s.n.streams.Delete(s.key)
+		return
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+
+	if sc.flags&STREAM_WINDOW != 0 {
+		s.sendWindow += int64(sc.window)
+		notify(s.writeNotify)
+	}
+
+	if len(payload) > 0 && sc.offset >= s.readOffset && !s.readClosed {
+		if _, ok := s.pending[sc.offset]; !ok {
+			s.pending[sc.offset] = payload
+			s.buffered += len(payload)
+		}
+		for {
+			data, ok := s.pending[s.readOffset]
+			if !ok {
+				break
+			}
+			delete(s.pending, s.readOffset)
+			s.readBuf = append(s.readBuf, data...)
+			s.readOffset += uint64(len(data))
+		}
+		notify(s.readNotify)
+	}
+
+	if sc.flags&STREAM_FIN != 0 {
+		s.finOffset = int64(sc.offset)
+		notify(s.readNotify)
+	}
+
+	overflow := s.buffered > streamInitialWindow
+	s.mu.Unlock()
+
+	if overflow {
+		s.n.logger.Warn("resetting stream", "error", errStreamWindow.Error(), "node", s.key.nodeId, "stream", s.key.id)
+		s.Reset()
+		return
+	}
+	s.removeIfDone()
+}
+
+// handleStreamFrame routes an inbound frame with a stream extension to its stream, accepting new streams on SYN.
+func (n *Nodosum) handleStreamFrame(connId uint32, app *application, header *frameHeader, payload []byte) {
+	value, _ := header.extension(EXT_STREAM)
+	sc, err := decodeStreamControl(value)
+	if err != nil {
+		n.logger.Error("error decoding stream extension", "error", err.Error(), "application", app.id, "conn", connId)
+		return
+	}
+
+	key := streamKey{
+		nodeId:        n.nodeIdOf(connId),
+		applicationId: app.id,
+		id:            sc.id,
+		opener:        sc.flags&STREAM_OPENER == 0,
+	}
+
+	v, ok := n.streams.Load(key)
+	if ok {
+		v.(*stream).receive(sc, payload)
+		return
+	}
+
+	if sc.flags&STREAM_SYN == 0 || key.opener {
+		if sc.flags&STREAM_RST == 0 {
+			_ = newStream(n, app, key).send(n.ctx, STREAM_RST, 0, 0, nil)
+		}
+		return
+	}
+
+	s := newStream(n, app, key)
+	n.streams.Store(key, s)
+	select {
+	case app.acceptedStreams <- s:
+		s.receive(sc, payload)
+	default:
+		n.streams.Delete(key)
+		n.logger.Warn("refusing stream, accept backlog full", "error", errStreamRefused.Error(), "application", app.id, "node", key.nodeId)
+		_ = s.send(n.ctx, STREAM_RST, 0, 0, nil)
+	}
+}
+
+// openStream opens a stream to the application on nodeId.
+func (n *Nodosum) openStream(ctx context.Context, app *application, nodeId string) (Stream, error) {
+	if _, ok := n.nodeConnection(nodeId); !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNodeUnreachable, nodeId)
+	}
+
+	key := streamKey{
+		nodeId:        nodeId,
+		applicationId: app.id,
+		id:            n.streamIds.Add(1),
+		opener:        true,
+	}
+
+	s := newStream(n, app, key)
+	n.streams.Store(key, s)
+
+	err := s.send(ctx, STREAM_SYN, 0, 0, nil)
+	if err != nil {
+		n.streams.Delete(key)
+		return nil, err
+	}
+	return s, nil
+}
+
+// resetStreams fails all streams to nodeId, used when one of its connections dropped.
+func (n *Nodosum) resetStreams(nodeId string) {
+	n.streams.Range(func(k, v any) bool {
+		if k.(streamKey).nodeId == nodeId {
+			n.streams.Delete(k)
+			v.(*stream).fail(fmt.Errorf("%w: %s", ErrNodeUnreachable, nodeId))
+		}
+		return true
+	})
+}
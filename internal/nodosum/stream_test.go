@@ -0,0 +1,260 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStreamTestPair connects the multiplexers of two nodes in memory, each seeing the other as connection 1.
+func newStreamTestPair(t *testing.T) (*application, *application) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	newNode := func(id, peer string) (*Nodosum, *application) {
+		n := &Nodosum{
+			clock:              realClock{},
+			nodeId:             id,
+			ctx:                ctx,
+			wg:                 wg,
+			logger:             slog.Default(),
+			connections:        &sync.Map{},
+			violations:         &sync.Map{},
+			remoteApplications: &sync.Map{},
+			applications:       &sync.Map{},
+			streams:            &sync.Map{},
+			rpcCalls:           &sync.Map{},
+			rpcHandling:        &sync.Map{},
+			rpcSlots:           make(chan struct{}, DEFAULT_MAX_CONCURRENT_REQUESTS),
+			outboxes:           &sync.Map{},
+			inboxes:            &sync.Map{},
+			reassembler:        newReassembler(DEFAULT_MAX_MESSAGE_SIZE, realClock{}),
+		}
+		n.connections.Store(uint32(1), &nodeConn{connId: 1, nodeId: peer, ctx: ctx, queue: newSendQueue(64, nil)})
+		app := &application{
+			id:              1,
+			nodosum:         n,
+			senders:         newSenderPolicy(),
+			acceptedStreams: make(chan *stream, streamAcceptBacklog),
+		}
+		n.applications.Store(app.id, app)
+		return n, app
+	}
+
+	a, appA := newNode("a", "b")
+	b, appB := newNode("b", "a")
+
+	// pump stands in for the connection between both nodes
+	pump := func(from *nodeConn, to *Nodosum) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-from.queue.ready:
+				for frame, ok := from.queue.pop(); ok; frame, ok = from.queue.pop() {
+					to.multiplexerTaskInbound(nil, &inboundFrame{connId: 1, frame: frame})
+				}
+			}
+		}
+	}
+	connA, _ := a.connections.Load(uint32(1))
+	connB, _ := b.connections.Load(uint32(1))
+	wg.Go(func() { pump(connA.(*nodeConn), b) })
+	wg.Go(func() { pump(connB.(*nodeConn), a) })
+
+	return appA, appB
+}
+
+func TestStreamEcho(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		s, err := appB.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(s)
+		s.Write(data)
+		s.Close()
+	}()
+
+	// Bigger than the window, so the sender depends on window updates
+	payload := make([]byte, 4*streamInitialWindow+123)
+	rand.Read(payload)
+
+	s, err := appA.OpenStream(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = s.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	echo, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Errorf("Expected echo of %d bytes, got %d bytes", len(payload), len(echo))
+	}
+	if err = s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamCloseKeepsWrittenData(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := appA.OpenStream(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, streamInitialWindow/2)
+	rand.Read(payload)
+	if _, err = s.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Read(make([]byte, 1)); !errors.Is(err, errStreamClosed) {
+		t.Errorf("Expected reading a closed stream to fail, got %v", err)
+	}
+
+	// The data arrived before the remote reads it, Close must not have thrown it away
+	remote, err := appB.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("Expected %d bytes after Close, got %d", len(payload), len(data))
+	}
+	if err = remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both ends forget the stream once both directions are closed
+	for _, n := range []*Nodosum{appA.nodosum, appB.nodosum} {
+		deadline := time.Now().Add(5 * time.Second)
+		for countStreams(n) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s to forget the stream", n.nodeId)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	appA, appB := newStreamTestPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := appA.OpenStream(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := appB.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = remote.Read(make([]byte, 1)); !errors.Is(err, errStreamReset) {
+		t.Errorf("Expected reset error on remote, got %v", err)
+	}
+	if _, err = s.Write([]byte("x")); !errors.Is(err, errStreamReset) {
+		t.Errorf("Expected reset error on local write, got %v", err)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	appA, _ := newStreamTestPair(t)
+
+	s, err := appA.OpenStream(context.Background(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err = s.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestStreamConnectionLoss(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	appA, _ := addNamedApplication(t, a, "tunnel")
+	appB, _ := addNamedApplication(t, b, "tunnel")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := appA.OpenStream(ctx, "b"); !errors.Is(err, ErrNodeUnreachable) {
+		t.Fatalf("Expected opening a stream to an unconnected node to fail, got %v", err)
+	}
+
+	if _, err := a.Connect(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, b, 1)
+	s, err := appA.OpenStream(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := appB.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc, _ := a.nodeConnection("b")
+	a.closeConnChannel(nc.connId)
+
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(make([]byte, 1)); !errors.Is(err, ErrNodeUnreachable) {
+		t.Errorf("Expected the stream to fail with the connection, got %v", err)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(make([]byte, 1)); !errors.Is(err, ErrNodeUnreachable) {
+		t.Errorf("Expected the remote stream to fail with the connection, got %v", err)
+	}
+}
+
+func countStreams(n *Nodosum) int {
+	count := 0
+	n.streams.Range(func(k, v any) bool {
+		count++
+		return true
+	})
+	return count
+}
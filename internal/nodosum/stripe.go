@@ -0,0 +1,85 @@
+package nodosum
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+)
+
+/*
+Connection striping
+
+A single connection between two nodes is limited by one TCP stream and one TLS session.
+With Config.ConnectionsPerPeer set to N, the dialing node opens N connections to every peer,
+numbered by a stripe index that is sent in the handshake. Duplicates are resolved per stripe,
+so both ends agree on the same set of connections.
+
+Frames are distributed over the stripes by a key: frames of a stream by the stream ID,
+chunks of a blob by the blob ID and everything else by the application ID.
+All frames with the same key use the same connection, so they stay in order as long as the set
+of connections to the peer does not change. Fragments of a message always travel together
+as they are reassembled per connection.
+
+Heartbeats and idle timeouts apply to every connection on its own, a lost stripe is redialed
+like a lost peer. Peers reports one entry per node.
+*/
+
+const (
+	DEFAULT_CONNECTIONS_PER_PEER = 1
+	// MAX_CONNECTIONS_PER_PEER bounds the stripe index accepted in handshakes
+	MAX_CONNECTIONS_PER_PEER = 64
+)
+
+// stripeKey returns the key that decides which connection to a node carries the frames of dataPack.
+func (dataPack *dataPackage) stripeKey() uint64 {
+	var id uint64
+	switch {
+	case dataPack.stream != nil:
+		id = uint64(dataPack.stream.id)
+	case dataPack.fragment != nil:
+		id = dataPack.fragment.id
+	default:
+		return uint64(dataPack.id)
+	}
+
+	buf := make([]byte, 12)
+	binary.LittleEndian.PutUint32(buf[0:4], dataPack.id)
+	binary.LittleEndian.PutUint64(buf[4:12], id)
+	h := fnv.New64a()
+	h.Write(buf)
+	return h.Sum64()
+}
+
+// nodeConnections returns all connections to the node with the given id, ordered by stripe.
+func (n *Nodosum) nodeConnections(nodeId string) []*nodeConn {
+	var conns []*nodeConn
+	n.connections.Range(func(k, v any) bool {
+		if nc, ok := v.(*nodeConn); ok && nc.nodeId != "" && nc.nodeId == nodeId {
+			conns = append(conns, nc)
+		}
+		return true
+	})
+	slices.SortFunc(conns, func(a, b *nodeConn) int {
+		return int(a.stripe) - int(b.stripe)
+	})
+	return conns
+}
+
+// nodeConnectionFor returns the connection to nodeId that carries the frames with the given stripe key.
+func (n *Nodosum) nodeConnectionFor(nodeId string, key uint64) (*nodeConn, bool) {
+	conns := n.nodeConnections(nodeId)
+	if len(conns) == 0 {
+		return nil, false
+	}
+	return conns[key%uint64(len(conns))], true
+}
+
+// stripeConnection returns the connection to nodeId with the given stripe index.
+func (n *Nodosum) stripeConnection(nodeId string, stripe uint8) (*nodeConn, bool) {
+	for _, nc := range n.nodeConnections(nodeId) {
+		if nc.stripe == stripe {
+			return nc, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,115 @@
+package nodosum
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newStripedNode(t *testing.T, memory *MemoryNetwork, id string, connections int) *Nodosum {
+	t.Helper()
+	return newTransportNode(t, id, memory.Transport(id), func(cfg *Config) {
+		cfg.ConnectionsPerPeer = connections
+	})
+}
+
+func waitForStripes(t *testing.T, n *Nodosum, nodeId string, count int) []*nodeConn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := n.nodeConnections(nodeId)
+		if len(conns) == count {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to have %d connections to %s, got %d", n.NodeId(), count, nodeId, len(conns))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConnectionStriping(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newStripedNode(t, memory, "a", 4)
+	b := newStripedNode(t, memory, "b", 4)
+
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conns := range [][]*nodeConn{waitForStripes(t, a, "b", 4), waitForStripes(t, b, "a", 4)} {
+		for i, nc := range conns {
+			if int(nc.stripe) != i {
+				t.Fatalf("Expected stripes 0 to 3, got %d at %d", nc.stripe, i)
+			}
+		}
+	}
+
+	peers := a.Peers()
+	if len(peers) != 1 || peers[0].NodeId != "b" || peers[0].Connections != 4 {
+		t.Fatalf("Expected one peer with 4 connections, got %+v", peers)
+	}
+	if ids := a.connectedNodes(); len(ids) != 1 {
+		t.Fatalf("Expected connected nodes once each, got %v", ids)
+	}
+}
+
+func TestStripeKeyRouting(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newStripedNode(t, memory, "a", 4)
+	b := newStripedNode(t, memory, "b", 4)
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForStripes(t, b, "a", 4)
+	waitForStripes(t, a, "b", 4)
+
+	message := &dataPackage{id: 7}
+	if message.stripeKey() != 7 {
+		t.Errorf("Expected messages to be keyed by application, got %d", message.stripeKey())
+	}
+
+	used := make(map[uint32]bool)
+	for id := range uint32(32) {
+		pack := &dataPackage{id: 7, stream: &streamControl{id: id}}
+		first, _ := b.nodeConnectionFor("a", pack.stripeKey())
+		// Every frame of a stream, whatever its control flags, uses the same connection
+		again := &dataPackage{id: 7, stream: &streamControl{id: id, flags: STREAM_FIN, offset: 100}}
+		second, _ := b.nodeConnectionFor("a", again.stripeKey())
+		if first != second {
+			t.Fatalf("Expected frames of stream %d on one connection", id)
+		}
+		used[first.connId] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("Expected streams to be spread over the connections, used %d", len(used))
+	}
+}
+
+func TestLostStripeRedialed(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newStripedNode(t, memory, "a", 3)
+	b := newStripedNode(t, memory, "b", 3)
+
+	b.AddPeer("a")
+	conns := waitForStripes(t, a, "b", 3)
+	lost := conns[1]
+	a.closeConnChannel(lost.connId)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if nc, ok := a.stripeConnection("b", 1); ok && nc.connId != lost.connId {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected b to redial the lost stripe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The other stripes are kept
+	for _, nc := range []*nodeConn{conns[0], conns[2]} {
+		if current, ok := a.stripeConnection("b", nc.stripe); !ok || current != nc {
+			t.Errorf("Expected stripe %d to be kept", nc.stripe)
+		}
+	}
+}
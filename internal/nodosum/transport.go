@@ -0,0 +1,338 @@
+package nodosum
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Transports
+
+A Transport provides the network a node runs on: a listener for the stream connections carrying frames,
+a dialer to connect to other nodes and a packet connection for the UDP handshake.
+Transports only move bytes, TLS is layered on top by Nodosum for every transport alike.
+
+NewTCPTransport is the default, listening on TCP and UDP on the same port.
+NewUnixTransport connects processes on the same host over Unix domain sockets.
+MemoryNetwork connects nodes within one process without any sockets, e.g. for tests.
+*/
+
+type Transport interface {
+	// Listen returns the listener accepting connections of other nodes.
+	Listen() (net.Listener, error)
+	// Dial connects to the node listening on addr.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	// ListenPacket returns the connection for handshake packets.
+	ListenPacket() (net.PacketConn, error)
+	// Addr returns the address other nodes dial to reach this transport.
+	Addr() string
+}
+
+type tcpTransport struct {
+	addr string
+}
+
+// NewTCPTransport returns a transport listening on TCP and UDP on addr, e.g. ":6969".
+func NewTCPTransport(addr string) Transport {
+	return &tcpTransport{addr: addr}
+}
+
+func (t *tcpTransport) Listen() (net.Listener, error) {
+	return net.Listen("tcp", t.addr)
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (t *tcpTransport) ListenPacket() (net.PacketConn, error) {
+	return net.ListenPacket("udp", t.addr)
+}
+
+func (t *tcpTransport) Addr() string {
+	return t.addr
+}
+
+type unixTransport struct {
+	path string
+}
+
+// NewUnixTransport returns a transport listening on the Unix socket path.
+// Handshake packets use a datagram socket at path with the suffix ".packet".
+// Stale socket files left behind by a previous process are removed.
+func NewUnixTransport(path string) Transport {
+	return &unixTransport{path: path}
+}
+
+func (t *unixTransport) Listen() (net.Listener, error) {
+	if err := removeStaleSocket(t.path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", t.path)
+}
+
+func (t *unixTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
+
+func (t *unixTransport) ListenPacket() (net.PacketConn, error) {
+	path := t.path + ".packet"
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.ListenPacket("unixgram", path)
+}
+
+func (t *unixTransport) Addr() string {
+	return t.path
+}
+
+// removeStaleSocket removes a socket file at path, any other kind of file is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+var errMemoryAddrInUse = errors.New("address already in use")
+
+// MemoryNetwork connects transports within one process, nodes on it do not need any ports or sockets.
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	packets   map[string]*memoryPacketConn
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners: make(map[string]*memoryListener),
+		packets:   make(map[string]*memoryPacketConn),
+	}
+}
+
+// Transport returns the transport of a node reachable on the network under addr.
+func (m *MemoryNetwork) Transport(addr string) Transport {
+	return &memoryTransport{network: m, addr: addr}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	addr    string
+	dials   uint64
+	mu      sync.Mutex
+}
+
+func (t *memoryTransport) Listen() (net.Listener, error) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, ok := t.network.listeners[t.addr]; ok {
+		return nil, fmt.Errorf("%w: %s", errMemoryAddrInUse, t.addr)
+	}
+	l := &memoryListener{
+		network: t.network,
+		addr:    memoryAddr(t.addr),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[t.addr] = l
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t.network.mu.Lock()
+	l, ok := t.network.listeners[addr]
+	t.network.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(addr), Err: errors.New("connection refused")}
+	}
+
+	// Every connection gets its own local address, like an ephemeral port
+	t.mu.Lock()
+	t.dials++
+	local := memoryAddr(fmt.Sprintf("%s#%d", t.addr, t.dials))
+	t.mu.Unlock()
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &memoryConn{Conn: server, local: l.addr, remote: local}:
+		return &memoryConn{Conn: client, local: local, remote: l.addr}, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(addr), Err: errors.New("connection refused")}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *memoryTransport) ListenPacket() (net.PacketConn, error) {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, ok := t.network.packets[t.addr]; ok {
+		return nil, fmt.Errorf("%w: %s", errMemoryAddrInUse, t.addr)
+	}
+	p := &memoryPacketConn{
+		network: t.network,
+		addr:    memoryAddr(t.addr),
+		packets: make(chan memoryPacket, 64),
+		closed:  make(chan struct{}),
+	}
+	t.network.packets[t.addr] = p
+	return p, nil
+}
+
+func (t *memoryTransport) Addr() string {
+	return t.addr
+}
+
+// memoryConn is one end of a pipe with the addresses of the memory network.
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+type memoryListener struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+type memoryPacket struct {
+	data []byte
+	from net.Addr
+}
+
+type memoryPacketConn struct {
+	network   *MemoryNetwork
+	addr      memoryAddr
+	packets   chan memoryPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	deadline  time.Time
+}
+
+func (p *memoryPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.deadline
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-p.packets:
+		return copy(b, packet.data), packet.from, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo delivers a packet to the packet connection listening on addr. Like UDP it silently
+// drops packets to unknown addresses or receivers that do not keep up.
+func (p *memoryPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	p.network.mu.Lock()
+	to, ok := p.network.packets[addr.String()]
+	p.network.mu.Unlock()
+	if !ok {
+		return len(b), nil
+	}
+
+	select {
+	case to.packets <- memoryPacket{data: append([]byte(nil), b...), from: p.addr}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (p *memoryPacketConn) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.network.mu.Lock()
+		delete(p.network.packets, string(p.addr))
+		p.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (p *memoryPacketConn) LocalAddr() net.Addr {
+	return p.addr
+}
+
+func (p *memoryPacketConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *memoryPacketConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (p *memoryPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
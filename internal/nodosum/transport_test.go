@@ -0,0 +1,162 @@
+package nodosum
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testTransports(t *testing.T) map[string][2]Transport {
+	dir := t.TempDir()
+	memory := NewMemoryNetwork()
+	return map[string][2]Transport{
+		"tcp":    {NewTCPTransport("127.0.0.1:0"), NewTCPTransport("127.0.0.1:0")},
+		"unix":   {NewUnixTransport(filepath.Join(dir, "a.sock")), NewUnixTransport(filepath.Join(dir, "b.sock"))},
+		"memory": {memory.Transport("a"), memory.Transport("b")},
+	}
+}
+
+func TestTransportStreams(t *testing.T) {
+	for name, transports := range testTransports(t) {
+		t.Run(name, func(t *testing.T) {
+			listener, err := transports[0].Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := transports[1].Dial(ctx, listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			msg := []byte("hello over " + name)
+			go conn.Write(msg)
+			echo := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echo, msg) {
+				t.Fatalf("Expected echo %q, got %q", msg, echo)
+			}
+		})
+	}
+}
+
+func TestTransportPackets(t *testing.T) {
+	for name, transports := range testTransports(t) {
+		t.Run(name, func(t *testing.T) {
+			a, err := transports[0].ListenPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+			b, err := transports[1].ListenPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			if _, err := a.WriteTo([]byte("ping"), b.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+			b.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 16)
+			n, from, err := b.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "ping" || from.String() != a.LocalAddr().String() {
+				t.Fatalf("Expected ping from %s, got %q from %s", a.LocalAddr(), buf[:n], from)
+			}
+		})
+	}
+}
+
+func TestMemoryDialUnknownAddress(t *testing.T) {
+	_, err := NewMemoryNetwork().Transport("a").Dial(context.Background(), "b")
+	if err == nil {
+		t.Fatal("Expected dial to an address without listener to fail")
+	}
+}
+
+func newMemoryNode(t *testing.T, memory *MemoryNetwork, id string) *Nodosum {
+	t.Helper()
+	return newTransportNode(t, id, memory.Transport(id))
+}
+
+func newTransportNode(t *testing.T, id string, transport Transport, configure ...func(*Config)) *Nodosum {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	cfg := &Config{
+		NodeId:            id,
+		Ctx:               ctx,
+		Wg:                wg,
+		SharedSecret:      "secret",
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Transport:         transport,
+		ReconnectInterval: 10 * time.Millisecond,
+
+		MultiplexerBufferSize:  64,
+		MultiplexerWorkerCount: 1,
+	}
+	for _, f := range configure {
+		f(cfg)
+	}
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Start()
+	t.Cleanup(func() {
+		cancel()
+		n.Shutdown()
+		wg.Wait()
+	})
+	return n
+}
+
+func TestNodeOnMemoryNetwork(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+
+	nodeId, err := b.Connect(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeId != "a" {
+		t.Fatalf("Expected to connect to node a, got %s", nodeId)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(a.Peers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected node to accept connection over the memory network")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	peer := a.Peers()[0]
+	if peer.NodeId != "b" || peer.Address != "b#1" {
+		t.Fatalf("Expected peer b on b#1, got %s on %s", peer.NodeId, peer.Address)
+	}
+}
@@ -0,0 +1,173 @@
+package nodosum
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+All UDP control packets (handshake, discovery, gossip) are sealed with AES-256-GCM.
+
+Keys are derived with HKDF from every active secret of the keyring.
+Packets are sealed with the key of the primary secret and opened with any active key,
+so secret rotation works the same way as for the TCP handshake.
+
+Envelope:
+	1 byte version | 12 byte nonce | ciphertext + 16 byte tag
+
+The plaintext starts with the unix nano timestamp of the sender (8 bytes, little endian).
+Packets outside of udpReplayWindow or with a nonce seen before are dropped.
+*/
+
+const (
+	udpEnvelopeVersion uint8 = 1
+	udpNonceSize             = 12
+	udpTimestampSize         = 8
+	udpReplayWindow          = 30 * time.Second
+	udpKeyInfo               = "mycorrizal udp control v1"
+)
+
+var (
+	errUdpPacketShort   = errors.New("udp packet too short")
+	errUdpPacketVersion = errors.New("unsupported udp envelope version")
+	errUdpPacketAuth    = errors.New("udp packet could not be authenticated")
+	errUdpPacketStale   = errors.New("udp packet outside of replay window")
+	errUdpPacketReplay  = errors.New("udp packet replayed")
+)
+
+type packetCipher struct {
+	mu      sync.Mutex
+	keyring *keyring
+	secrets []string
+	aeads   []cipher.AEAD
+	seen    map[[udpNonceSize]byte]time.Time
+	pruned  time.Time
+	now     func() time.Time
+}
+
+func newPacketCipher(k *keyring) *packetCipher {
+	return &packetCipher{
+		keyring: k,
+		seen:    make(map[[udpNonceSize]byte]time.Time),
+		now:     time.Now,
+	}
+}
+
+// keys returns the AEADs of all active secrets, primary first.
+// They are derived again whenever the keyring changed.
+func (c *packetCipher) keys() ([]cipher.AEAD, error) {
+	secrets := c.keyring.active()
+	if slices.Equal(secrets, c.secrets) {
+		return c.aeads, nil
+	}
+
+	aeads := make([]cipher.AEAD, 0, len(secrets))
+	for _, secret := range secrets {
+		key, err := hkdf.Key(sha256.New, []byte(secret), nil, udpKeyInfo, 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads = append(aeads, aead)
+	}
+
+	c.secrets = secrets
+	c.aeads = aeads
+	return aeads, nil
+}
+
+func (c *packetCipher) seal(payload []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	aeads, err := c.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1+udpNonceSize, 1+udpNonceSize+udpTimestampSize+len(payload)+aeads[0].Overhead())
+	buf[0] = udpEnvelopeVersion
+	nonce := buf[1 : 1+udpNonceSize]
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, udpTimestampSize+len(payload))
+	binary.LittleEndian.PutUint64(plain, uint64(c.now().UnixNano()))
+	copy(plain[udpTimestampSize:], payload)
+
+	return aeads[0].Seal(buf, nonce, plain, buf[:1]), nil
+}
+
+func (c *packetCipher) open(packet []byte) ([]byte, error) {
+	if len(packet) < 1+udpNonceSize+udpTimestampSize {
+		return nil, errUdpPacketShort
+	}
+	if packet[0] != udpEnvelopeVersion {
+		return nil, errUdpPacketVersion
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	aeads, err := c.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := packet[1 : 1+udpNonceSize]
+	var plain []byte
+	for _, aead := range aeads {
+		plain, err = aead.Open(nil, nonce, packet[1+udpNonceSize:], packet[:1])
+		if err == nil {
+			break
+		}
+	}
+	if err != nil || len(plain) < udpTimestampSize {
+		return nil, errUdpPacketAuth
+	}
+
+	now := c.now()
+	sent := time.Unix(0, int64(binary.LittleEndian.Uint64(plain)))
+	if sent.Before(now.Add(-udpReplayWindow)) || sent.After(now.Add(udpReplayWindow)) {
+		return nil, errUdpPacketStale
+	}
+
+	c.pruneSeen(now)
+	key := [udpNonceSize]byte(nonce)
+	if _, ok := c.seen[key]; ok {
+		return nil, errUdpPacketReplay
+	}
+	c.seen[key] = sent
+
+	return plain[udpTimestampSize:], nil
+}
+
+// pruneSeen forgets nonces of packets that would be rejected as stale anyway, at most once per second.
+func (c *packetCipher) pruneSeen(now time.Time) {
+	if now.Sub(c.pruned) < time.Second {
+		return
+	}
+	c.pruned = now
+	for nonce, sent := range c.seen {
+		if sent.Before(now.Add(-udpReplayWindow)) {
+			delete(c.seen, nonce)
+		}
+	}
+}
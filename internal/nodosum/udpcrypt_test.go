@@ -0,0 +1,68 @@
+package nodosum
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPacketCipherRoundTrip(t *testing.T) {
+	sender := newPacketCipher(newKeyring("secret", nil))
+	receiver := newPacketCipher(newKeyring("secret", nil))
+
+	packet, err := sender.seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := receiver.open(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("hello")) {
+		t.Errorf("Expected payload hello, got %q", payload)
+	}
+
+	if _, err = receiver.open(packet); !errors.Is(err, errUdpPacketReplay) {
+		t.Errorf("Expected replayed packet to be rejected, got %v", err)
+	}
+
+	packet, _ = sender.seal([]byte("hello"))
+	packet[len(packet)-1] ^= 0xff
+	if _, err = receiver.open(packet); !errors.Is(err, errUdpPacketAuth) {
+		t.Errorf("Expected tampered packet to be rejected, got %v", err)
+	}
+}
+
+func TestPacketCipherRejectsStalePackets(t *testing.T) {
+	sender := newPacketCipher(newKeyring("secret", nil))
+	sender.now = func() time.Time { return time.Now().Add(-2 * udpReplayWindow) }
+	receiver := newPacketCipher(newKeyring("secret", nil))
+
+	packet, err := sender.seal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = receiver.open(packet); !errors.Is(err, errUdpPacketStale) {
+		t.Errorf("Expected stale packet to be rejected, got %v", err)
+	}
+}
+
+func TestPacketCipherRotation(t *testing.T) {
+	sender := newPacketCipher(newKeyring("old", nil))
+	receiverKeyring := newKeyring("old", nil)
+	receiver := newPacketCipher(receiverKeyring)
+
+	receiverKeyring.rotate("new")
+	packet, _ := sender.seal([]byte("hello"))
+	if _, err := receiver.open(packet); err != nil {
+		t.Errorf("Expected packet sealed with previous secret to be accepted, got %v", err)
+	}
+
+	receiverKeyring.retire("old")
+	packet, _ = sender.seal([]byte("hello"))
+	if _, err := receiver.open(packet); !errors.Is(err, errUdpPacketAuth) {
+		t.Errorf("Expected packet sealed with retired secret to be rejected, got %v", err)
+	}
+}
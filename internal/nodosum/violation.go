@@ -0,0 +1,39 @@
+package nodosum
+
+import (
+	"sync/atomic"
+)
+
+/*
+Protocol violations
+
+A peer sending frames that break the protocol, like an unknown version or type, an oversized frame
+or a malformed extension area, is disconnected before the frame is processed any further.
+Oversized frames are rejected by their header, so they are never allocated.
+
+Violations are counted per node and survive reconnects, so a node that keeps misbehaving
+can be spotted with ProtocolViolations or Peers.
+*/
+
+// protocolViolation counts a violation against the node on the other end of a connection and closes it.
+func (n *Nodosum) protocolViolation(connId uint32, err error) {
+	v, ok := n.connections.Load(connId)
+	if !ok {
+		return
+	}
+	nc := v.(*nodeConn)
+
+	counter, _ := n.violations.LoadOrStore(nc.nodeId, &atomic.Uint64{})
+	count := counter.(*atomic.Uint64).Add(1)
+	n.logger.Warn("protocol violation, disconnecting", "error", err.Error(), "node", nc.nodeId, "remote", nc.addr, "violations", count)
+	n.closeConnChannel(connId)
+}
+
+// ProtocolViolations returns the number of protocol violations of nodeId since this node started.
+func (n *Nodosum) ProtocolViolations(nodeId string) uint64 {
+	v, ok := n.violations.Load(nodeId)
+	if !ok {
+		return 0
+	}
+	return v.(*atomic.Uint64).Load()
+}
@@ -0,0 +1,177 @@
+package nodosum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func rawFrameHeader(version uint8, kind messageType, flag messageFlag, length uint32) []byte {
+	header := make([]byte, frameHeaderSize)
+	header[0] = version
+	header[5] = byte(kind)
+	header[6] = byte(flag)
+	binary.LittleEndian.PutUint32(header[7:11], length)
+	return header
+}
+
+func TestCheckFrameHeader(t *testing.T) {
+	for _, version := range []uint8{1, PROTOCOL_VERSION} {
+		if err := checkFrameHeader(rawFrameHeader(version, APP, 0, 0)); err != nil {
+			t.Errorf("Expected version %d to be accepted: %v", version, err)
+		}
+	}
+	if err := checkFrameHeader(rawFrameHeader(0, APP, 0, 0)); !errors.Is(err, errUnknownVersion) {
+		t.Errorf("Expected version 0 to be rejected, got %v", err)
+	}
+	if err := checkFrameHeader(rawFrameHeader(PROTOCOL_VERSION+1, APP, 0, 0)); !errors.Is(err, errUnknownVersion) {
+		t.Errorf("Expected future version to be rejected, got %v", err)
+	}
+	if err := checkFrameHeader(rawFrameHeader(PROTOCOL_VERSION, APP+1, 0, 0)); !errors.Is(err, errUnknownType) {
+		t.Errorf("Expected unknown type to be rejected, got %v", err)
+	}
+}
+
+func TestProtocolViolationsDisconnect(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newTransportNode(t, "a", memory.Transport("a"), func(cfg *Config) {
+		cfg.MaxFrameSize = 128 * 1024
+		cfg.FragmentSize = 64 * 1024
+	})
+	b := newMemoryNode(t, memory, "b")
+
+	frames := map[string][]byte{
+		"oversized":       rawFrameHeader(PROTOCOL_VERSION, APP, 0, 1<<30),
+		"unknown version": rawFrameHeader(9, APP, 0, 0),
+		"unknown type":    rawFrameHeader(PROTOCOL_VERSION, 7, 0, 0),
+		"empty extension": append(rawFrameHeader(PROTOCOL_VERSION, APP, EXTENDED, 0), 0, 0),
+		"bad extension":   append(rawFrameHeader(PROTOCOL_VERSION, APP, EXTENDED, 0), 3, 0, 1, 0xff, 0),
+	}
+
+	violations := uint64(0)
+	for name, frame := range frames {
+		if _, err := b.Connect(context.Background(), "a"); err != nil {
+			t.Fatal(err)
+		}
+		waitForPeers(t, a, 1)
+		nc, _ := b.nodeConnection("a")
+		if err := b.enqueue(context.Background(), nc, frame, SEND_QUEUE_BLOCK); err != nil {
+			t.Fatal(err)
+		}
+
+		violations++
+		deadline := time.Now().Add(5 * time.Second)
+		for a.ProtocolViolations("b") != violations || len(a.Peers()) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: Expected a to disconnect b and count %d violations, got %d", name, violations, a.ProtocolViolations("b"))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		waitForPeers(t, b, 0)
+	}
+}
+
+func TestDecompressionBombDisconnects(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newTransportNode(t, "a", memory.Transport("a"), func(cfg *Config) {
+		cfg.MaxMessageSize = 1024 * 1024
+	})
+	b := newMemoryNode(t, memory, "b")
+	app, received := addNamedApplication(t, a, "target")
+
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	// A few kilobytes decompressing to 64MB
+	payload, err := compressPayload(COMPRESSION_ZSTD, nil, make([]byte, 64*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := rawFrameHeader(PROTOCOL_VERSION, APP, COMPRESSED, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[1:5], app.id)
+	nc, _ := b.nodeConnection("a")
+	if err := b.enqueue(context.Background(), nc, append(frame, payload...), SEND_QUEUE_BLOCK); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.ProtocolViolations("b") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a payload decompressing beyond the maximum message size to be a protocol violation")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case p := <-received:
+		t.Fatalf("Expected the payload to be dropped, got %d bytes", len(p.([]byte)))
+	default:
+	}
+}
+
+func TestMaxFrameSizeNegotiated(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newTransportNode(t, "a", memory.Transport("a"), func(cfg *Config) {
+		cfg.MaxFrameSize = 128 * 1024
+		cfg.FragmentSize = 64 * 1024
+	})
+	b := newMemoryNode(t, memory, "b")
+
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	fromB, _ := b.nodeConnection("a")
+	fromA, _ := a.nodeConnection("b")
+	if fromA.maxFrameSize != 128*1024 || fromB.maxFrameSize != 128*1024 {
+		t.Fatalf("Expected both ends to agree on 128KB, got %d and %d", fromA.maxFrameSize, fromB.maxFrameSize)
+	}
+
+	err := b.enqueue(context.Background(), fromB, make([]byte, 128*1024+1), SEND_QUEUE_BLOCK)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Expected oversized frame to be refused by the sender, got %v", err)
+	}
+	if a.ProtocolViolations("b") != 0 {
+		t.Error("Expected no violation for a frame that was never sent")
+	}
+}
+
+func TestMaxFrameSizeTooSmall(t *testing.T) {
+	_, err := New(&Config{MaxFrameSize: 64 * 1024, Transport: NewMemoryNetwork().Transport("a")})
+	if err == nil {
+		t.Fatal("Expected maximum frame size not bigger than the fragment size to be rejected")
+	}
+}
+
+func TestPartialMessageFloodDisconnects(t *testing.T) {
+	memory := NewMemoryNetwork()
+	a := newMemoryNode(t, memory, "a")
+	b := newMemoryNode(t, memory, "b")
+	app, _ := addNamedApplication(t, a, "target")
+
+	if _, err := b.Connect(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	waitForPeers(t, a, 1)
+
+	// First fragments of messages that are never finished
+	nc, _ := b.nodeConnection("a")
+	for i := range maxPartialMessages + 1 {
+		frame := buildFrame(&dataPackage{id: app.id}, []byte("x"), false, &fragmentInfo{id: uint64(i)})
+		if err := b.enqueue(context.Background(), nc, frame, SEND_QUEUE_BLOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.ProtocolViolations("b") != 1 || len(a.Peers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a flood of partial messages to be a protocol violation")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -18,8 +18,19 @@ import (
 type Mycorrizal interface {
 	Start() error
 	Shutdown() error
+	// RotateSharedSecret makes secret the primary cluster secret, the former one stays accepted until retired.
+	RotateSharedSecret(secret string) error
+	// RetireSharedSecret stops accepting a previous cluster secret. The primary one can not be retired.
+	RetireSharedSecret(secret string) error
+	// SetSharedSecrets replaces the primary and all accepted previous cluster secrets.
+	SetSharedSecrets(primary string, previous []string) error
+	// Peers returns the connected nodes with their heartbeat round trip time and send queue depth.
+	Peers() []PeerStatus
 }
 
+// PeerStatus describes the connection to another node of the cluster.
+type PeerStatus = nodosum.PeerStatus
+
 type mycorrizal struct {
 	nodeId        string
 	ctx           context.Context
@@ -87,6 +98,13 @@ func New(cfg *Config) (Mycorrizal, error) {
 		cfg.Logger.Info("Node running in single mode, no Cluster connections")
 	}
 
+	var peers []string
+	if cfg.DiscoveryMode == DC_MODE_STATIC && !cfg.SingleMode {
+		for _, addr := range cfg.NodeAddrs {
+			peers = append(peers, addr.String())
+		}
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 	wg := &sync.WaitGroup{}
 
@@ -94,6 +112,8 @@ func New(cfg *Config) (Mycorrizal, error) {
 		NodeId:                 id,
 		Ctx:                    ctx,
 		ListenPort:             cfg.ListenPort,
+		SharedSecret:           cfg.SharedSecret,
+		PreviousSharedSecrets:  cfg.PreviousSharedSecrets,
 		Logger:                 cfg.Logger,
 		Wg:                     wg,
 		HandshakeTimeout:       cfg.HandshakeTimeout,
@@ -103,6 +123,31 @@ func New(cfg *Config) (Mycorrizal, error) {
 		TlsCert:                cfg.ClusterTLSCert,
 		MultiplexerBufferSize:  cfg.MultiplexerBufferSize,
 		MultiplexerWorkerCount: cfg.MultiplexerWorkerCount,
+		AuditSink:              cfg.AuditSink,
+		AuditBufferSize:        cfg.AuditBufferSize,
+		PeerRoles:              cfg.PeerRoles,
+		MaxConnections:         cfg.MaxConnections,
+		MaxConnectionsPerIP:    cfg.MaxConnectionsPerIP,
+		MaxHandshakes:          cfg.MaxHandshakes,
+		ConnFrameRate:          cfg.ConnFrameRate,
+		ConnByteRate:           cfg.ConnByteRate,
+		RateLimitAction:        cfg.RateLimitAction,
+		Compression:            cfg.Compression,
+		CompressionThreshold:   cfg.CompressionThreshold,
+		FragmentSize:           cfg.FragmentSize,
+		MaxMessageSize:         cfg.MaxMessageSize,
+		RetransmitInterval:     cfg.RetransmitInterval,
+		SendQueueSize:          cfg.SendQueueSize,
+		SendQueuePolicy:        cfg.SendQueuePolicy,
+		HeartbeatInterval:      cfg.HeartbeatInterval,
+		IdleTimeout:            cfg.IdleTimeout,
+		Transport:              cfg.Transport,
+		Peers:                  peers,
+		ReconnectInterval:      cfg.ReconnectInterval,
+		ConnectionsPerPeer:     cfg.ConnectionsPerPeer,
+		MaxFrameSize:           cfg.MaxFrameSize,
+		BroadcastFanout:        cfg.BroadcastFanout,
+		MaxConcurrentRequests:  cfg.MaxConcurrentRequests,
 	}
 
 	ndsm, err := nodosum.New(nodosumConfig)
@@ -143,6 +188,22 @@ func (mc *mycorrizal) Shutdown() error {
 	return nil
 }
 
+func (mc *mycorrizal) RotateSharedSecret(secret string) error {
+	return mc.nodosum.RotateSharedSecret(secret)
+}
+
+func (mc *mycorrizal) RetireSharedSecret(secret string) error {
+	return mc.nodosum.RetireSharedSecret(secret)
+}
+
+func (mc *mycorrizal) SetSharedSecrets(primary string, previous []string) error {
+	return mc.nodosum.SetSharedSecrets(primary, previous)
+}
+
+func (mc *mycorrizal) Peers() []PeerStatus {
+	return mc.nodosum.Peers()
+}
+
 // connectionRegistry is needed to keep track of connections and merge connections for efficiency
 type connectionRegistry struct {
 	mu       sync.Mutex
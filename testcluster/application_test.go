@@ -0,0 +1,199 @@
+package testcluster
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// registerEverywhere registers an application with the given name on every node, received payloads go to the returned channels.
+func registerEverywhere(t *testing.T, c *Cluster, name string) ([]Application, []chan string) {
+	t.Helper()
+	var apps []Application
+	var received []chan string
+	for _, node := range c.Nodes() {
+		app, err := node.RegisterApplication(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan string, 64)
+		app.SetReceiveFunc(func(payload []byte) error {
+			ch <- string(payload)
+			return nil
+		})
+		apps = append(apps, app)
+		received = append(received, ch)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, app := range apps {
+		for len(app.Nodes()) != len(apps)-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s on all nodes seen from node-%d, got %v", name, i, app.Nodes())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	return apps, received
+}
+
+func expectReceived(t *testing.T, ch chan string, want ...string) {
+	t.Helper()
+	var got []string
+	for range want {
+		select {
+		case payload := <-ch:
+			got = append(got, payload)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestApplicationSendReceive(t *testing.T) {
+	c := Start(t, Options{Nodes: 2})
+	waitConverged(t, c)
+	apps, received := registerEverywhere(t, c, "greeter")
+
+	var want []string
+	for i := range 10 {
+		payload := fmt.Sprintf("hello %d", i)
+		if err := apps[0].Send([]byte(payload), []string{c.Node(1).Id}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, payload)
+	}
+	expectReceived(t, received[1], want...)
+
+	if err := apps[1].SendContext(context.Background(), []byte("reply"), []string{c.Node(0).Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[0], "reply")
+
+	// Large payloads are fragmented and compressed on the way
+	large := make([]byte, 200*1024)
+	for i := range large {
+		large[i] = byte(i % 7)
+	}
+	if err := apps[0].Send(large, []string{c.Node(1).Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[1], string(large))
+}
+
+func TestApplicationSendReliable(t *testing.T) {
+	c := Start(t, Options{Nodes: 2})
+	waitConverged(t, c)
+	apps, received := registerEverywhere(t, c, "ledger")
+	for _, app := range apps {
+		app.EnableReliableDelivery()
+	}
+
+	if err := apps[1].Send([]byte("entry"), []string{c.Node(0).Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[0], "entry")
+}
+
+func TestApplicationSendReliableAcrossRestarts(t *testing.T) {
+	c := Start(t, Options{Nodes: 2, Memory: true})
+	waitConverged(t, c)
+	apps, received := registerEverywhere(t, c, "ledger")
+	for _, app := range apps {
+		app.EnableReliableDelivery()
+	}
+	if err := apps[0].Send([]byte("first"), []string{c.Node(1).Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[1], "first")
+
+	// restart brings node i back with the application registered again
+	restart := func(i int) {
+		c.Restart(i)
+		waitConverged(t, c)
+		app, err := c.Node(i).RegisterApplication("ledger")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.EnableReliableDelivery()
+		ch := make(chan string, 64)
+		app.SetReceiveFunc(func(payload []byte) error {
+			ch <- string(payload)
+			return nil
+		})
+		apps[i], received[i] = app, ch
+		deadline := time.Now().Add(5 * time.Second)
+		for len(apps[1-i].Nodes()) != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected ledger on node-%d again", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A restarted sender counts from the start again, the receiver must not take it for duplicates
+	restart(0)
+	if err := apps[0].Send([]byte("after sender restart"), []string{c.Node(1).Id}); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[1], "after sender restart")
+
+	// A restarted receiver starts from the start again, the sender has to number its messages accordingly
+	restart(1)
+	if err := apps[0].Send([]byte("after receiver restart"), []string{c.Node(1).Id}); err != nil {
+		t.Fatal(err)
+	}
+	// The previous message is delivered once more if the acknowledgement was lost with the receiver
+	for {
+		select {
+		case payload := <-received[1]:
+			if payload == "after receiver restart" {
+				return
+			}
+			if payload != "after sender restart" {
+				t.Fatalf("Expected the message after the receiver restart, got %q", payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the message after the receiver restart")
+		}
+	}
+}
+
+func TestApplicationBroadcast(t *testing.T) {
+	c := Start(t, Options{Nodes: 3})
+	waitConverged(t, c)
+	apps, received := registerEverywhere(t, c, "gossip")
+
+	if err := apps[0].Send([]byte("everyone"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectReceived(t, received[1], "everyone")
+	expectReceived(t, received[2], "everyone")
+	select {
+	case payload := <-received[0]:
+		t.Fatalf("Expected the sender not to receive its broadcast, got %q", payload)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestApplicationUnregisteredOnPeer(t *testing.T) {
+	c := Start(t, Options{Nodes: 2, Memory: true})
+	waitConverged(t, c)
+
+	app, err := c.Node(0).RegisterApplication("lonely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Nodes()) != 0 {
+		t.Errorf("Expected no other node with lonely, got %v", app.Nodes())
+	}
+	// Frames for applications a node does not know are dropped
+	if err := app.Send([]byte("anyone?"), []string{c.Node(1).Id}); err != nil {
+		t.Fatal(err)
+	}
+}
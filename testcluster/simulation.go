@@ -0,0 +1,155 @@
+package testcluster
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/conamu/mycorrizal/internal/nodosum"
+)
+
+/*
+Simulations
+
+A Simulation is a cluster on the in-memory network whose nodes and chaos transport run on a virtual clock.
+Virtual time only moves when the simulation runs, from one timer to the next. Each step fires a single timer
+and waits until the nodes settled before the next one fires. All random faults are drawn from generators seeded
+with the seed of the simulation, and so should every random decision of the scenario itself:
+
+	testcluster.Simulate(t, testcluster.Options{Nodes: 5}, func(t *testing.T, sim *testcluster.Simulation) {
+		sim.Chaos.SetFault("*", "*", testcluster.Fault{Latency: 20 * time.Millisecond, Jitter: 30 * time.Millisecond, DropRate: 0.01})
+		sim.RunUntilConverged(time.Minute)
+		sim.Kill(sim.Rand().IntN(5))
+		sim.RunFor(30 * time.Second)
+	})
+
+The scenario runs in a testing/synctest bubble. A step counts as settled once every goroutine of the
+bubble is durably blocked, so settling neither waits on nor depends on the wall clock. Timers fire in
+the order of their deadlines, ties in the order they were scheduled.
+
+Options.Seed is the seed of the simulation, Options.RandomSeed draws one at random instead.
+A failing simulation logs its seed, setting MYCORRIZAL_SIM_SEED to it replays the same timeline.
+Goroutines still run in parallel between steps, so the order of events within one step
+is up to the scheduler. Everything driven by time, the network and faults is reproduced.
+*/
+
+const (
+	// SIM_SEED_ENV overrides the seed of every simulation, to replay a failed one
+	SIM_SEED_ENV = "MYCORRIZAL_SIM_SEED"
+)
+
+// simEpoch is the virtual time every simulation starts at.
+var simEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type Simulation struct {
+	*Cluster
+	Clock *SimClock
+	Seed  uint64
+	rng   *rand.Rand
+}
+
+// Simulate runs scenario on a cluster on a virtual clock and the in-memory network, inside a synctest bubble.
+// The seed is taken from SIM_SEED_ENV, drawn at random if Options.RandomSeed is set or else Options.Seed, in that order.
+func Simulate(t *testing.T, opts Options, scenario func(t *testing.T, sim *Simulation)) {
+	t.Helper()
+
+	seed := opts.Seed
+	if opts.RandomSeed {
+		seed = rand.Uint64()
+	}
+	if env := os.Getenv(SIM_SEED_ENV); env != "" {
+		s, err := strconv.ParseUint(env, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid %s: %v", SIM_SEED_ENV, err)
+		}
+		seed = s
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("simulation seed %d, replay with %s=%d", seed, SIM_SEED_ENV, seed)
+		}
+	})
+
+	opts.Memory = true
+	opts.Seed = seed
+	opts.RandomSeed = false
+	synctest.Test(t, func(t *testing.T) {
+		clock := nodosum.NewSimClock(simEpoch)
+		scenario(t, &Simulation{
+			Cluster: start(t, opts, clock),
+			Clock:   clock,
+			Seed:    seed,
+			rng:     rand.New(rand.NewPCG(seed, 0)),
+		})
+	})
+}
+
+// Rand returns the generator for random decisions of the scenario, seeded with the seed of the simulation.
+func (s *Simulation) Rand() *rand.Rand {
+	return s.rng
+}
+
+// Now returns the virtual time.
+func (s *Simulation) Now() time.Time {
+	return s.Clock.Now()
+}
+
+// Elapsed returns the virtual time since the simulation started.
+func (s *Simulation) Elapsed() time.Duration {
+	return s.Clock.Now().Sub(simEpoch)
+}
+
+// settle waits until every goroutine of a simulation is durably blocked, it returns at once on the wall clock.
+func (c *Cluster) settle() {
+	if _, ok := c.clock.(*SimClock); !ok {
+		return
+	}
+	synctest.Wait()
+}
+
+// Step fires the next timer and lets the nodes react to it. Timers due at the same instant fire
+// one step after another, so their effects do not race. It returns false if no timer is pending.
+func (s *Simulation) Step() bool {
+	s.settle()
+	if !s.Clock.FireNext() {
+		return false
+	}
+	s.settle()
+	return true
+}
+
+// RunFor runs the simulation for d of virtual time.
+func (s *Simulation) RunFor(d time.Duration) {
+	s.RunUntil(func() bool { return false }, d)
+}
+
+// RunUntil runs the simulation until cond is true, checked after every step, or d of virtual time passed.
+// It reports whether cond became true.
+func (s *Simulation) RunUntil(cond func() bool, d time.Duration) bool {
+	end := s.Clock.Now().Add(d)
+	for {
+		s.settle()
+		if cond() {
+			return true
+		}
+		next, ok := s.Clock.Next()
+		if !ok || next.After(end) {
+			s.Clock.AdvanceTo(end)
+			s.settle()
+			return cond()
+		}
+		s.Clock.FireNext()
+	}
+}
+
+// RunUntilConverged runs the simulation until the cluster converged, for at most d of virtual time.
+func (s *Simulation) RunUntilConverged(d time.Duration) error {
+	if !s.RunUntil(s.Converged, d) {
+		return fmt.Errorf("cluster did not converge within %s of virtual time", d)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package testcluster
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// reconnectScenario kills and restarts random nodes under jittery latency and records when the cluster converged.
+func reconnectScenario(t *testing.T, seed uint64) []string {
+	var trace []string
+	Simulate(t, Options{Nodes: 3, Seed: seed}, func(t *testing.T, sim *Simulation) {
+		sim.Chaos.SetFault("*", "*", Fault{Latency: 5 * time.Millisecond, Jitter: 10 * time.Millisecond})
+
+		converged := func(event string) {
+			t.Helper()
+			if err := sim.RunUntilConverged(time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			trace = append(trace, fmt.Sprintf("%s converged at %s", event, sim.Elapsed()))
+		}
+
+		converged("start")
+		for range 2 {
+			i := sim.Rand().IntN(3)
+			sim.Kill(i)
+			converged(fmt.Sprintf("kill node-%d", i))
+			sim.RunFor(time.Duration(sim.Rand().IntN(100)) * time.Millisecond)
+			sim.Restart(i)
+			converged(fmt.Sprintf("restart node-%d", i))
+		}
+	})
+	return trace
+}
+
+func TestSimulationReplay(t *testing.T) {
+	first := reconnectScenario(t, 42)
+	second := reconnectScenario(t, 42)
+	if !slices.Equal(first, second) {
+		t.Fatalf("Expected same timeline for the same seed:\n%v\n%v", first, second)
+	}
+}
+
+func TestSimulationSeedZero(t *testing.T) {
+	Simulate(t, Options{Nodes: 1}, func(t *testing.T, sim *Simulation) {
+		if sim.Seed != 0 {
+			t.Errorf("Expected seed 0 to be kept, got %d", sim.Seed)
+		}
+	})
+}
+
+func TestSimulationVirtualTime(t *testing.T) {
+	start := time.Now()
+	Simulate(t, Options{Nodes: 2, Seed: 1, Configure: func(i int, cfg *Config) {
+		cfg.HeartbeatInterval = time.Second
+		cfg.IdleTimeout = 5 * time.Second
+		cfg.ReconnectInterval = time.Second
+	}}, func(t *testing.T, sim *Simulation) {
+		if err := sim.RunUntilConverged(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		// A one way partition silences node-1, node-0 closes the connection after the idle timeout
+		sim.Chaos.Partition("node-1", "node-0", true)
+		if !sim.RunUntil(func() bool { return len(sim.Node(0).Peers()) == 0 }, time.Minute) {
+			t.Fatal("Expected idle connection to be closed")
+		}
+		if sim.Elapsed() < 5*time.Second {
+			t.Errorf("Expected idle timeout after 5s of virtual time, got %s", sim.Elapsed())
+		}
+	})
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected virtual time to run faster than the wall clock, took %s", time.Since(start))
+	}
+}
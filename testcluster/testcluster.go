@@ -0,0 +1,414 @@
+/*
+Package testcluster starts several Nodosum nodes in one process for tests.
+
+	c := testcluster.Start(t, testcluster.Options{Nodes: 3})
+	c.WaitConverged(ctx)
+
+	c.Partition([]int{0}, []int{1, 2})
+	c.Heal()
+
+	c.Kill(1)
+	c.Restart(1)
+
+	c.Chaos.SetFault("node-0", "*", testcluster.Fault{Latency: 50 * time.Millisecond})
+
+Nodes listen on ephemeral loopback ports, or on an in-memory network with Options.Memory,
+so any number of clusters can run in parallel. Every node keeps a connection to every other node
+and redials lost ones, so a cluster converges again after kills, restarts and partitions.
+All transports are wrapped by Cluster.Chaos, nodes are named by their IDs in faults.
+All nodes are shut down when the test ends.
+*/
+package testcluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/conamu/mycorrizal/internal/nodosum"
+)
+
+const (
+	DEFAULT_NODES              = 3
+	DEFAULT_SHARED_SECRET      = "testcluster"
+	DEFAULT_RECONNECT_INTERVAL = 20 * time.Millisecond
+)
+
+var errPartitioned = errors.New("connection refused, nodes are partitioned")
+
+// The node types a test configures, aliased so they can be named outside of this module.
+type (
+	// Config is the config of a node, passed to Options.Configure
+	Config = nodosum.Config
+	// Chaos injects faults into the traffic of a cluster
+	Chaos = nodosum.Chaos
+	// Fault describes the faults Chaos injects between two nodes
+	Fault = nodosum.Fault
+	// SimClock is the virtual clock of a Simulation
+	SimClock = nodosum.SimClock
+	// Application is an application registered on a node
+	Application = nodosum.Application
+)
+
+type Options struct {
+	// Nodes is the number of nodes, default DEFAULT_NODES
+	Nodes int
+	// Memory runs the nodes on an in-memory network instead of loopback TCP
+	Memory bool
+	// Logger is used by all nodes, default discards everything
+	Logger *slog.Logger
+	// Seed seeds the random faults of Cluster.Chaos
+	Seed uint64
+	// RandomSeed makes a simulation draw its seed at random instead of using Seed
+	RandomSeed bool
+	// Configure is called with the config of every node before it is started, including restarts
+	Configure func(i int, cfg *Config)
+}
+
+type Node struct {
+	Id   string
+	Addr string
+	*nodosum.Nodosum
+
+	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
+	running bool
+}
+
+type Cluster struct {
+	// Chaos injects faults into the traffic between nodes
+	Chaos *Chaos
+
+	t      testing.TB
+	opts   Options
+	memory *nodosum.MemoryNetwork
+	// clock is the clock of all nodes, nil for the wall clock
+	clock nodosum.Clock
+
+	mu    sync.Mutex
+	nodes []*Node
+	// groups maps node indexes to their partition group, nodes in different groups can not connect
+	groups map[int]int
+	conns  map[*clusterConn]struct{}
+}
+
+// Start starts a cluster and connects all nodes with each other. It fails the test if a node can not be started.
+func Start(t testing.TB, opts Options) *Cluster {
+	t.Helper()
+	return start(t, opts, nil)
+}
+
+func start(t testing.TB, opts Options, clock nodosum.Clock) *Cluster {
+	t.Helper()
+
+	if opts.Nodes <= 0 {
+		opts.Nodes = DEFAULT_NODES
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	c := &Cluster{
+		Chaos: nodosum.NewChaos(opts.Seed),
+		t:     t,
+		opts:  opts,
+		nodes: make([]*Node, opts.Nodes),
+		conns: make(map[*clusterConn]struct{}),
+		clock: clock,
+	}
+	if clock != nil {
+		c.Chaos.SetClock(clock)
+	}
+	if opts.Memory {
+		c.memory = nodosum.NewMemoryNetwork()
+	}
+	t.Cleanup(c.Close)
+
+	for i := range c.nodes {
+		addr := "127.0.0.1:0"
+		if opts.Memory {
+			addr = nodeId(i)
+		}
+		if err := c.start(i, addr); err != nil {
+			t.Fatalf("starting node %d: %v", i, err)
+		}
+	}
+	// Ephemeral ports are only known once the nodes listen
+	if !opts.Memory {
+		for i, node := range c.nodes {
+			for _, peer := range c.nodes[i+1:] {
+				node.AddPeer(peer.Addr)
+			}
+		}
+	}
+	return c
+}
+
+func nodeId(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
+
+// start starts the i-th node. Every pair of nodes is connected by the one with the lower index,
+// so there are no duplicate connections to resolve and the other one waits to be dialed again.
+func (c *Cluster) start(i int, addr string) error {
+	var transport nodosum.Transport
+	if c.memory != nil {
+		transport = c.memory.Transport(addr)
+	} else {
+		transport = nodosum.NewTCPTransport(addr)
+	}
+
+	var peers []string
+	for j := i + 1; j < len(c.nodes); j++ {
+		if c.memory != nil {
+			peers = append(peers, nodeId(j))
+		} else if peer := c.Node(j); peer != nil {
+			peers = append(peers, peer.Addr)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	cfg := &nodosum.Config{
+		NodeId:                 nodeId(i),
+		Ctx:                    ctx,
+		Wg:                     wg,
+		Logger:                 c.opts.Logger.With("node", nodeId(i)),
+		SharedSecret:           DEFAULT_SHARED_SECRET,
+		MultiplexerBufferSize:  1024,
+		MultiplexerWorkerCount: 1,
+		ReconnectInterval:      DEFAULT_RECONNECT_INTERVAL,
+		Peers:                  peers,
+		Clock:                  c.clock,
+		Transport:              c.Chaos.Transport(&clusterTransport{Transport: transport, cluster: c, from: i}, nodeId(i)),
+	}
+	if c.opts.Configure != nil {
+		c.opts.Configure(i, cfg)
+	}
+
+	n, err := nodosum.New(cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	n.Start()
+
+	node := &Node{Id: nodeId(i), Addr: n.Addr(), Nodosum: n, cancel: cancel, wg: wg, running: true}
+	c.mu.Lock()
+	c.nodes[i] = node
+	c.mu.Unlock()
+	c.settle()
+	return nil
+}
+
+// Node returns the i-th node. After a restart it returns the new instance.
+func (c *Cluster) Node(i int) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[i]
+}
+
+// Nodes returns all nodes, including killed ones.
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.nodes)
+}
+
+// Kill shuts the i-th node down, its peers notice the lost connection like after a crash.
+func (c *Cluster) Kill(i int) {
+	c.mu.Lock()
+	node := c.nodes[i]
+	running := node.running
+	node.running = false
+	c.mu.Unlock()
+
+	if running {
+		node.stop()
+		c.settle()
+	}
+}
+
+func (n *Node) stop() {
+	n.cancel()
+	n.Shutdown()
+	n.wg.Wait()
+}
+
+// Restart starts a killed node again with the same ID and address, the other nodes reconnect to it.
+// It fails the test if the node can not be started.
+func (c *Cluster) Restart(i int) {
+	c.t.Helper()
+	c.Kill(i)
+
+	node := c.Node(i)
+	if err := c.start(i, node.Addr); err != nil {
+		c.t.Fatalf("restarting node %d: %v", i, err)
+	}
+}
+
+// Partition splits the cluster into groups of node indexes. Connections between groups are closed
+// and refused until Heal is called, nodes not listed in any group are isolated from all others.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.mu.Lock()
+	c.groups = make(map[int]int)
+	for g, group := range groups {
+		for _, i := range group {
+			c.groups[i] = g
+		}
+	}
+	var cut []*clusterConn
+	for conn := range c.conns {
+		if c.partitioned(conn.from, conn.to) {
+			cut = append(cut, conn)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, conn := range cut {
+		conn.Close()
+	}
+}
+
+// Heal removes all partitions, nodes reconnect within their reconnect interval.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = nil
+}
+
+// partitioned reports whether node from can not reach node to, c.mu has to be held.
+func (c *Cluster) partitioned(from, to int) bool {
+	if c.groups == nil {
+		return false
+	}
+	gFrom, okFrom := c.groups[from]
+	gTo, okTo := c.groups[to]
+	return !okFrom || !okTo || gFrom != gTo
+}
+
+// expectedPeers returns the IDs of the nodes each running node should be connected to, by node index.
+func (c *Cluster) expectedPeers() map[int][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expected := make(map[int][]string)
+	for i, node := range c.nodes {
+		if !node.running {
+			continue
+		}
+		ids := []string{}
+		for j, peer := range c.nodes {
+			if j != i && peer.running && !c.partitioned(i, j) {
+				ids = append(ids, peer.Id)
+			}
+		}
+		slices.Sort(ids)
+		expected[i] = ids
+	}
+	return expected
+}
+
+// Converged reports whether every running node is connected to exactly the nodes it can reach.
+func (c *Cluster) Converged() bool {
+	nodes := c.Nodes()
+	for i, expected := range c.expectedPeers() {
+		ids := []string{}
+		for _, peer := range nodes[i].Peers() {
+			ids = append(ids, peer.NodeId)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitConverged waits until the cluster converged or ctx is done.
+// A Simulation has to use RunUntilConverged instead, its time only moves when it runs.
+func (c *Cluster) WaitConverged(ctx context.Context) error {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !c.Converged() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cluster did not converge: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close shuts down all running nodes, it is called automatically when the test ends.
+func (c *Cluster) Close() {
+	for i := range c.Nodes() {
+		c.Kill(i)
+	}
+}
+
+// indexOf returns the index of the node listening on addr.
+func (c *Cluster) indexOf(addr string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, node := range c.nodes {
+		if node != nil && node.Addr == addr {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// clusterTransport refuses dials across partitions and tracks dialed connections so Partition can cut them.
+type clusterTransport struct {
+	nodosum.Transport
+	cluster *Cluster
+	from    int
+}
+
+func (t *clusterTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	to, ok := t.cluster.indexOf(addr)
+	if !ok {
+		return t.Transport.Dial(ctx, addr)
+	}
+
+	conn, err := t.Transport.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked after dialing so a partition set up meanwhile is not missed
+	t.cluster.mu.Lock()
+	defer t.cluster.mu.Unlock()
+	if t.cluster.partitioned(t.from, to) {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "testcluster", Addr: conn.RemoteAddr(), Err: errPartitioned}
+	}
+	cc := &clusterConn{Conn: conn, cluster: t.cluster, from: t.from, to: to}
+	t.cluster.conns[cc] = struct{}{}
+	return cc, nil
+}
+
+type clusterConn struct {
+	net.Conn
+	cluster   *Cluster
+	from, to  int
+	closeOnce sync.Once
+}
+
+func (c *clusterConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.cluster.mu.Lock()
+		delete(c.cluster.conns, c)
+		c.cluster.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,107 @@
+package testcluster
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitConverged(t *testing.T, c *Cluster) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.WaitConverged(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterConverges(t *testing.T) {
+	for name, memory := range map[string]bool{"tcp": false, "memory": true} {
+		t.Run(name, func(t *testing.T) {
+			c := Start(t, Options{Nodes: 4, Memory: memory})
+			waitConverged(t, c)
+
+			for _, node := range c.Nodes() {
+				if len(node.Peers()) != 3 {
+					t.Errorf("Expected %s to have 3 peers, got %d", node.Id, len(node.Peers()))
+				}
+			}
+		})
+	}
+}
+
+func TestClusterKillRestart(t *testing.T) {
+	c := Start(t, Options{Nodes: 3, Memory: true})
+	waitConverged(t, c)
+
+	c.Kill(1)
+	waitConverged(t, c)
+	if len(c.Node(0).Peers()) != 1 {
+		t.Fatalf("Expected node-0 to lose its connection to node-1, got %d peers", len(c.Node(0).Peers()))
+	}
+
+	c.Restart(1)
+	waitConverged(t, c)
+	if len(c.Node(0).Peers()) != 2 {
+		t.Fatalf("Expected node-0 to reconnect to node-1, got %d peers", len(c.Node(0).Peers()))
+	}
+}
+
+func TestClusterRestartTCP(t *testing.T) {
+	c := Start(t, Options{Nodes: 2})
+	waitConverged(t, c)
+
+	addr := c.Node(1).Addr
+	c.Restart(1)
+	if c.Node(1).Addr != addr {
+		t.Fatalf("Expected restarted node on %s, got %s", addr, c.Node(1).Addr)
+	}
+	waitConverged(t, c)
+}
+
+func TestClusterPartition(t *testing.T) {
+	c := Start(t, Options{Nodes: 3, Memory: true})
+	waitConverged(t, c)
+
+	c.Partition([]int{0}, []int{1, 2})
+	waitConverged(t, c)
+	if len(c.Node(0).Peers()) != 0 {
+		t.Errorf("Expected node-0 to be isolated, got %d peers", len(c.Node(0).Peers()))
+	}
+	if len(c.Node(1).Peers()) != 1 {
+		t.Errorf("Expected node-1 to only reach node-2, got %d peers", len(c.Node(1).Peers()))
+	}
+
+	// Partitions hold while nodes keep redialing
+	time.Sleep(10 * DEFAULT_RECONNECT_INTERVAL)
+	if len(c.Node(0).Peers()) != 0 {
+		t.Error("Expected partition to refuse reconnects")
+	}
+
+	c.Heal()
+	waitConverged(t, c)
+	if len(c.Node(0).Peers()) != 2 {
+		t.Errorf("Expected node-0 to reconnect after heal, got %d peers", len(c.Node(0).Peers()))
+	}
+}
+
+func TestClusterChaos(t *testing.T) {
+	c := Start(t, Options{Nodes: 2, Memory: true, Configure: func(i int, cfg *Config) {
+		cfg.HeartbeatInterval = 10 * time.Millisecond
+	}})
+	waitConverged(t, c)
+
+	c.Chaos.SetFault("node-1", "node-0", Fault{Latency: 30 * time.Millisecond})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peers := c.Node(0).Peers()
+		if len(peers) == 1 && peers[0].RTT >= 20*time.Millisecond {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected latency of pongs to show in the RTT of node-0, got %v", peers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
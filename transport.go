@@ -0,0 +1,35 @@
+package mycorrizal
+
+import "github.com/conamu/mycorrizal/internal/nodosum"
+
+// Transport provides the network a node runs on, see Config.Transport.
+type Transport = nodosum.Transport
+
+// MemoryNetwork connects nodes within one process without any ports or sockets.
+type MemoryNetwork = nodosum.MemoryNetwork
+
+// Chaos injects faults into the traffic of transports wrapped with Chaos.Transport.
+type Chaos = nodosum.Chaos
+
+// Fault describes the faults injected into the traffic from one node to another.
+type Fault = nodosum.Fault
+
+// NewTCPTransport returns a transport listening on TCP and UDP on addr, e.g. ":6969".
+func NewTCPTransport(addr string) Transport {
+	return nodosum.NewTCPTransport(addr)
+}
+
+// NewUnixTransport returns a transport listening on the Unix domain socket path.
+func NewUnixTransport(path string) Transport {
+	return nodosum.NewUnixTransport(path)
+}
+
+// NewMemoryNetwork returns an empty in-memory network, MemoryNetwork.Transport adds a node to it.
+func NewMemoryNetwork() *MemoryNetwork {
+	return nodosum.NewMemoryNetwork()
+}
+
+// NewChaos returns a fault injection controller, random faults are drawn from a generator seeded with seed.
+func NewChaos(seed uint64) *Chaos {
+	return nodosum.NewChaos(seed)
+}